@@ -5,13 +5,18 @@ import (
 	"fmt"
 	"github.com/marcopoloprotocol/flyclientDemo/common"
 	"github.com/marcopoloprotocol/flyclientDemo/diskdb"
+	"github.com/marcopoloprotocol/flyclientDemo/diskdb/lvldb"
 	"github.com/marcopoloprotocol/flyclientDemo/diskdb/memorydb"
 	"github.com/marcopoloprotocol/flyclientDemo/mmr"
 	"github.com/marcopoloprotocol/flyclientDemo/rlp"
 	"math/big"
+	"sync"
 )
 
-var RightDif = big.NewInt(100000)
+const (
+	dbCache   = 16 // megabytes of leveldb cache
+	dbHandles = 16 // leveldb file handles
+)
 
 func getDB() diskdb.Database {
 	return memorydb.New()
@@ -20,6 +25,7 @@ func getDB() diskdb.Database {
 type Block struct {
 	Nonce      uint64      `json:"nonce"`
 	Number     uint64      `json:"height"`
+	Time       uint64      `json:"timestamp"`
 	PreHash    common.Hash `json:"parentId"`
 	Difficulty *big.Int    `json:"difficulty"`
 	MRoot      common.Hash `json:"m_root"`
@@ -32,27 +38,52 @@ func NewBlock(num uint64, nonce uint64, diff *big.Int) *Block {
 	}
 }
 
+// Hash returns the hash of b under SHA3, the default hasher of the chain and
+// the one proof-of-work seals with.
 func (b Block) Hash() common.Hash {
-	return mmr.RlpHash(b)
+	return b.HashWith(mmr.SHA3)
+}
+
+// HashWith returns the hash of b under h. A chain identifies its blocks by
+// their hash under the hasher of its MMR.
+func (b Block) HashWith(h mmr.Hasher) common.Hash {
+	return mmr.RlpHashWith(h, b)
+}
+
+// leaf returns the MMR leaf of b hashed with h, which carries its time for
+// the chain's mmr.TimeRangeMerger.
+func (b *Block) leaf(h mmr.Hasher) *mmr.Node {
+	return mmr.NewNodeWithPayload(b.HashWith(h), b.Difficulty, mmr.TimeRangePayload(b.Time, b.Time))
 }
 
 func (b Block) String() string {
 
 	return fmt.Sprintf(`Header(%s):
 Height:	        %d
+Time:           %d
 Prehash:        %s
 Difficulty      %s
 Mmr:            %s
 ____________________________________________________________
-`, b.Hash(), b.Number, b.PreHash, b.Difficulty, b.MRoot)
+`, b.Hash(), b.Number, b.Time, b.PreHash, b.Difficulty, b.MRoot)
 }
 
+// BlockChain is safe for one writer and many readers: blocks are imported one
+// at a time while proofs are served concurrently, each from a snapshot of the
+// MMR taken when it starts.
 type BlockChain struct {
+	mu      sync.RWMutex // guards header, params and reorgSubs, held for writing by imports
+	proving sync.RWMutex // held for reading by proofs in progress, reorgs wait for them
+
 	genesis *Block
-	blocks  []*Block
 	header  *Block
 	db      diskdb.Database
 	Mmr     *mmr.Mmr
+
+	engine Engine
+	params *mmr.ProofParams // parameters of the proofs served
+
+	reorgSubs []chan<- ReorgEvent
 }
 
 var genesisBlock = &Block{
@@ -63,58 +94,465 @@ var genesisBlock = &Block{
 	MRoot:      common.Hash{},
 }
 
-func NewBlockChain() (bc *BlockChain) {
-	bc = &BlockChain{
-		header:  genesisBlock,
+// NewBlockChain creates a block chain kept in an in-memory database, hashing
+// with SHA3.
+func NewBlockChain(engine Engine) (bc *BlockChain) {
+	return NewBlockChainWithHasher(engine, mmr.SHA3)
+}
+
+// NewBlockChainWithHasher is like NewBlockChain, but hashes blocks and the
+// MMR with h.
+func NewBlockChainWithHasher(engine Engine, h mmr.Hasher) *BlockChain {
+	bc, err := newBlockChain(getDB(), engine, h)
+	if err != nil {
+		panic(err)
+	}
+	return bc
+}
+
+// OpenBlockChain opens the block chain stored in the leveldb database at
+// datadir, resuming from its stored head, or initializes it with the genesis
+// block if the database is empty. It hashes with SHA3.
+func OpenBlockChain(datadir string, engine Engine) (*BlockChain, error) {
+	return OpenBlockChainWithHasher(datadir, engine, mmr.SHA3)
+}
+
+// OpenBlockChainWithHasher is like OpenBlockChain, but hashes blocks and the
+// MMR with h. A stored chain must have been created with it too.
+func OpenBlockChainWithHasher(datadir string, engine Engine, h mmr.Hasher) (*BlockChain, error) {
+	db, err := lvldb.New(datadir, dbCache, dbHandles, "chaindata/")
+	if err != nil {
+		return nil, err
+	}
+	bc, err := newBlockChain(db, engine, h)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return bc, nil
+}
+
+func newBlockChain(db diskdb.Database, engine Engine, h mmr.Hasher) (*BlockChain, error) {
+	m, err := mmr.OpenMMRWithMerger(db, mmrPrefix, h, mmr.TimeRangeMerger)
+	if err != nil {
+		return nil, err
+	}
+	bc := &BlockChain{
 		genesis: genesisBlock,
-		blocks:  []*Block{genesisBlock},
-		Mmr:     mmr.NewMMR(),
-		db:      getDB(),
+		db:      db,
+		Mmr:     m,
+		engine:  engine,
+		params:  DefaultProofParams(),
+	}
+	bc.params.Hasher = h.ID()
+	headHash, ok := readHeadHash(db)
+	if !ok {
+		// A crash while writing the genesis block may have left its leaf.
+		for m.GetLeafNumber() > 0 {
+			m.Pop()
+		}
+		return bc, bc.writeGenesis()
+	}
+	if bc.header, err = readBlock(db, headHash); err != nil {
+		return nil, fmt.Errorf("missing head block %s: %v", headHash, err)
+	}
+	if stored, err := readCanonicalHash(db, 0); err != nil || stored != bc.hash(genesisBlock) {
+		return nil, errors.New("database contains an incompatible genesis block")
+	}
+	if err := bc.recoverMmr(); err != nil {
+		return nil, err
+	}
+	return bc, nil
+}
+
+// recoverMmr brings the MMR back to the canonical chain. The MMR is flushed
+// before the head moves, so a crash in between leaves it with the leaves of
+// blocks past the head, or of the branch a reorg was switching to. It is popped
+// back to the newest canonical block whose MRoot it matches, bagging the peaks
+// again as the nodes bagging them may have been overwritten by the pushes that
+// were cut short, and the leaves of the canonical blocks from there up to the
+// head are pushed again.
+func (bc *BlockChain) recoverMmr() error {
+	head := bc.header
+	for bc.Mmr.GetLeafNumber() > head.Number {
+		bc.Mmr.Pop()
+	}
+	// The genesis block commits to the empty MMR, the walk ends there.
+	n := bc.Mmr.GetLeafNumber()
+	for ; n > 0; n-- {
+		b, err := bc.GetBlockByNumber(n)
+		if err != nil {
+			return fmt.Errorf("missing canonical block #%d: %v", n, err)
+		}
+		if bc.Mmr.GetRoot() == b.MRoot {
+			break
+		}
+		bc.Mmr.Pop()
+	}
+	for ; n <= head.Number; n++ {
+		b, err := bc.GetBlockByNumber(n)
+		if err != nil {
+			return fmt.Errorf("missing canonical block #%d: %v", n, err)
+		}
+		bc.Mmr.Push(b.leaf(bc.Mmr.Hasher()))
+	}
+	return bc.Mmr.Flush()
+}
+
+func (bc *BlockChain) writeGenesis() error {
+	bc.header = genesisBlock
+	bc.Mmr.Push(genesisBlock.leaf(bc.Mmr.Hasher()))
+	if err := bc.Mmr.Flush(); err != nil {
+		return err
 	}
-	node := mmr.NewNode(genesisBlock.Hash(), big.NewInt(0))
-	bc.Mmr.Push(node)
-	ghash := genesisBlock.Hash().Bytes()
-	genc, _ := rlp.EncodeToBytes(genesisBlock)
-	bc.db.Put(ghash, genc)
-	return
+	hash := bc.hash(genesisBlock)
+	batch := bc.db.NewBatch()
+	if err := writeBlock(batch, hash, genesisBlock); err != nil {
+		return err
+	}
+	if err := writeTd(batch, hash, genesisBlock.Difficulty); err != nil {
+		return err
+	}
+	if err := writeCanonicalHash(batch, 0, hash); err != nil {
+		return err
+	}
+	if err := writeHeadHash(batch, hash); err != nil {
+		return err
+	}
+	return batch.Write()
 }
 
+// InsertBlock appends a locally built block to the chain. PreHash and MRoot
+// are filled in from the current head, as are the difficulty and time if
+// unset, and the block is sealed by the consensus engine before it is
+// validated. Blocks without a time are stamped TargetBlockTime after the
+// head, the pace the difficulty aims at.
 func (bc *BlockChain) InsertBlock(b *Block) error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
 	if b.Number == 0 {
-		return errors.New("can not add genesis block")
+		return invalidBlock(b, ErrGenesisBlock, "")
 	}
 
-	b.PreHash = bc.header.Hash()
+	b.PreHash = bc.hash(bc.header)
 
 	b.MRoot = bc.Mmr.GetRoot()
 
-	node := mmr.NewNode(b.Hash(), b.Difficulty)
-	bc.Mmr.Push(node)
+	if b.Time == 0 {
+		b.Time = bc.header.Time + TargetBlockTime
+	}
+	if b.Difficulty == nil {
+		b.Difficulty = bc.engine.CalcDifficulty(bc.header, bc.Mmr.GetRootNode())
+	}
+	if err := bc.engine.Seal(b, nil); err != nil {
+		return err
+	}
+	return bc.withHash(b, bc.importBlock(b))
+}
+
+// ImportBlock adds an externally built block to the chain as is. The block
+// may extend the head or any other known block; side chain blocks are stored
+// and the chain is reorganized once a branch has more total difficulty than
+// the canonical one. Invalid blocks are rejected with a *ValidationError.
+func (bc *BlockChain) ImportBlock(b *Block) error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return bc.withHash(b, bc.importBlock(b))
+}
 
-	//bc.header = bc.blocks[len(bc.blocks)]
-	enc, err := rlp.EncodeToBytes(b)
+func (bc *BlockChain) importBlock(b *Block) error {
+	if b.Number == 0 {
+		return invalidBlock(b, ErrGenesisBlock, "")
+	}
+	hash := bc.hash(b)
+	if ok, _ := bc.db.Has(blockKey(hash)); ok {
+		return invalidBlock(b, ErrKnownBlock, "")
+	}
+	if b.PreHash == bc.hash(bc.header) {
+		if err := bc.validateBlock(bc.header, bc.Mmr.GetRootNode(), b); err != nil {
+			return err
+		}
+		td, err := bc.childTd(bc.header, b)
+		if err != nil {
+			return err
+		}
+		return bc.extendHead(b, td)
+	}
+	parent, err := readBlock(bc.db, b.PreHash)
+	if err != nil {
+		return invalidBlock(b, ErrUnknownParent, "parent %s", b.PreHash)
+	}
+	peaks, err := bc.peaksOf(parent)
+	if err != nil {
+		return err
+	}
+	if err := bc.validateBlock(parent, bc.Mmr.BagPeaks(peaks), b); err != nil {
+		return err
+	}
+	td, err := bc.childTd(parent, b)
+	if err != nil {
+		return err
+	}
+	batch := bc.db.NewBatch()
+	if err := writeBlock(batch, hash, b); err != nil {
+		return err
+	}
+	if err := writeTd(batch, hash, td); err != nil {
+		return err
+	}
+	if err := writePeaks(batch, hash, bc.Mmr.AppendToPeaks(peaks, parent.Number+1, b.leaf(bc.Mmr.Hasher()))); err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	htd, err := readTd(bc.db, bc.hash(bc.header))
 	if err != nil {
 		return err
 	}
-	bc.db.Put(b.Hash().Bytes(), enc)
-	bc.blocks = append(bc.blocks, b)
+	// Ties keep the current head, the first branch seen wins.
+	if td.Cmp(htd) > 0 {
+		return bc.reorg(b)
+	}
+	return nil
+}
+
+// extendHead appends b, a valid child of the head, to the canonical chain.
+func (bc *BlockChain) extendHead(b *Block, td *big.Int) error {
+	bc.Mmr.Push(b.leaf(bc.Mmr.Hasher()))
+	if err := bc.writeHead(b, td); err != nil {
+		bc.truncateMmr()
+		return err
+	}
 	bc.header = b
 	return nil
 }
 
+// writeHead writes b, whose leaf has been pushed to the MMR, as the new head.
+func (bc *BlockChain) writeHead(b *Block, td *big.Int) error {
+	// The MMR is flushed before the head moves, so a crash in between leaves
+	// the stored head behind the MMR rather than ahead of it, and recoverMmr
+	// drops the extra leaf on open.
+	if err := bc.Mmr.Flush(); err != nil {
+		return err
+	}
+	hash := bc.hash(b)
+	batch := bc.db.NewBatch()
+	if err := writeTd(batch, hash, td); err != nil {
+		return err
+	}
+	if err := writeBlock(batch, hash, b); err != nil {
+		return err
+	}
+	if err := writeCanonicalHash(batch, b.Number, hash); err != nil {
+		return err
+	}
+	if err := writeHeadHash(batch, hash); err != nil {
+		return err
+	}
+	return batch.Write()
+}
+
+// truncateMmr drops the leaves of blocks past the head from the MMR, after
+// a failed attempt to append them.
+func (bc *BlockChain) truncateMmr() {
+	for bc.Mmr.GetLeafNumber() > bc.header.Number+1 {
+		bc.Mmr.Pop()
+	}
+}
+
+// childTd returns the total difficulty of b, a child of parent.
+func (bc *BlockChain) childTd(parent, b *Block) (*big.Int, error) {
+	ptd, err := readTd(bc.db, bc.hash(parent))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).Add(ptd, b.Difficulty), nil
+}
+
+// peaksOf returns the peaks of the MMR over all blocks up to and including b.
+// They are read from the canonical MMR for canonical blocks and from the
+// database for side chain blocks.
+func (bc *BlockChain) peaksOf(b *Block) ([]*mmr.Node, error) {
+	hash := bc.hash(b)
+	if stored, err := readCanonicalHash(bc.db, b.Number); err == nil && stored == hash {
+		return bc.Mmr.PeaksAt(b.Number + 1), nil
+	}
+	return readPeaks(bc.db, hash)
+}
+
+// hash returns the hash identifying b in the chain, under the hasher of its
+// MMR.
+func (bc *BlockChain) hash(b *Block) common.Hash {
+	return b.HashWith(bc.Mmr.Hasher())
+}
+
+// GetTd returns the total difficulty of the chain up to and including the
+// block with the given hash.
+func (bc *BlockChain) GetTd(hash common.Hash) (*big.Int, error) {
+	return readTd(bc.db, hash)
+}
+
+// Engine returns the consensus engine of the chain.
+func (bc *BlockChain) Engine() Engine {
+	return bc.engine
+}
+
 func (bc *BlockChain) Len() int {
-	return len(bc.blocks)
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return int(bc.header.Number) + 1
+}
+
+// CurrentBlock returns the head of the chain.
+func (bc *BlockChain) CurrentBlock() *Block {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.header
 }
 
-func (bc *BlockChain) GetTailMmr() *mmr.Mmr {
-	m := bc.Mmr.Copy()
+// GetBlockByHash retrieves a block from the database by hash.
+func (bc *BlockChain) GetBlockByHash(hash common.Hash) (*Block, error) {
+	return readBlock(bc.db, hash)
+}
+
+// GetBlockByNumber retrieves the canonical block at the given height.
+func (bc *BlockChain) GetBlockByNumber(number uint64) (*Block, error) {
+	hash, err := readCanonicalHash(bc.db, number)
+	if err != nil {
+		return nil, err
+	}
+	return readBlock(bc.db, hash)
+}
+
+// Close flushes the MMR and closes the underlying database.
+func (bc *BlockChain) Close() error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if err := bc.Mmr.Flush(); err != nil {
+		return err
+	}
+	return bc.db.Close()
+}
+
+// GetTailMmr returns the MMR committed to by the head block, i.e. the one of
+// all blocks before it. It is a copy-on-write snapshot of the chain's MMR,
+// cheap to take however long the chain is. Inserts leave it intact, while
+// reorgs wait until release is called, as they pop the nodes it shares.
+func (bc *BlockChain) GetTailMmr() (m *mmr.Mmr, release func()) {
+	m, _, release = bc.tail()
+	return m, release
+}
+
+// tail returns the MMR committed to by the head block, like GetTailMmr, and
+// the proof parameters. Until release is called, reorgs wait rather than pop
+// the MMR below the snapshot, so proofs made from it stay consistent while
+// blocks keep being inserted.
+func (bc *BlockChain) tail() (m *mmr.Mmr, params *mmr.ProofParams, release func()) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	bc.proving.RLock()
+	m = bc.Mmr.Snapshot()
 	m.Pop()
-	return m
+	return m, bc.params, bc.proving.RUnlock
+}
+
+// SetProofParams sets the parameters of the proofs created from now on.
+func (bc *BlockChain) SetProofParams(params *mmr.ProofParams) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.params = params.Copy()
+}
+
+// GetProof creates a FlyClient proof of the canonical chain, carrying the
+// headers of all sampled blocks.
+func (bc *BlockChain) GetProof() (*mmr.ProofInfo, error) {
+	m, params, release := bc.tail()
+	defer release()
+	return bc.newProof(m, params)
+}
+
+// GetProofAt creates a FlyClient proof of the canonical chain as of block
+// number, i.e. of the MMR committed to by that block's MRoot, carrying the
+// headers of all sampled blocks. The stored MMR is viewed, not copied.
+func (bc *BlockChain) GetProofAt(number uint64) (*mmr.ProofInfo, error) {
+	m, params, release, err := bc.viewAt(number)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return bc.newProof(m, params)
+}
+
+// newProof creates a FlyClient proof of m. The MMR committed to by the genesis
+// block is empty, there is nothing to sample from it.
+func (bc *BlockChain) newProof(m *mmr.Mmr, params *mmr.ProofParams) (*mmr.ProofInfo, error) {
+	if m.GetLeafNumber() == 0 {
+		return nil, fmt.Errorf("%w: no blocks before the proven one", mmr.ErrLeafRange)
+	}
+	res, _ := m.CreateNewProof(params)
+	return bc.withHeaders(res)
+}
+
+// viewAt is like tail for the MMR committed to by block number.
+func (bc *BlockChain) viewAt(number uint64) (*mmr.Mmr, *mmr.ProofParams, func(), error) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	if number > bc.header.Number {
+		return nil, nil, nil, fmt.Errorf("%w: #%d, head is #%d", ErrBlockNotFound, number, bc.header.Number)
+	}
+	m, err := bc.Mmr.PrefixAt(number)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	bc.proving.RLock()
+	return m, bc.params, bc.proving.RUnlock, nil
 }
 
-func (bc *BlockChain) GetProof() *mmr.ProofInfo {
-	m := bc.GetTailMmr()
+// GetIncrementalProof creates a proof for a light client which already trusts
+// the MMR of the first trusted blocks, sampling only the blocks after them.
+// Light clients behind the kept checkpoints get mmr.ErrStaleCheckpoint.
+func (bc *BlockChain) GetIncrementalProof(trusted uint64) (*mmr.IncrementalProof, error) {
+	m, params, release := bc.tail()
+	defer release()
+	p, err := m.CreateIncrementalProof(params, trusted)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := bc.withHeaders(p.Proof); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
 
-	res, _, _ := m.CreateNewProof(RightDif)
-	return res
+// ProveBlocks proves the given blocks against the MMR of GetProof, it
+// implements mmr.Prover.
+func (bc *BlockChain) ProveBlocks(blocks []uint64) (*mmr.ProofInfo, error) {
+	m, _, release := bc.tail()
+	defer release()
+	return bc.withHeaders(m.ProveBlocks(blocks))
+}
+
+// ProveWeights proves the blocks containing the given aggregated difficulties
+// against the MMR of GetProof, it implements mmr.Prover.
+func (bc *BlockChain) ProveWeights(weights []*big.Int) (*mmr.ProofInfo, error) {
+	m, _, release := bc.tail()
+	defer release()
+	return bc.withHeaders(m.ProveBlocks(m.BlocksByWeight(weights)))
+}
+
+// withHeaders attaches the canonical headers of the checked blocks to proof.
+func (bc *BlockChain) withHeaders(proof *mmr.ProofInfo) (*mmr.ProofInfo, error) {
+	for _, n := range mmr.SortAndRemoveRepeatForBlocks(append([]uint64{}, proof.Checked...)) {
+		b, err := bc.GetBlockByNumber(n)
+		if err != nil {
+			return nil, err
+		}
+		enc, err := rlp.EncodeToBytes(b)
+		if err != nil {
+			return nil, err
+		}
+		proof.Headers = append(proof.Headers, enc)
+	}
+	return proof, nil
 }
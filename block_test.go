@@ -1,32 +1,42 @@
 package flyclientdemo
 
 import (
+	"errors"
 	"fmt"
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+	"github.com/marcopoloprotocol/flyclientDemo/diskdb/memorydb"
 	"github.com/marcopoloprotocol/flyclientDemo/mmr"
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math"
 	"math/big"
+	"os"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestBlockChain_GetProof(t *testing.T) {
-	bc := NewBlockChain()
+	bc := NewBlockChain(NewFakeEngine())
 	length := 500000
 
-	for i := 0; i < length; i++ {
-		b := NewBlock(uint64(i), 2, big.NewInt(10000))
-		bc.InsertBlock(b)
+	for i := 1; i <= length; i++ {
+		b := NewBlock(uint64(i), 2, big.NewInt(4096))
+		if err := bc.InsertBlock(b); err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
 	}
 
 	start := time.Now()
-	proof := bc.GetProof()
+	proof, err := bc.GetProof()
+	assert.NoError(t, err)
 	fmt.Println(len(proof.Elems))
 
 	fmt.Println("gen proof cost:", time.Now().Sub(start))
 	start = time.Now()
-	pBlocks, err := mmr.VerifyRequiredBlocks(proof, RightDif)
+	pBlocks, err := mmr.VerifyRequiredBlocks(proof, DefaultProofParams())
 	assert.NoError(t, err)
-	assert.True(t, proof.VerifyProof(pBlocks))
+	assert.True(t, proof.VerifyProof(pBlocks, DecodeSampledHeader))
 
 	fmt.Println("verify cost:", time.Now().Sub(start))
 
@@ -42,3 +52,438 @@ func TestBlockChain_GetProof(t *testing.T) {
 	//wg.Wait()
 	//fmt.Println("All goroutines finished!")
 }
+
+func TestBlockChain_GetProofAt(t *testing.T) {
+	bc := newSealedChain(t, 2000)
+	lc, _ := NewLightClient(memorydb.New(), NewPoW(), nil)
+
+	proof, err := bc.GetProofAt(1500)
+	assert.NoError(t, err)
+	b, err := bc.GetBlockByNumber(1500)
+	assert.NoError(t, err)
+	assert.Equal(t, b.MRoot, proof.RootHash)
+	assert.Equal(t, uint64(1500), proof.LeafNumber)
+	assert.NoError(t, lc.Verify(proof))
+
+	head, err := bc.GetProofAt(bc.CurrentBlock().Number)
+	assert.NoError(t, err)
+	tail, err := bc.GetProof()
+	assert.NoError(t, err)
+	assert.Equal(t, tail.String(), head.String())
+	assert.NoError(t, lc.Verify(head))
+	m, release := bc.GetTailMmr()
+	assert.Equal(t, bc.CurrentBlock().MRoot, m.GetRoot())
+	release()
+
+	_, err = bc.GetProofAt(2001)
+	assert.True(t, errors.Is(err, ErrBlockNotFound))
+	_, err = bc.GetProofAt(0)
+	assert.True(t, errors.Is(err, mmr.ErrLeafRange))
+	// Nothing precedes the head of a new chain.
+	_, err = NewBlockChain(NewPoW()).GetProof()
+	assert.True(t, errors.Is(err, mmr.ErrLeafRange))
+}
+
+func TestBlockChain_Hasher(t *testing.T) {
+	bc := NewBlockChainWithHasher(NewPoW(), mmr.Keccak256)
+	for i := 1; i <= 300; i++ {
+		assert.NoError(t, bc.InsertBlock(NewBlock(uint64(i), 0, big.NewInt(256))))
+	}
+	head := bc.CurrentBlock()
+	parent, err := bc.GetBlockByNumber(head.Number - 1)
+	assert.NoError(t, err)
+	assert.Equal(t, parent.HashWith(mmr.Keccak256), head.PreHash)
+	assert.NotEqual(t, parent.Hash(), head.PreHash)
+	_, err = bc.GetBlockByHash(head.HashWith(mmr.Keccak256))
+	assert.NoError(t, err)
+	checkCanonicalMmr(t, bc)
+
+	// Side chain blocks and reorgs identify blocks by the same hash.
+	b := buildChild(t, bc, parent, 257)
+	assert.NoError(t, bc.ImportBlock(b))
+	assert.Equal(t, b.HashWith(mmr.Keccak256), bc.CurrentBlock().HashWith(mmr.Keccak256))
+	checkCanonicalMmr(t, bc)
+
+	proof, err := bc.GetProof()
+	assert.NoError(t, err)
+	assert.Equal(t, mmr.HashKeccak256, proof.Hasher)
+	params := DefaultProofParams()
+	params.Hasher = mmr.HashKeccak256
+	lc, err := NewLightClient(memorydb.New(), NewPoW(), params)
+	assert.NoError(t, err)
+	assert.NoError(t, lc.Verify(proof))
+	lc, _ = NewLightClient(memorydb.New(), NewPoW(), nil)
+	assert.True(t, errors.Is(lc.Verify(proof), ErrInvalidProof))
+}
+
+func TestBlockChain_Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flyclient-chain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bc, err := OpenBlockChain(dir, NewFakeEngine())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 1000; i++ {
+		assert.NoError(t, bc.InsertBlock(NewBlock(uint64(i), 2, big.NewInt(4096))))
+	}
+	head, root := bc.CurrentBlock(), bc.Mmr.GetRoot()
+	assert.NoError(t, bc.Close())
+
+	bc, err = OpenBlockChain(dir, NewFakeEngine())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	assert.Equal(t, head.Hash(), bc.CurrentBlock().Hash())
+	assert.Equal(t, root, bc.Mmr.GetRoot())
+	assert.Equal(t, 1001, bc.Len())
+
+	b, err := bc.GetBlockByNumber(500)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(500), b.Number)
+
+	next := NewBlock(1001, 2, big.NewInt(4096))
+	assert.NoError(t, bc.InsertBlock(next))
+	assert.Equal(t, root, next.MRoot)
+	assert.Equal(t, head.Hash(), next.PreHash)
+}
+
+func TestBlockChain_RecoverMmr(t *testing.T) {
+	db := memorydb.New()
+	bc, err := newBlockChain(db, NewFakeEngine(), mmr.SHA3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 100; i++ {
+		assert.NoError(t, bc.InsertBlock(NewBlock(uint64(i), 2, big.NewInt(4096))))
+	}
+	head, root := bc.CurrentBlock(), bc.Mmr.GetRoot()
+
+	// A crash after the MMR was flushed but before the head moved.
+	for i := 101; i <= 103; i++ {
+		b := NewBlock(uint64(i), 2, big.NewInt(4096))
+		bc.Mmr.Push(b.leaf(mmr.SHA3))
+	}
+	assert.NoError(t, bc.Mmr.Flush())
+
+	bc, err = newBlockChain(db, NewFakeEngine(), mmr.SHA3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, head.Hash(), bc.CurrentBlock().Hash())
+	assert.Equal(t, root, bc.Mmr.GetRoot())
+	assert.Equal(t, uint64(101), bc.Mmr.GetLeafNumber())
+	next := NewBlock(101, 2, big.NewInt(4096))
+	assert.NoError(t, bc.InsertBlock(next))
+	assert.Equal(t, root, next.MRoot)
+
+	// A crash while writing the genesis block.
+	db = memorydb.New()
+	m, err := mmr.OpenMMRWithMerger(db, mmrPrefix, mmr.SHA3, mmr.TimeRangeMerger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Push(genesisBlock.leaf(mmr.SHA3))
+	assert.NoError(t, m.Flush())
+	bc, err = newBlockChain(db, NewFakeEngine(), mmr.SHA3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(1), bc.Mmr.GetLeafNumber())
+	assert.NoError(t, bc.InsertBlock(NewBlock(1, 2, big.NewInt(4096))))
+}
+
+// Run with -race: proofs served while blocks are imported, including reorgs,
+// must be consistent with the canonical chain at some point in time.
+func TestBlockChain_ConcurrentProofs(t *testing.T) {
+	bc := newSealedChain(t, 200)
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				proof, err := bc.GetProof()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if err := proof.VerifyHeaders(DecodeSampledHeader); err != nil {
+					t.Errorf("proof of %d blocks: %v", proof.LeafNumber, err)
+					return
+				}
+				pBlocks, err := mmr.VerifyRequiredBlocks(proof, DefaultProofParams())
+				if err != nil || !proof.VerifyProof(pBlocks, DecodeSampledHeader) {
+					t.Errorf("proof of %d blocks rejected: %v", proof.LeafNumber, err)
+					return
+				}
+				bc.CurrentBlock()
+				bc.Len()
+			}
+		}()
+	}
+	// Extend the head, then switch to a heavier branch forking off below it
+	// every 50 blocks.
+	for i := 0; i < 300; i++ {
+		head := bc.CurrentBlock()
+		if i%50 == 49 {
+			parent, _ := bc.GetBlockByNumber(head.Number - 3)
+			for j := 0; j < 4; j++ {
+				parent = buildChild(t, bc, parent, 257)
+				assert.NoError(t, bc.ImportBlock(parent))
+			}
+			assert.Equal(t, parent.Hash(), bc.CurrentBlock().Hash())
+			continue
+		}
+		assert.NoError(t, bc.ImportBlock(buildChild(t, bc, head, 256)))
+	}
+	close(done)
+	wg.Wait()
+	checkCanonicalMmr(t, bc)
+}
+
+// sealTestBlock searches a nonce satisfying the proof-of-work target of b.
+func sealTestBlock(b *Block) {
+	if err := NewPoW().Seal(b, nil); err != nil {
+		panic(err)
+	}
+}
+
+func TestBlockChain_ImportBlock(t *testing.T) {
+	bc := NewBlockChain(NewPoW())
+	build := func(parent *Block, diff int64) *Block {
+		b := NewBlock(parent.Number+1, 0, big.NewInt(diff))
+		b.PreHash, b.MRoot = parent.Hash(), bc.Mmr.GetRoot()
+		b.Time = parent.Time + TargetBlockTime
+		sealTestBlock(b)
+		return b
+	}
+	b1 := build(bc.CurrentBlock(), 4096)
+	assert.NoError(t, bc.ImportBlock(b1))
+
+	tests := []struct {
+		corrupt func(b *Block)
+		err     error
+	}{
+		{func(b *Block) { b.Number = 0 }, ErrGenesisBlock},
+		{func(b *Block) { b.Number++ }, ErrInvalidNumber},
+		{func(b *Block) { b.PreHash = common.Hash{1} }, ErrUnknownParent},
+		{func(b *Block) { b.MRoot = common.Hash{1} }, ErrInvalidMRoot},
+		{func(b *Block) { b.Difficulty = big.NewInt(4096 + 3) }, ErrInvalidDifficulty},
+		{func(b *Block) { b.Difficulty = big.NewInt(0) }, ErrInvalidDifficulty},
+		{func(b *Block) { b.Time = b1.Time }, ErrInvalidTime},
+		{func(b *Block) {
+			for b.Nonce++; NewPoW().VerifySeal(b) == nil; b.Nonce++ {
+			}
+		}, ErrInvalidPoW},
+	}
+	for i, tt := range tests {
+		b := build(b1, 4097)
+		tt.corrupt(b)
+		if tt.err != ErrInvalidPoW && tt.err != ErrInvalidDifficulty {
+			sealTestBlock(b)
+		}
+		err := bc.ImportBlock(b)
+		var verr *ValidationError
+		if !errors.As(err, &verr) || !errors.Is(err, tt.err) {
+			t.Errorf("test %d: have error %v, want %v", i, err, tt.err)
+		}
+	}
+	assert.Equal(t, b1.Hash(), bc.CurrentBlock().Hash())
+
+	b2 := build(b1, 4097)
+	assert.NoError(t, bc.ImportBlock(b2))
+	assert.Equal(t, 3, bc.Len())
+}
+
+// buildChild builds a sealed child of parent, which must be known to bc.
+func buildChild(t *testing.T, bc *BlockChain, parent *Block, diff int64) *Block {
+	peaks, err := bc.peaksOf(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewBlock(parent.Number+1, 0, big.NewInt(diff))
+	b.PreHash, b.MRoot = bc.hash(parent), bc.Mmr.BagPeaks(peaks).GetHash()
+	b.Time = parent.Time + TargetBlockTime
+	sealTestBlock(b)
+	return b
+}
+
+// checkCanonicalMmr checks the MMR of bc against one built from scratch over
+// its canonical blocks.
+func checkCanonicalMmr(t *testing.T, bc *BlockChain) {
+	want := mmr.NewMMRWithMerger(bc.Mmr.Hasher(), mmr.TimeRangeMerger)
+	for n := uint64(0); n <= bc.CurrentBlock().Number; n++ {
+		b, err := bc.GetBlockByNumber(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want.Push(b.leaf(bc.Mmr.Hasher()))
+	}
+	assert.Equal(t, want.GetRoot(), bc.Mmr.GetRoot())
+	assert.Equal(t, want.GetLeafNumber(), bc.Mmr.GetLeafNumber())
+}
+
+func TestBlockChain_Reorg(t *testing.T) {
+	bc := NewBlockChain(NewPoW())
+	events := make(chan ReorgEvent, 10)
+	bc.SubscribeReorgEvent(events)
+
+	// canonical: genesis - a1 - ... - a5
+	var a []*Block
+	parent := bc.CurrentBlock()
+	for i := 0; i < 5; i++ {
+		b := buildChild(t, bc, parent, 1000)
+		assert.NoError(t, bc.ImportBlock(b))
+		a, parent = append(a, b), b
+	}
+	// side: a2 - b3 - ... - b6, heavier from b6 on
+	var side []*Block
+	parent = a[1]
+	for i := 0; i < 4; i++ {
+		b := buildChild(t, bc, parent, 999)
+		assert.NoError(t, bc.ImportBlock(b))
+		side, parent = append(side, b), b
+		if i < 3 {
+			assert.Equal(t, a[4].Hash(), bc.CurrentBlock().Hash())
+		}
+	}
+	assert.Equal(t, side[3].Hash(), bc.CurrentBlock().Hash())
+	checkCanonicalMmr(t, bc)
+	canon, _ := bc.GetBlockByNumber(3)
+	assert.Equal(t, side[0].Hash(), canon.Hash())
+
+	ev := waitReorgEvent(t, events)
+	assert.Equal(t, a[4].Hash(), ev.OldHead.Hash())
+	assert.Equal(t, side[3].Hash(), ev.NewHead.Hash())
+	assert.Equal(t, a[1].Hash(), ev.Ancestor.Hash())
+	assert.Equal(t, 3, len(ev.Dropped))
+	assert.Equal(t, 4, len(ev.Added))
+
+	// The old branch can still be extended and win back.
+	a6 := buildChild(t, bc, a[4], 1000)
+	assert.NoError(t, bc.ImportBlock(a6))
+	assert.Equal(t, a6.Hash(), bc.CurrentBlock().Hash())
+	checkCanonicalMmr(t, bc)
+	if _, err := bc.GetBlockByNumber(6); err != nil {
+		t.Fatal(err)
+	}
+	ev = waitReorgEvent(t, events)
+	assert.Equal(t, side[3].Hash(), ev.OldHead.Hash())
+	assert.Equal(t, a6.Hash(), ev.NewHead.Hash())
+
+	err := bc.ImportBlock(side[0])
+	assert.True(t, errors.Is(err, ErrKnownBlock))
+}
+
+func TestBlockChain_ReorgFailure(t *testing.T) {
+	newChain := func() (*BlockChain, []*Block, *Block) {
+		bc := NewBlockChain(NewPoW())
+		var a []*Block
+		parent := bc.CurrentBlock()
+		for i := 0; i < 5; i++ {
+			b := buildChild(t, bc, parent, 1000)
+			assert.NoError(t, bc.ImportBlock(b))
+			a, parent = append(a, b), b
+		}
+		// a2 - b3 - b4 - b5, b6 on top of it is heavier.
+		parent = a[1]
+		for i := 0; i < 3; i++ {
+			b := buildChild(t, bc, parent, 999)
+			assert.NoError(t, bc.ImportBlock(b))
+			parent = b
+		}
+		return bc, a, buildChild(t, bc, parent, 999)
+	}
+
+	// A canonical block to drop is missing.
+	bc, a, b6 := newChain()
+	root := bc.Mmr.GetRoot()
+	assert.NoError(t, bc.db.Delete(blockKey(a[3].Hash())))
+	assert.Error(t, bc.ImportBlock(b6))
+	assert.Equal(t, a[4].Hash(), bc.CurrentBlock().Hash())
+	assert.Equal(t, root, bc.Mmr.GetRoot())
+	assert.Equal(t, uint64(6), bc.Mmr.GetLeafNumber())
+
+	// The new head fails to be written after the MMR was switched.
+	bc, a, b6 = newChain()
+	bc.db = &crashDB{Database: bc.db, writes: 1}
+	assert.True(t, errors.Is(bc.ImportBlock(b6), errCrash))
+	assert.Equal(t, a[4].Hash(), bc.CurrentBlock().Hash())
+	checkCanonicalMmr(t, bc)
+}
+
+func TestBlockChain_ReorgCrash(t *testing.T) {
+	// genesis - a1 - ... - a1200, then genesis - b1 - ... - b1202 which is
+	// heavier from b1202 on, and c on top of it.
+	src := NewBlockChain(NewPoW())
+	var blocks []*Block
+	parent := src.CurrentBlock()
+	for i := 0; i < 1200; i++ {
+		b := buildChild(t, src, parent, 1000)
+		blocks, parent = append(blocks, b), b
+		assert.NoError(t, src.ImportBlock(b))
+	}
+	oldHead := parent
+	parent = src.genesis
+	for i := 0; i < 1202; i++ {
+		b := buildChild(t, src, parent, 999)
+		blocks, parent = append(blocks, b), b
+		assert.NoError(t, src.ImportBlock(b))
+	}
+	newHead := parent
+	assert.Equal(t, newHead.Hash(), src.CurrentBlock().Hash())
+	c := buildChild(t, src, newHead, 999)
+
+	// Crash after every write of the reorg in turn, the chain must open at
+	// one of the heads and switch to the new branch once c arrives.
+	for writes := 0; ; writes++ {
+		db := &crashDB{Database: memorydb.New(), writes: math.MaxInt32}
+		bc, err := newBlockChain(db, NewPoW(), mmr.SHA3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, b := range blocks[:len(blocks)-1] {
+			assert.NoError(t, bc.ImportBlock(b))
+		}
+		db.writes = writes
+		if err := bc.ImportBlock(newHead); err == nil {
+			break
+		} else if !errors.Is(err, errCrash) {
+			t.Fatalf("writes %d: %v", writes, err)
+		}
+		if bc, err = newBlockChain(db.Database, NewPoW(), mmr.SHA3); err != nil {
+			t.Fatalf("writes %d: reopen: %v", writes, err)
+		}
+		assert.Equal(t, oldHead.Hash(), bc.CurrentBlock().Hash())
+		checkCanonicalMmr(t, bc)
+		if err := bc.ImportBlock(newHead); err != nil && !errors.Is(err, ErrKnownBlock) {
+			t.Fatalf("writes %d: %v", writes, err)
+		}
+		assert.NoError(t, bc.ImportBlock(c))
+		assert.Equal(t, c.Hash(), bc.CurrentBlock().Hash())
+		checkCanonicalMmr(t, bc)
+	}
+}
+
+func waitReorgEvent(t *testing.T, events chan ReorgEvent) ReorgEvent {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no reorg event")
+	}
+	return ReorgEvent{}
+}
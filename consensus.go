@@ -0,0 +1,248 @@
+package flyclientdemo
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/marcopoloprotocol/flyclientDemo/mmr"
+)
+
+const (
+	// DifficultyBoundDivisor bounds how far the difficulty of a block may
+	// move away from its parent's: at most parent.Difficulty/DifficultyBoundDivisor.
+	DifficultyBoundDivisor = 2048
+
+	// TargetBlockTime is the block interval, in seconds, the difficulty aims at.
+	TargetBlockTime = 10
+
+	// MinBlockTime is the shortest interval, in seconds, the retargeting rule
+	// grants each block: blocks are taken to span at least MinBlockTime each,
+	// however close their timestamps are.
+	MinBlockTime = TargetBlockTime / 2
+
+	// MaxRetargetFactor bounds the difficulty of a block to this multiple of
+	// the average difficulty of the chain before it, see AverageDifficulty.
+	MaxRetargetFactor = 4
+)
+
+var (
+	// MinimumDifficulty is the lowest difficulty a non-genesis block may have.
+	MinimumDifficulty = big.NewInt(1)
+
+	// GenesisChildDifficulty is the difficulty CalcDifficulty hands out to
+	// the first block, as the genesis block carries none.
+	GenesisChildDifficulty = big.NewInt(1024)
+
+	// two256 is 2^256, the size of the hash space used by the PoW target.
+	two256 = new(big.Int).Lsh(big.NewInt(1), 256)
+
+	errSealStopped = errors.New("sealing stopped")
+)
+
+// Engine is the consensus engine securing a BlockChain. It decides which
+// difficulty a block must have and produces and checks the seal proving the
+// work behind it.
+type Engine interface {
+	// CalcDifficulty returns the difficulty a new child of parent should have.
+	// history is the root of the MMR over all blocks up to parent.
+	CalcDifficulty(parent *Block, history *mmr.Node) *big.Int
+
+	// VerifyDifficulty checks the difficulty of b against its parent.
+	VerifyDifficulty(parent, b *Block) error
+
+	// VerifyRetarget checks the time and difficulty of b against history, the
+	// root of the MMR over all blocks before it, which aggregates their
+	// difficulty and time range. It needs no parent, so light clients run it
+	// on the blocks sampled by a proof.
+	VerifyRetarget(history *mmr.Node, b *Block) error
+
+	// Seal searches a nonce for b which satisfies VerifySeal, starting at
+	// b.Nonce. It gives up with an error once stop is closed.
+	Seal(b *Block, stop <-chan struct{}) error
+
+	// VerifySeal checks the nonce of b.
+	VerifySeal(b *Block) error
+}
+
+// PoW is the hash-based proof-of-work engine: a block is sealed once its hash,
+// which covers the nonce, is at most 2^256/Difficulty. The seal is on the SHA3
+// hash, Block.Hash, whichever hasher the chain identifies blocks with.
+//
+// The difficulty may drift by at most 1/DifficultyBoundDivisor of the
+// parent's per block, retargeting towards the average difficulty of the
+// chain, and may never exceed MaxRetargetFactor times that average. As the
+// average is taken over at least MinBlockTime per block, a block weighs at
+// most MaxRetargetFactor*TargetBlockTime/MinBlockTime times the mean
+// difficulty before it. The cap is what stops a prover from making a few
+// blocks of huge difficulty: k blocks forked off a chain of n raise its total
+// difficulty by a factor of about (1+k/n)^8 at most.
+type PoW struct{}
+
+// NewPoW creates a proof-of-work consensus engine.
+func NewPoW() *PoW {
+	return &PoW{}
+}
+
+// CalcDifficulty implements Engine, moving the parent's difficulty by the
+// largest allowed step towards the average difficulty of history.
+func (p *PoW) CalcDifficulty(parent *Block, history *mmr.Node) *big.Int {
+	if parent.Number == 0 {
+		return new(big.Int).Set(GenesisChildDifficulty)
+	}
+	avg := AverageDifficulty(history, parent.Number+1)
+	step := difficultyBound(parent)
+	d := new(big.Int).Set(parent.Difficulty)
+	switch d.Cmp(avg) {
+	case 1:
+		if d.Sub(d, step); d.Cmp(avg) < 0 {
+			d.Set(avg)
+		}
+	case -1:
+		if d.Add(d, step); d.Cmp(avg) > 0 {
+			d.Set(avg)
+		}
+	}
+	if d.Cmp(MinimumDifficulty) < 0 {
+		d.Set(MinimumDifficulty)
+	}
+	return d
+}
+
+// VerifyDifficulty implements Engine. Children of the genesis block, which
+// carries no difficulty, only need MinimumDifficulty.
+func (p *PoW) VerifyDifficulty(parent, b *Block) error {
+	return verifyDifficulty(parent, b)
+}
+
+// VerifyRetarget implements Engine.
+func (p *PoW) VerifyRetarget(history *mmr.Node, b *Block) error {
+	return verifyRetarget(history, b)
+}
+
+// Seal implements Engine.
+func (p *PoW) Seal(b *Block, stop <-chan struct{}) error {
+	if b.Difficulty == nil || b.Difficulty.Sign() <= 0 {
+		return invalidBlock(b, ErrInvalidDifficulty, "can not seal")
+	}
+	target := new(big.Int).Div(two256, b.Difficulty)
+	for hash := new(big.Int); ; b.Nonce++ {
+		if hash.SetBytes(b.Hash().Bytes()).Cmp(target) <= 0 {
+			return nil
+		}
+		select {
+		case <-stop:
+			return errSealStopped
+		default:
+		}
+	}
+}
+
+// VerifySeal implements Engine.
+func (p *PoW) VerifySeal(b *Block) error {
+	if b.Difficulty == nil || b.Difficulty.Sign() <= 0 {
+		return invalidBlock(b, ErrInvalidDifficulty, "can not verify seal")
+	}
+	target := new(big.Int).Div(two256, b.Difficulty)
+	if new(big.Int).SetBytes(b.Hash().Bytes()).Cmp(target) > 0 {
+		return invalidBlock(b, ErrInvalidPoW, "hash above target")
+	}
+	return nil
+}
+
+// FakeEngine follows the difficulty rule of PoW but neither seals nor checks
+// seals, so tests can build long chains cheaply.
+type FakeEngine struct {
+	PoW
+}
+
+// NewFakeEngine creates a consensus engine accepting every nonce.
+func NewFakeEngine() *FakeEngine {
+	return &FakeEngine{}
+}
+
+// Seal implements Engine, leaving the nonce untouched.
+func (f *FakeEngine) Seal(b *Block, stop <-chan struct{}) error {
+	return nil
+}
+
+// VerifySeal implements Engine, accepting any nonce.
+func (f *FakeEngine) VerifySeal(b *Block) error {
+	return nil
+}
+
+// verifyDifficulty checks that the difficulty of b stays within
+// parent.Difficulty/DifficultyBoundDivisor of its parent's.
+func verifyDifficulty(parent, b *Block) error {
+	if b.Difficulty == nil || b.Difficulty.Cmp(MinimumDifficulty) < 0 {
+		return invalidBlock(b, ErrInvalidDifficulty, "below minimum %v", MinimumDifficulty)
+	}
+	if parent.Number == 0 {
+		return nil
+	}
+	bound := difficultyBound(parent)
+	delta := new(big.Int).Sub(b.Difficulty, parent.Difficulty)
+	if delta.Abs(delta).Cmp(bound) > 0 {
+		return invalidBlock(b, ErrInvalidDifficulty, "have %v, parent %v, max change %v",
+			b.Difficulty, parent.Difficulty, bound)
+	}
+	return nil
+}
+
+// difficultyBound returns how far the difficulty of a child of parent may
+// move away from the parent's.
+func difficultyBound(parent *Block) *big.Int {
+	bound := new(big.Int).Div(parent.Difficulty, big.NewInt(DifficultyBoundDivisor))
+	if bound.Sign() == 0 {
+		bound.SetInt64(1)
+	}
+	return bound
+}
+
+// AverageDifficulty returns the difficulty at which the blocks aggregated by
+// history, an MMR node with a mmr.TimeRangeMerger payload over the first
+// leaves blocks, would have come every TargetBlockTime: their total
+// difficulty scaled by TargetBlockTime over the seconds they span, but at
+// least MinBlockTime per block after genesis. It is at least
+// GenesisChildDifficulty, which also stands in while history spans no time.
+func AverageDifficulty(history *mmr.Node, leaves uint64) *big.Int {
+	avg := new(big.Int).Set(GenesisChildDifficulty)
+	min, max, err := mmr.DecodeTimeRange(history.GetPayload())
+	if err != nil {
+		return avg
+	}
+	span := new(big.Int).SetUint64(max - min)
+	if leaves > 1 {
+		floor := new(big.Int).SetUint64(leaves - 1)
+		if floor.Mul(floor, big.NewInt(MinBlockTime)); floor.Cmp(span) > 0 {
+			span = floor
+		}
+	}
+	if span.Sign() == 0 {
+		return avg
+	}
+	d := new(big.Int).Mul(history.GetDifficulty(), big.NewInt(TargetBlockTime))
+	d.Div(d, span)
+	if d.Cmp(avg) > 0 {
+		avg = d
+	}
+	return avg
+}
+
+// verifyRetarget checks that b comes after every block aggregated by history,
+// the blocks before it, and that its difficulty is at most MaxRetargetFactor
+// times their average.
+func verifyRetarget(history *mmr.Node, b *Block) error {
+	_, last, err := mmr.DecodeTimeRange(history.GetPayload())
+	if err != nil {
+		return invalidBlock(b, ErrInvalidTime, "history without time range: %v", err)
+	}
+	if b.Time <= last {
+		return invalidBlock(b, ErrInvalidTime, "have %d, earlier block at %d", b.Time, last)
+	}
+	max := AverageDifficulty(history, b.Number)
+	max.Mul(max, big.NewInt(MaxRetargetFactor))
+	if b.Difficulty == nil || b.Difficulty.Cmp(max) > 0 {
+		return invalidBlock(b, ErrInvalidDifficulty, "have %v, retarget cap %v", b.Difficulty, max)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package flyclientdemo
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+	"github.com/marcopoloprotocol/flyclientDemo/mmr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoW_SealAndVerify(t *testing.T) {
+	pow := NewPoW()
+	b := NewBlock(1, 0, big.NewInt(5000))
+	assert.NoError(t, pow.Seal(b, nil))
+	assert.NoError(t, pow.VerifySeal(b))
+
+	target := new(big.Int).Div(two256, b.Difficulty)
+	assert.True(t, new(big.Int).SetBytes(b.Hash().Bytes()).Cmp(target) <= 0)
+
+	// A sealed block is very unlikely to stay sealed at a much higher difficulty.
+	b.Difficulty = new(big.Int).Lsh(big.NewInt(1), 200)
+	assert.True(t, errors.Is(pow.VerifySeal(b), ErrInvalidPoW))
+
+	stop := make(chan struct{})
+	close(stop)
+	assert.Equal(t, errSealStopped, pow.Seal(b, stop))
+}
+
+func TestPoW_Difficulty(t *testing.T) {
+	pow := NewPoW()
+	m := mmr.NewMMRWithMerger(mmr.SHA3, mmr.TimeRangeMerger)
+	genesis := NewBlock(0, 0, big.NewInt(0))
+	m.Push(genesis.leaf(mmr.SHA3))
+	parent := NewBlock(1, 0, pow.CalcDifficulty(genesis, m.GetRootNode()))
+	parent.Time = TargetBlockTime
+	assert.NoError(t, pow.VerifyDifficulty(genesis, parent))
+
+	m.Push(parent.leaf(mmr.SHA3))
+	child := NewBlock(2, 0, pow.CalcDifficulty(parent, m.GetRootNode()))
+	assert.NoError(t, pow.VerifyDifficulty(parent, child))
+	assert.Equal(t, GenesisChildDifficulty, child.Difficulty)
+
+	parent.Difficulty = big.NewInt(2048 * 10)
+	for _, d := range []int64{2048*10 - 10, 2048 * 10, 2048*10 + 10} {
+		child.Difficulty = big.NewInt(d)
+		assert.NoError(t, pow.VerifyDifficulty(parent, child))
+	}
+	for _, d := range []int64{0, 2048*10 - 11, 2048*10 + 11} {
+		child.Difficulty = big.NewInt(d)
+		assert.True(t, errors.Is(pow.VerifyDifficulty(parent, child), ErrInvalidDifficulty))
+	}
+}
+
+func TestPoW_Retarget(t *testing.T) {
+	pow := NewPoW()
+	history := func(td int64, from, to uint64) *mmr.Node {
+		return mmr.NewNodeWithPayload(common.Hash{}, big.NewInt(td), mmr.TimeRangePayload(from, to))
+	}
+	// 1000 blocks of difficulty 20480, one every TargetBlockTime.
+	onTime := history(1000*20480, 0, 1000*TargetBlockTime)
+	assert.Equal(t, "20480", AverageDifficulty(onTime, 1001).String())
+	assert.Equal(t, "40960", AverageDifficulty(history(1000*20480, 0, 500*TargetBlockTime), 1001).String())
+	assert.Equal(t, GenesisChildDifficulty.String(), AverageDifficulty(history(100, 0, 1000), 11).String())
+	assert.Equal(t, GenesisChildDifficulty.String(), AverageDifficulty(history(0, 0, 0), 1).String())
+	// Compressed timestamps count MinBlockTime per block.
+	compressed := history(1000*20480, 0, 1000)
+	assert.Equal(t, AverageDifficulty(history(1000*20480, 0, 1000*MinBlockTime), 1001).String(),
+		AverageDifficulty(compressed, 1001).String())
+
+	// The difficulty steps towards the average.
+	parent := &Block{Number: 1000, Time: 1000 * TargetBlockTime, Difficulty: big.NewInt(20480)}
+	assert.Equal(t, "20480", pow.CalcDifficulty(parent, onTime).String())
+	assert.Equal(t, "20490", pow.CalcDifficulty(parent, history(1000*20480, 0, 500*TargetBlockTime)).String())
+	assert.Equal(t, "20470", pow.CalcDifficulty(parent, history(1000*20480, 0, 2000*TargetBlockTime)).String())
+
+	b := &Block{Number: 1001, Time: parent.Time + 1, Difficulty: big.NewInt(MaxRetargetFactor * 20480)}
+	assert.NoError(t, pow.VerifyRetarget(onTime, b))
+	b.Difficulty = big.NewInt(MaxRetargetFactor*20480 + 1)
+	assert.True(t, errors.Is(pow.VerifyRetarget(onTime, b), ErrInvalidDifficulty))
+	b.Difficulty, b.Time = big.NewInt(20480), parent.Time
+	assert.True(t, errors.Is(pow.VerifyRetarget(onTime, b), ErrInvalidTime))
+	b.Time = parent.Time + 1
+	assert.True(t, errors.Is(pow.VerifyRetarget(mmr.NewNode(common.Hash{}, big.NewInt(1)), b), ErrInvalidTime))
+
+	// The first block may not exceed the cap either.
+	bc := NewBlockChain(NewFakeEngine())
+	b = NewBlock(1, 0, new(big.Int).Mul(GenesisChildDifficulty, big.NewInt(MaxRetargetFactor+1)))
+	assert.True(t, errors.Is(bc.InsertBlock(b), ErrInvalidDifficulty))
+}
+
+func TestBlockChain_InsertSealed(t *testing.T) {
+	bc := NewBlockChain(NewPoW())
+	for i := 1; i <= 20; i++ {
+		b := &Block{Number: uint64(i)}
+		assert.NoError(t, bc.InsertBlock(b))
+		assert.NoError(t, bc.Engine().VerifySeal(b))
+	}
+	assert.Equal(t, 21, bc.Len())
+
+	// The fake engine accepts blocks no real engine would.
+	fake := NewBlockChain(NewFakeEngine())
+	b := NewBlock(1, 0, big.NewInt(MaxRetargetFactor*1024))
+	assert.NoError(t, fake.InsertBlock(b))
+	assert.Error(t, NewPoW().VerifySeal(b))
+}
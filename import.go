@@ -0,0 +1,202 @@
+package flyclientdemo
+
+import (
+	"io"
+	"math/big"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+	"github.com/marcopoloprotocol/flyclientDemo/diskdb"
+	"github.com/marcopoloprotocol/flyclientDemo/mmr"
+	"github.com/marcopoloprotocol/flyclientDemo/rlp"
+)
+
+// importWindow is the number of blocks ImportChain validates and commits at
+// once. The chain is unlocked in between, so proofs keep being served.
+var importWindow = 1 << 16
+
+// ImportProgress is reported by ImportChain after each window of blocks.
+type ImportProgress struct {
+	Imported uint64 // blocks added to the chain so far
+	Skipped  uint64 // blocks skipped as already canonical
+	Head     uint64 // number of the current head
+	Elapsed  time.Duration
+}
+
+// ImportChain reads consecutive RLP-encoded blocks from r and appends them to the head. Leading blocks which are already
+// canonical are skipped. Each window of blocks is pushed to the MMR at once
+// with mmr.PushBatch and validated concurrently, which is much faster than
+// calling ImportBlock for every block. progress, if not nil, is called after
+// each window. The blocks before an invalid one stay imported, the invalid
+// one is reported with a *ValidationError.
+func (bc *BlockChain) ImportChain(r io.Reader, progress func(ImportProgress)) error {
+	var (
+		stream = rlp.NewStream(r, 0)
+		start  = time.Now()
+		stats  ImportProgress
+		blocks []*Block
+	)
+	commit := func() error {
+		head := bc.CurrentBlock().Number
+		err := bc.importBlocks(blocks)
+		stats.Head = bc.CurrentBlock().Number
+		stats.Imported += stats.Head - head
+		stats.Elapsed = time.Since(start)
+		if err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(stats)
+		}
+		blocks = blocks[:0]
+		return nil
+	}
+	for {
+		b := new(Block)
+		if err := stream.Decode(b); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if len(blocks) == 0 && stats.Imported == 0 {
+			if hash, err := readCanonicalHash(bc.db, b.Number); err == nil && hash == bc.hash(b) {
+				stats.Skipped++
+				continue
+			}
+		}
+		if blocks = append(blocks, b); len(blocks) == importWindow {
+			if err := commit(); err != nil {
+				return err
+			}
+		}
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+	return commit()
+}
+
+// importBlocks appends blocks, a window of consecutive blocks, to the head.
+// On an invalid block the ones before it are still appended.
+func (bc *BlockChain) importBlocks(blocks []*Block) error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	// The links between the blocks are checked first, so that the MMR
+	// leaves can be pushed before the roots committed to are checked.
+	var (
+		parent = bc.header
+		phash  = bc.hash(parent)
+		hashes = make([]common.Hash, len(blocks))
+		leaves = make([]*mmr.Node, len(blocks))
+		linked = len(blocks)
+		failed error
+	)
+	for i, b := range blocks {
+		if b.Number != parent.Number+1 {
+			failed, linked = bc.withHash(b, invalidBlock(b, ErrInvalidNumber, "parent is #%d", parent.Number)), i
+			break
+		}
+		if b.PreHash != phash {
+			failed, linked = bc.withHash(b, invalidBlock(b, ErrUnknownParent, "parent %s", b.PreHash)), i
+			break
+		}
+		hashes[i] = bc.hash(b)
+		leaves[i] = mmr.NewNodeWithPayload(hashes[i], b.Difficulty, mmr.TimeRangePayload(b.Time, b.Time))
+		parent, phash = b, hashes[i]
+	}
+	blocks = blocks[:linked]
+	bc.Mmr.PushBatch(leaves[:linked])
+
+	errs := make([]error, len(blocks))
+	var (
+		wg   sync.WaitGroup
+		next = make(chan int, len(blocks))
+	)
+	for i := range blocks {
+		next <- i
+	}
+	close(next)
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				parent := bc.header
+				if i > 0 {
+					parent = blocks[i-1]
+				}
+				history := bc.Mmr.BagPeaks(bc.Mmr.PeaksAt(blocks[i].Number))
+				errs[i] = bc.validateBlock(parent, history, blocks[i])
+			}
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			failed, blocks = bc.withHash(blocks[i], err), blocks[:i]
+			break
+		}
+	}
+	for bc.Mmr.GetLeafNumber() > bc.header.Number+1+uint64(len(blocks)) {
+		bc.Mmr.Pop()
+	}
+	if len(blocks) == 0 {
+		return failed
+	}
+	if err := bc.commitBlocks(blocks, hashes[:len(blocks)]); err != nil {
+		bc.truncateMmr()
+		return err
+	}
+	return failed
+}
+
+// commitBlocks writes blocks, validated children of the head whose leaves
+// have been pushed to the MMR, and makes the last one the head. The blocks
+// and the MMR are written first, then the canonical hashes and the head in a
+// single batch, so a crash leaves either the old head with the MMR recovered
+// to it on open, or the new head with everything it refers to.
+func (bc *BlockChain) commitBlocks(blocks []*Block, hashes []common.Hash) error {
+	td, err := readTd(bc.db, bc.hash(bc.header))
+	if err != nil {
+		return err
+	}
+	batch := bc.db.NewBatch()
+	for i, b := range blocks {
+		td = new(big.Int).Add(td, b.Difficulty)
+		if err := writeBlock(batch, hashes[i], b); err != nil {
+			return err
+		}
+		if err := writeTd(batch, hashes[i], td); err != nil {
+			return err
+		}
+		if batch.ValueSize() >= diskdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	if err := bc.Mmr.Flush(); err != nil {
+		return err
+	}
+	batch.Reset()
+	for i, b := range blocks {
+		if err := writeCanonicalHash(batch, b.Number, hashes[i]); err != nil {
+			return err
+		}
+	}
+	if err := writeHeadHash(batch, hashes[len(hashes)-1]); err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	bc.header = blocks[len(blocks)-1]
+	return nil
+}
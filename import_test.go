@@ -0,0 +1,241 @@
+package flyclientdemo
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+	"github.com/marcopoloprotocol/flyclientDemo/diskdb"
+	"github.com/marcopoloprotocol/flyclientDemo/diskdb/memorydb"
+	"github.com/marcopoloprotocol/flyclientDemo/mmr"
+	"github.com/marcopoloprotocol/flyclientDemo/rlp"
+	"github.com/stretchr/testify/assert"
+)
+
+// exportChain returns the canonical blocks of bc after genesis.
+func exportChain(t testing.TB, bc *BlockChain) []*Block {
+	var blocks []*Block
+	for n := uint64(1); n <= bc.CurrentBlock().Number; n++ {
+		b, err := bc.GetBlockByNumber(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+// encodeBlocks encodes blocks one after another, as ImportChain reads them.
+func encodeBlocks(t testing.TB, blocks []*Block) *bytes.Buffer {
+	var buf bytes.Buffer
+	for _, b := range blocks {
+		assert.NoError(t, rlp.Encode(&buf, b))
+	}
+	return &buf
+}
+
+func TestBlockChain_ImportChain(t *testing.T) {
+	defer func(w int) { importWindow = w }(importWindow)
+	importWindow = 700
+
+	src := newSealedChain(t, 3000)
+	blocks := exportChain(t, src)
+	assert.Equal(t, 3000, len(blocks))
+
+	dir, err := ioutil.TempDir("", "flyclient-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bc, err := OpenBlockChain(dir, NewPoW())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Import a prefix first, the rest of the file then skips it.
+	assert.NoError(t, bc.ImportChain(encodeBlocks(t, blocks[:1000]), nil))
+	var reports []ImportProgress
+	assert.NoError(t, bc.ImportChain(encodeBlocks(t, blocks), func(p ImportProgress) {
+		reports = append(reports, p)
+	}))
+	assert.Equal(t, 3, len(reports))
+	last := reports[len(reports)-1]
+	assert.Equal(t, uint64(2000), last.Imported)
+	assert.Equal(t, uint64(1000), last.Skipped)
+	assert.Equal(t, uint64(3000), last.Head)
+	assert.Equal(t, src.CurrentBlock().Hash(), bc.CurrentBlock().Hash())
+	assert.Equal(t, src.Mmr.GetRoot(), bc.Mmr.GetRoot())
+	checkCanonicalMmr(t, bc)
+	td, err := bc.GetTd(bc.CurrentBlock().Hash())
+	assert.NoError(t, err)
+	want, _ := src.GetTd(src.CurrentBlock().Hash())
+	assert.Equal(t, want, td)
+
+	assert.NoError(t, bc.Close())
+	bc, err = OpenBlockChain(dir, NewPoW())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	assert.Equal(t, src.Mmr.GetRoot(), bc.Mmr.GetRoot())
+	proof, err := bc.GetProof()
+	assert.NoError(t, err)
+	pBlocks, err := mmr.VerifyRequiredBlocks(proof, DefaultProofParams())
+	assert.NoError(t, err)
+	assert.True(t, proof.VerifyProof(pBlocks, DecodeSampledHeader))
+	assert.NoError(t, bc.InsertBlock(NewBlock(3001, 0, big.NewInt(256))))
+}
+
+func TestBlockChain_ImportChainInvalid(t *testing.T) {
+	defer func(w int) { importWindow = w }(importWindow)
+	importWindow = 300
+
+	blocks := exportChain(t, newSealedChain(t, 1000))
+	tests := []struct {
+		corrupt func(blocks []*Block) []*Block
+		head    uint64
+		err     error
+	}{
+		{func(blocks []*Block) []*Block {
+			b := *blocks[649]
+			b.MRoot = common.Hash{1}
+			return append(append(blocks[:649:649], &b), blocks[650:]...)
+		}, 649, ErrInvalidMRoot},
+		{func(blocks []*Block) []*Block {
+			return append(blocks[:449:449], blocks[450:]...)
+		}, 449, ErrInvalidNumber},
+		{func(blocks []*Block) []*Block {
+			b := *blocks[899]
+			b.PreHash = common.Hash{1}
+			return append(append(blocks[:899:899], &b), blocks[900:]...)
+		}, 899, ErrUnknownParent},
+		{func(blocks []*Block) []*Block {
+			b := *blocks[299]
+			b.Time = blocks[298].Time
+			return append(append(blocks[:299:299], &b), blocks[300:]...)
+		}, 299, ErrInvalidTime},
+	}
+	for i, tt := range tests {
+		bc := NewBlockChain(NewPoW())
+		err := bc.ImportChain(encodeBlocks(t, tt.corrupt(blocks)), nil)
+		var verr *ValidationError
+		if !errors.As(err, &verr) || !errors.Is(err, tt.err) {
+			t.Errorf("test %d: have error %v, want %v", i, err, tt.err)
+		}
+		assert.Equal(t, tt.head, bc.CurrentBlock().Number)
+		checkCanonicalMmr(t, bc)
+	}
+}
+
+var errCrash = errors.New("crashed")
+
+// crashDB is a database which stops writing, as if the process died, after a
+// number of writes.
+type crashDB struct {
+	diskdb.Database
+	writes int
+}
+
+func (db *crashDB) write() error {
+	if db.writes == 0 {
+		return errCrash
+	}
+	db.writes--
+	return nil
+}
+
+func (db *crashDB) Put(key []byte, value []byte) error {
+	if err := db.write(); err != nil {
+		return err
+	}
+	return db.Database.Put(key, value)
+}
+
+func (db *crashDB) Delete(key []byte) error {
+	if err := db.write(); err != nil {
+		return err
+	}
+	return db.Database.Delete(key)
+}
+
+func (db *crashDB) NewBatch() diskdb.Batch {
+	return &crashBatch{db.Database.NewBatch(), db}
+}
+
+type crashBatch struct {
+	diskdb.Batch
+	db *crashDB
+}
+
+func (b *crashBatch) Write() error {
+	if err := b.db.write(); err != nil {
+		return err
+	}
+	return b.Batch.Write()
+}
+
+func TestBlockChain_ImportChainCrash(t *testing.T) {
+	defer func(w int) { importWindow = w }(importWindow)
+	importWindow = 1500
+
+	src := newSealedChain(t, 3000)
+	blocks := exportChain(t, src)
+	// Crash after every write of the import in turn, the chain must open at
+	// a consistent head and the import resume from there.
+	for writes := 0; ; writes++ {
+		db := memorydb.New()
+		bc, err := newBlockChain(&crashDB{Database: db, writes: 2 + writes}, NewPoW(), mmr.SHA3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bc.ImportChain(encodeBlocks(t, blocks), nil); err == nil {
+			break
+		} else if !errors.Is(err, errCrash) {
+			t.Fatalf("writes %d: %v", writes, err)
+		}
+		if bc, err = newBlockChain(db, NewPoW(), mmr.SHA3); err != nil {
+			t.Fatalf("writes %d: reopen: %v", writes, err)
+		}
+		checkCanonicalMmr(t, bc)
+		assert.NoError(t, bc.ImportChain(encodeBlocks(t, blocks), nil))
+		assert.Equal(t, src.CurrentBlock().Hash(), bc.CurrentBlock().Hash())
+		assert.Equal(t, src.Mmr.GetRoot(), bc.Mmr.GetRoot())
+	}
+}
+
+func benchmarkImport(b *testing.B, run func(bc *BlockChain, file []byte) error) {
+	src := NewBlockChain(NewFakeEngine())
+	for i := 1; i <= 100000; i++ {
+		src.InsertBlock(NewBlock(uint64(i), 0, big.NewInt(4096)))
+	}
+	buf := encodeBlocks(b, exportChain(b, src))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := run(NewBlockChain(NewFakeEngine()), buf.Bytes()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkImportChain(b *testing.B) {
+	benchmarkImport(b, func(bc *BlockChain, file []byte) error {
+		return bc.ImportChain(bytes.NewReader(file), nil)
+	})
+}
+
+func BenchmarkImportBlocks(b *testing.B) {
+	benchmarkImport(b, func(bc *BlockChain, file []byte) error {
+		for s := rlp.NewStream(bytes.NewReader(file), 0); ; {
+			blk := new(Block)
+			if err := s.Decode(blk); err != nil {
+				return nil
+			}
+			if err := bc.ImportBlock(blk); err != nil {
+				return err
+			}
+		}
+	})
+}
@@ -0,0 +1,219 @@
+package flyclientdemo
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+	"github.com/marcopoloprotocol/flyclientDemo/diskdb"
+	"github.com/marcopoloprotocol/flyclientDemo/mmr"
+	"github.com/marcopoloprotocol/flyclientDemo/rlp"
+)
+
+var checkpointKey = []byte("LightCheckpoint") // checkpointKey -> rlp(Checkpoint)
+
+var (
+	ErrInvalidProof   = errors.New("invalid flyclient proof")
+	ErrMissingHeader  = errors.New("proof carries no sampled headers")
+	ErrHeaderMismatch = errors.New("sampled header does not match the proof")
+	ErrStaleProof     = errors.New("proof is not heavier than the trusted checkpoint")
+	ErrNoCheckpoint   = errors.New("light client has no trusted checkpoint")
+)
+
+// Checkpoint is the MMR a light client has accepted. RootHash is the MRoot of
+// the block following the last proven one.
+type Checkpoint struct {
+	RootHash       common.Hash
+	RootDifficulty *big.Int
+	LeafNumber     uint64
+}
+
+// LightClient follows a chain through FlyClient proofs instead of downloading
+// all of its headers. It keeps the heaviest proven MMR as its trusted
+// checkpoint.
+type LightClient struct {
+	db         diskdb.Database
+	engine     Engine
+	params     *mmr.ProofParams // weakest parameters accepted in proofs
+	hasher     mmr.Hasher       // hash function of params, blocks are hashed with it
+	checkpoint *Checkpoint
+}
+
+// DefaultProofParams returns the default parameters of proofs of this chain,
+// whose MMR aggregates block times with mmr.TimeRangeMerger.
+func DefaultProofParams() *mmr.ProofParams {
+	params := mmr.DefaultProofParams()
+	params.Merger = mmr.TimeRange
+	return params
+}
+
+// NewLightClient creates a light client persisting its checkpoint in db,
+// resuming from a previously stored one if any. Proofs made with weaker
+// parameters than params are refused, nil stands for the defaults. Proofs
+// have to aggregate block times with mmr.TimeRangeMerger, whatever params
+// says, as the difficulty of sampled blocks is checked against them.
+func NewLightClient(db diskdb.Database, engine Engine, params *mmr.ProofParams) (*LightClient, error) {
+	if params == nil {
+		params = DefaultProofParams()
+	}
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	hasher, err := mmr.HasherByID(params.Hasher)
+	if err != nil {
+		return nil, err
+	}
+	lc := &LightClient{db: db, engine: engine, params: params.Copy(), hasher: hasher}
+	lc.params.Merger = mmr.TimeRange
+	if ok, _ := db.Has(checkpointKey); ok {
+		enc, err := db.Get(checkpointKey)
+		if err != nil {
+			return nil, err
+		}
+		cp := new(Checkpoint)
+		if err := rlp.DecodeBytes(enc, cp); err != nil {
+			return nil, err
+		}
+		lc.checkpoint = cp
+	}
+	return lc, nil
+}
+
+// Checkpoint returns the trusted checkpoint, or nil if no proof has been
+// accepted yet.
+func (lc *LightClient) Checkpoint() *Checkpoint {
+	return lc.checkpoint
+}
+
+// Verify checks a proof carrying the headers of the blocks it samples, and on
+// success makes the proven MMR the trusted checkpoint. Besides the MMR itself,
+// every sampled header must be the proven leaf, commit in its MRoot to the MMR
+// over all blocks before it, carry a valid seal and follow the retargeting
+// rule given the difficulty and time range that MMR aggregates.
+func (lc *LightClient) Verify(proof *mmr.ProofInfo) error {
+	if lc.checkpoint != nil && proof.RootDifficulty != nil &&
+		proof.RootDifficulty.Cmp(lc.checkpoint.RootDifficulty) <= 0 {
+		return ErrStaleProof
+	}
+	if proof.Headers == nil {
+		return ErrMissingHeader
+	}
+	pBlocks, err := mmr.VerifyRequiredBlocks(proof, lc.params)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidProof, err)
+	}
+	leaves, err := proof.VerifyProofHeaders(pBlocks, DecodeSampledHeader)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidProof, err)
+	}
+	if err := lc.checkHeaders(proof.Headers, leaves); err != nil {
+		return err
+	}
+	return lc.setCheckpoint(&Checkpoint{
+		RootHash:       proof.RootHash,
+		RootDifficulty: new(big.Int).Set(proof.RootDifficulty),
+		LeafNumber:     proof.LeafNumber,
+	})
+}
+
+// Update checks a proof sampling only the blocks after the trusted checkpoint
+// and on success moves the checkpoint to the proven MMR. The sampled headers
+// are checked like in Verify.
+func (lc *LightClient) Update(p *mmr.IncrementalProof) error {
+	if lc.checkpoint == nil {
+		return ErrNoCheckpoint
+	}
+	if p.Proof == nil || p.Proof.Headers == nil {
+		return ErrMissingHeader
+	}
+	trusted := &mmr.Root{
+		Hash:       lc.checkpoint.RootHash,
+		Difficulty: lc.checkpoint.RootDifficulty,
+		LeafNumber: lc.checkpoint.LeafNumber,
+	}
+	leaves, err := p.VerifyHeaders(trusted, lc.params, DecodeSampledHeader)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidProof, err)
+	}
+	if err := lc.checkHeaders(p.Proof.Headers, leaves); err != nil {
+		return err
+	}
+	return lc.setCheckpoint(&Checkpoint{
+		RootHash:       p.Proof.RootHash,
+		RootDifficulty: new(big.Int).Set(p.Proof.RootDifficulty),
+		LeafNumber:     p.Proof.LeafNumber,
+	})
+}
+
+// Compare decides which of two competing chains proved more work, see
+// mmr.CompareProofs. The sampled headers of both are checked like in Verify.
+// The checkpoint is left alone, the winner's proof still has to be verified.
+func (lc *LightClient) Compare(a, b *mmr.Contender) (*mmr.Comparison, error) {
+	return mmr.CompareProofs(a, b, lc.params, DecodeSampledHeader, lc.checkHeader)
+}
+
+// checkHeaders runs checkHeader on the headers of a verified proof, with the
+// leaves they are sampled as.
+func (lc *LightClient) checkHeaders(headers [][]byte, leaves []*mmr.ProofLeaf) error {
+	for i, h := range headers {
+		if err := lc.checkHeader(h, leaves[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkHeader checks the parts of a sampled header the proof cannot: the
+// genesis block has to be ours and every other block has to be sealed and
+// follow the retargeting rule given the MMR before it, as proven for leaf.
+func (lc *LightClient) checkHeader(enc []byte, leaf *mmr.ProofLeaf) error {
+	h := new(Block)
+	if err := rlp.DecodeBytes(enc, h); err != nil {
+		return err
+	}
+	// The retarget average grants each block before h a minimum span, so h
+	// must not claim fewer of them than it is preceded by.
+	if h.Number != leaf.Number {
+		return fmt.Errorf("%w: header #%d at leaf %d", ErrHeaderMismatch, h.Number, leaf.Number)
+	}
+	if h.Number == 0 {
+		if h.HashWith(lc.hasher) != genesisBlock.HashWith(lc.hasher) {
+			return fmt.Errorf("%w: unknown genesis", ErrHeaderMismatch)
+		}
+		return nil
+	}
+	if err := lc.engine.VerifySeal(h); err != nil {
+		return err
+	}
+	history := mmr.NewNodeWithPayload(leaf.PrefixRoot, leaf.PrefixDifficulty, leaf.PrefixPayload)
+	return lc.engine.VerifyRetarget(history, h)
+}
+
+// DecodeSampledHeader is the mmr.HeaderDecoder of the blocks of this chain,
+// with which the mmr package checks the headers carried by proofs against the
+// proven MMR.
+func DecodeSampledHeader(raw []byte, h mmr.Hasher) (*mmr.SampledHeader, error) {
+	b := new(Block)
+	if err := rlp.DecodeBytes(raw, b); err != nil {
+		return nil, err
+	}
+	return &mmr.SampledHeader{
+		Hash:       b.HashWith(h),
+		Difficulty: b.Difficulty,
+		Payload:    mmr.TimeRangePayload(b.Time, b.Time),
+		MRoot:      b.MRoot,
+	}, nil
+}
+
+func (lc *LightClient) setCheckpoint(cp *Checkpoint) error {
+	enc, err := rlp.EncodeToBytes(cp)
+	if err != nil {
+		return err
+	}
+	if err := lc.db.Put(checkpointKey, enc); err != nil {
+		return err
+	}
+	lc.checkpoint = cp
+	return nil
+}
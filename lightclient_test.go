@@ -0,0 +1,221 @@
+package flyclientdemo
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+	"github.com/marcopoloprotocol/flyclientDemo/diskdb/memorydb"
+	"github.com/marcopoloprotocol/flyclientDemo/mmr"
+	"github.com/marcopoloprotocol/flyclientDemo/rlp"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSealedChain(t *testing.T, length int) *BlockChain {
+	bc := NewBlockChain(NewPoW())
+	for i := 1; i <= length; i++ {
+		if err := bc.InsertBlock(NewBlock(uint64(i), 0, big.NewInt(256))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return bc
+}
+
+func TestLightClient_Verify(t *testing.T) {
+	bc := newSealedChain(t, 2000)
+	proof, err := bc.GetProof()
+	assert.NoError(t, err)
+
+	db := memorydb.New()
+	lc, _ := NewLightClient(db, NewPoW(), nil)
+	assert.Nil(t, lc.Checkpoint())
+
+	weak := DefaultProofParams()
+	weak.Lambda = 20
+	bc.SetProofParams(weak)
+	weakProof, err := bc.GetProof()
+	assert.NoError(t, err)
+	assert.True(t, errors.Is(lc.Verify(weakProof), ErrInvalidProof))
+	assert.True(t, len(weakProof.Checked) < len(proof.Checked))
+
+	bare := *proof
+	bare.Headers = nil
+	assert.True(t, errors.Is(lc.Verify(&bare), ErrMissingHeader))
+
+	forged := *proof
+	forged.Headers = append([][]byte{}, proof.Headers...)
+	last := new(Block)
+	assert.NoError(t, rlp.DecodeBytes(forged.Headers[len(forged.Headers)-1], last))
+	last.MRoot = common.Hash{1}
+	forged.Headers[len(forged.Headers)-1], _ = rlp.EncodeToBytes(last)
+	assert.True(t, errors.Is(lc.Verify(&forged), ErrInvalidProof))
+	assert.True(t, errors.Is(forged.VerifyHeaders(DecodeSampledHeader), mmr.ErrHeaderLeaf))
+	assert.Nil(t, lc.Checkpoint())
+
+	assert.NoError(t, lc.Verify(proof))
+	cp := lc.Checkpoint()
+	assert.Equal(t, bc.CurrentBlock().MRoot, cp.RootHash)
+	assert.Equal(t, uint64(bc.Len()-1), cp.LeafNumber)
+	assert.True(t, errors.Is(lc.Verify(proof), ErrStaleProof))
+
+	// The checkpoint survives a restart.
+	lc, err = NewLightClient(db, NewPoW(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, cp, lc.Checkpoint())
+}
+
+func TestLightClient_ForgedMRoot(t *testing.T) {
+	// A prover sealing real blocks but not committing to its history.
+	pow, m := NewPoW(), mmr.NewMMRWithMerger(mmr.SHA3, mmr.TimeRangeMerger)
+	headers := []*Block{genesisBlock}
+	m.Push(genesisBlock.leaf(mmr.SHA3))
+	for i := 1; i <= 2000; i++ {
+		b := NewBlock(uint64(i), 0, big.NewInt(256))
+		b.PreHash, b.Time = headers[i-1].Hash(), headers[i-1].Time+TargetBlockTime
+		assert.NoError(t, pow.Seal(b, nil))
+		headers = append(headers, b)
+		m.Push(b.leaf(mmr.SHA3))
+	}
+	m.Pop()
+	proof, _ := m.CreateNewProof(DefaultProofParams())
+	for _, n := range mmr.SortAndRemoveRepeatForBlocks(append([]uint64{}, proof.Checked...)) {
+		enc, _ := rlp.EncodeToBytes(headers[n])
+		proof.Headers = append(proof.Headers, enc)
+	}
+	assert.True(t, errors.Is(proof.VerifyHeaders(DecodeSampledHeader), mmr.ErrHeaderMRoot))
+
+	pBlocks, err := mmr.VerifyRequiredBlocks(proof, DefaultProofParams())
+	assert.NoError(t, err)
+	assert.False(t, proof.VerifyProof(pBlocks, DecodeSampledHeader))
+
+	lc, _ := NewLightClient(memorydb.New(), pow, nil)
+	assert.True(t, errors.Is(lc.Verify(proof), ErrInvalidProof))
+	assert.Nil(t, lc.Checkpoint())
+}
+
+func TestLightClient_Compare(t *testing.T) {
+	honest := newSealedChain(t, 1000)
+	// The adversary shares the first 1000 blocks, then outpaces the honest
+	// chain with blocks it never sealed.
+	adversary := NewBlockChain(NewFakeEngine())
+	for i := uint64(1); i <= 1000; i++ {
+		b, err := honest.GetBlockByNumber(i)
+		assert.NoError(t, err)
+		assert.NoError(t, adversary.ImportBlock(b))
+	}
+	for i := 1001; i <= 2500; i++ {
+		assert.NoError(t, adversary.InsertBlock(NewBlock(uint64(i), 0, big.NewInt(256))))
+	}
+	for i := 1001; i <= 2000; i++ {
+		assert.NoError(t, honest.InsertBlock(NewBlock(uint64(i), 0, big.NewInt(256))))
+	}
+
+	contender := func(bc *BlockChain) *mmr.Contender {
+		proof, err := bc.GetProof()
+		assert.NoError(t, err)
+		return &mmr.Contender{Proof: proof, Prover: bc}
+	}
+	lc, _ := NewLightClient(memorydb.New(), NewPoW(), nil)
+	res, err := lc.Compare(contender(adversary), contender(honest))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Winner)
+	assert.True(t, errors.Is(res.Faults[0], ErrInvalidPoW))
+	assert.Nil(t, res.Faults[1])
+
+	// Checking no seals, the adversary's chain is heavier.
+	res, err = mmr.CompareProofs(contender(adversary), contender(honest), DefaultProofParams(), DecodeSampledHeader, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, res.Winner)
+	assert.Equal(t, uint64(1001), res.Fork) // genesis and blocks 1 to 1000
+}
+
+func TestLightClient_Update(t *testing.T) {
+	bc := newSealedChain(t, 1500)
+	lc, _ := NewLightClient(memorydb.New(), NewPoW(), nil)
+	p, err := bc.GetIncrementalProof(100)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrNoCheckpoint, lc.Update(p))
+
+	proof, err := bc.GetProof()
+	assert.NoError(t, err)
+	assert.NoError(t, lc.Verify(proof))
+	trusted := lc.Checkpoint().LeafNumber
+
+	for i := 1501; i <= 2000; i++ {
+		assert.NoError(t, bc.InsertBlock(NewBlock(uint64(i), 0, big.NewInt(256))))
+	}
+	p, err = bc.GetIncrementalProof(trusted)
+	assert.NoError(t, err)
+	assert.NoError(t, lc.Update(p))
+	assert.Equal(t, bc.CurrentBlock().MRoot, lc.Checkpoint().RootHash)
+
+	// A proof made for an older checkpoint no longer links.
+	p, err = bc.GetIncrementalProof(trusted)
+	assert.NoError(t, err)
+	assert.True(t, errors.Is(lc.Update(p), ErrInvalidProof))
+}
+
+// forgeChain builds blocks after genesis outside of a BlockChain, enforcing
+// no rule, with the fields of each set by next, and proves them.
+func forgeChain(length int, next func(b, parent *Block, history *mmr.Node)) *mmr.ProofInfo {
+	m := mmr.NewMMRWithMerger(mmr.SHA3, mmr.TimeRangeMerger)
+	blocks := []*Block{genesisBlock}
+	m.Push(genesisBlock.leaf(mmr.SHA3))
+	for i := 1; i <= length; i++ {
+		parent := blocks[i-1]
+		b := NewBlock(uint64(i), 0, big.NewInt(256))
+		b.PreHash, b.MRoot, b.Time = parent.Hash(), m.GetRoot(), parent.Time+TargetBlockTime
+		next(b, parent, m.GetRootNode())
+		blocks = append(blocks, b)
+		m.Push(b.leaf(mmr.SHA3))
+	}
+	proof, _ := m.CreateNewProof(DefaultProofParams())
+	for _, n := range mmr.SortAndRemoveRepeatForBlocks(append([]uint64{}, proof.Checked...)) {
+		enc, _ := rlp.EncodeToBytes(blocks[n])
+		proof.Headers = append(proof.Headers, enc)
+	}
+	return proof
+}
+
+func TestLightClient_DifficultyRaising(t *testing.T) {
+	// Seals are not checked, only the retargeting rule stands in the way.
+	verify := func(proof *mmr.ProofInfo) error {
+		lc, _ := NewLightClient(memorydb.New(), NewFakeEngine(), nil)
+		return lc.Verify(proof)
+	}
+	assert.NoError(t, verify(forgeChain(500, func(b, parent *Block, history *mmr.Node) {})))
+
+	// Few blocks doubling their difficulty outweigh many honest ones.
+	raised := forgeChain(100, func(b, parent *Block, history *mmr.Node) {
+		if parent.Number > 0 {
+			b.Difficulty = new(big.Int).Lsh(parent.Difficulty, 1)
+		}
+	})
+	assert.True(t, errors.Is(verify(raised), ErrInvalidDifficulty))
+
+	// Block times standing still do not make the average difficulty rise.
+	stalled := forgeChain(500, func(b, parent *Block, history *mmr.Node) {
+		if parent.Number > 0 {
+			b.Time = parent.Time
+		}
+	})
+	assert.True(t, errors.Is(verify(stalled), ErrInvalidTime))
+
+	// Blocks a second apart, each at four times the average over the seconds
+	// their timestamps span, gain no more than the minimum span allows.
+	compressed := forgeChain(60, func(b, parent *Block, history *mmr.Node) {
+		min, max, _ := mmr.DecodeTimeRange(history.GetPayload())
+		b.Time = parent.Time + 1
+		avg := new(big.Int).Set(GenesisChildDifficulty)
+		if max > min {
+			avg.Mul(history.GetDifficulty(), big.NewInt(TargetBlockTime))
+			avg.Div(avg, new(big.Int).SetUint64(max-min))
+			if avg.Cmp(GenesisChildDifficulty) < 0 {
+				avg.Set(GenesisChildDifficulty)
+			}
+		}
+		b.Difficulty = avg.Mul(avg, big.NewInt(MaxRetargetFactor))
+	})
+	assert.True(t, errors.Is(verify(compressed), ErrInvalidDifficulty))
+}
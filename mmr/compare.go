@@ -0,0 +1,284 @@
+package mmr
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	ErrNoValidProof = errors.New("no contender has a valid proof")
+	ErrBadAnswer    = errors.New("prover answered a query incorrectly")
+)
+
+// Prover answers the follow-up queries of a verifier comparing its chain with
+// a competing one. All answers are proofs against the MMR of the prover's
+// FlyClient proof and carry the headers of the blocks they check.
+type Prover interface {
+	// ProveBlocks proves the given leaves.
+	ProveBlocks(blocks []uint64) (*ProofInfo, error)
+	// ProveWeights proves the leaves containing the given aggregated
+	// difficulties, i.e. the leaves GetChildByAggrWeightDisc selects.
+	ProveWeights(weights []*big.Int) (*ProofInfo, error)
+}
+
+// HeaderCheck verifies what a proof cannot about a sampled header, typically
+// its seal, or what only the chain knows to check against the leaf it is
+// sampled as, such as its difficulty given the aggregates of the MMR before
+// it. A nil HeaderCheck accepts every header.
+type HeaderCheck func(raw []byte, leaf *ProofLeaf) error
+
+// Contender is a chain competing for the trust of a light client.
+type Contender struct {
+	Proof  *ProofInfo // FlyClient proof of the chain, carrying the sampled headers
+	Prover Prover     // answers queries about the MMR of Proof
+}
+
+// Comparison is the outcome of CompareProofs.
+type Comparison struct {
+	Winner int         // index of the contender which proved more work, -1 on a tie
+	Fork   uint64      // number of leaves both chains share
+	Work   [2]*big.Int // difficulty each contender proved after the fork
+	Faults [2]error    // why a contender was disqualified, nil if it was not
+}
+
+// CompareProofs decides which of two contenders proved more work. Both proofs
+// are verified first, a contender with an invalid proof or answer loses. The
+// fork point is found by bisection: the provers are asked for the leaves at
+// the midpoints and the prefix roots the leaves commit to are compared.
+// Beyond the fork, blocks are sampled by aggregated difficulty like in a
+// FlyClient proof, using randomness derived from both roots, and the chain
+// proving more difficulty after the fork wins. Node hashes commit to
+// difficulties, so the work after the fork is the one the leaves claim. A
+// leaf claiming more than its header is caught by VerifyHeaders, a header
+// without the work behind it by check. Headers are decoded with dec.
+func CompareProofs(a, b *Contender, params *ProofParams, dec HeaderDecoder, check HeaderCheck) (*Comparison, error) {
+	cs := [2]*Contender{a, b}
+	res := &Comparison{Winner: -1}
+	for i, ct := range cs {
+		res.Faults[i] = ct.verify(params, dec, check)
+	}
+	if res.Faults[0] != nil && res.Faults[1] != nil {
+		return res, ErrNoValidProof
+	}
+	for i := range cs {
+		if res.Faults[i] != nil {
+			res.Winner = 1 - i
+			return res, nil
+		}
+	}
+	if equal_hash(a.Proof.RootHash, b.Proof.RootHash) && a.Proof.LeafNumber == b.Proof.LeafNumber {
+		res.Fork = a.Proof.LeafNumber
+		res.Work = [2]*big.Int{new(big.Int), new(big.Int)}
+		return res, nil
+	}
+	fork, fault, err := findFork(cs, dec, check)
+	if err != nil {
+		res.Faults[fault], res.Winner = err, 1-fault
+		return res, nil
+	}
+	res.Fork = fork
+	t := NewTranscript(compareDomain)
+	for _, ct := range cs {
+		t.AbsorbRoot("root", &Root{Hash: ct.Proof.RootHash, Difficulty: ct.Proof.RootDifficulty, LeafNumber: ct.Proof.LeafNumber})
+	}
+	t.AbsorbParams(params)
+	t.Absorb("fork", res.Fork)
+	for i, ct := range cs {
+		res.Work[i], res.Faults[i] = ct.workAfter(res.Fork, t, params, dec, check)
+	}
+	switch {
+	case res.Faults[0] != nil && res.Faults[1] != nil:
+		return res, ErrNoValidProof
+	case res.Faults[0] != nil:
+		res.Winner = 1
+	case res.Faults[1] != nil:
+		res.Winner = 0
+	default:
+		switch res.Work[0].Cmp(res.Work[1]) {
+		case 1:
+			res.Winner = 0
+		case -1:
+			res.Winner = 1
+		}
+	}
+	return res, nil
+}
+
+// verify checks the FlyClient proof of the contender.
+func (ct *Contender) verify(params *ProofParams, dec HeaderDecoder, check HeaderCheck) error {
+	p := ct.Proof
+	if p == nil {
+		return fmt.Errorf("%w: no proof", ErrProofMalformed)
+	}
+	if p.Headers == nil {
+		return fmt.Errorf("%w: no sampled headers", ErrProofMalformed)
+	}
+	tree, err := p.Tree()
+	if err != nil {
+		return err
+	}
+	pBlocks, err := VerifyRequiredBlocks(p, params)
+	if err != nil {
+		return err
+	}
+	leaves, err := p.verifyTree(tree, pBlocks, dec)
+	if err != nil {
+		return err
+	}
+	return checkHeaders(p, leaves, check)
+}
+
+func checkHeaders(p *ProofInfo, leaves []*ProofLeaf, check HeaderCheck) error {
+	if check == nil {
+		return nil
+	}
+	for i, h := range p.Headers {
+		if err := check(h, leaves[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// answer verifies a proof returned by the prover for the given blocks and
+// returns the proven leaves.
+func (ct *Contender) answer(p *ProofInfo, blocks []uint64, dec HeaderDecoder, check HeaderCheck) ([]*ProofLeaf, error) {
+	if p == nil {
+		return nil, fmt.Errorf("%w: no proof", ErrBadAnswer)
+	}
+	if !equal_hash(p.RootHash, ct.Proof.RootHash) || p.LeafNumber != ct.Proof.LeafNumber || p.Hasher != ct.Proof.Hasher || p.Merger != ct.Proof.Merger ||
+		p.RootDifficulty == nil || p.RootDifficulty.Cmp(ct.Proof.RootDifficulty) != 0 {
+		return nil, fmt.Errorf("%w: proof for a different mmr", ErrBadAnswer)
+	}
+	checked := SortAndRemoveRepeatForBlocks(append([]uint64{}, p.Checked...))
+	if blocks != nil {
+		want := SortAndRemoveRepeatForBlocks(append([]uint64{}, blocks...))
+		if len(checked) != len(want) {
+			return nil, fmt.Errorf("%w: proved %v, asked for %v", ErrBadAnswer, checked, want)
+		}
+		for i := range want {
+			if checked[i] != want[i] {
+				return nil, fmt.Errorf("%w: proved %v, asked for %v", ErrBadAnswer, checked, want)
+			}
+		}
+	}
+	if p.Headers == nil {
+		return nil, fmt.Errorf("%w: no headers", ErrBadAnswer)
+	}
+	leaves, err := p.verifyHeaders(dec)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHeaders(p, leaves, check); err != nil {
+		return nil, err
+	}
+	return leaves, nil
+}
+
+// prefixAt returns the leaf the contender has at number n, with the root of
+// its MMR over the leaves before it.
+func (ct *Contender) prefixAt(n uint64, dec HeaderDecoder, check HeaderCheck) (*ProofLeaf, error) {
+	p, err := ct.Prover.ProveBlocks([]uint64{n})
+	if err != nil {
+		return nil, err
+	}
+	leaves, err := ct.answer(p, []uint64{n}, dec, check)
+	if err != nil {
+		return nil, err
+	}
+	return leaves[0], nil
+}
+
+// findFork returns the number of leaves both contenders share. If a
+// contender fails to answer, its index is returned with the error.
+func findFork(cs [2]*Contender, dec HeaderDecoder, check HeaderCheck) (uint64, int, error) {
+	short, long := 0, 1
+	if cs[1].Proof.LeafNumber < cs[0].Proof.LeafNumber {
+		short, long = 1, 0
+	}
+	// The shorter chain may be a prefix of the longer one. Its root is the
+	// MRoot of the longer chain's block following it.
+	lo, hi := uint64(0), cs[short].Proof.LeafNumber
+	if hi < cs[long].Proof.LeafNumber {
+		leaf, err := cs[long].prefixAt(hi, dec, check)
+		if err != nil {
+			return 0, long, err
+		}
+		if leaf.PrefixRoot == cs[short].Proof.RootHash {
+			return hi, 0, nil
+		}
+	}
+	// Invariant: the chains agree on the first lo leaves but not on the
+	// first hi ones. Both have genesis as leaf 0, whose prefix is empty.
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		var leaves [2]*ProofLeaf
+		for i, ct := range cs {
+			leaf, err := ct.prefixAt(mid, dec, check)
+			if err != nil {
+				return 0, i, err
+			}
+			leaves[i] = leaf
+		}
+		if leaves[0].PrefixRoot == leaves[1].PrefixRoot {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, 0, nil
+}
+
+// workAfter samples the contender's blocks after the fork by aggregated
+// difficulty and returns the difficulty they prove.
+func (ct *Contender) workAfter(fork uint64, t *Transcript, params *ProofParams, dec HeaderDecoder, check HeaderCheck) (*big.Int, error) {
+	if fork >= ct.Proof.LeafNumber {
+		return new(big.Int), nil
+	}
+	first, err := ct.prefixAt(fork, dec, check)
+	if err != nil {
+		return nil, err
+	}
+	// The prefix difficulty and RootDifficulty are both committed by the root
+	// hash, as node hashes cover the difficulties of their children.
+	start := first.PrefixDifficulty
+	work := new(big.Int).Sub(ct.Proof.RootDifficulty, start)
+	if work.Sign() <= 0 {
+		return nil, fmt.Errorf("%w: no work after the fork", ErrBadAnswer)
+	}
+	weights := sampleRange(t, start, work, ct.Proof.LeafNumber-fork, params)
+	p, err := ct.Prover.ProveWeights(weights)
+	if err != nil {
+		return nil, err
+	}
+	leaves, err := ct.answer(p, nil, dec, check)
+	if err != nil {
+		return nil, err
+	}
+	if err := coverWeights(leaves, weights, fork); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadAnswer, err)
+	}
+	return work, nil
+}
+
+// ProveBlocks creates a proof for the given leaves, without headers. Provers
+// use it to answer the queries of CompareProofs.
+func (m *Mmr) ProveBlocks(blocks []uint64) *ProofInfo {
+	m = m.Snapshot()
+	blocks = SortAndRemoveRepeatForBlocks(append([]uint64{}, blocks...))
+	info := m.genProof(blocks)
+	info.Checked = blocks
+	return info
+}
+
+// BlocksByWeight returns the leaves containing the given aggregated
+// difficulties, sorted and without duplicates.
+func (m *Mmr) BlocksByWeight(weights []*big.Int) []uint64 {
+	m = m.Snapshot()
+	blocks := make([]uint64, 0, len(weights))
+	for _, w := range weights {
+		blocks = append(blocks, m.childByAggrWeight(w))
+	}
+	return SortAndRemoveRepeatForBlocks(blocks)
+}
@@ -0,0 +1,185 @@
+package mmr
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/marcopoloprotocol/flyclientDemo/rlp"
+)
+
+// testChain is a chain of test headers with its MMR, acting as an honest
+// prover for itself.
+type testChain struct {
+	m       *Mmr
+	headers [][]byte
+}
+
+// extend returns a copy of the chain with count more blocks of the given
+// difficulty. Only every sealEvery-th block is sealed.
+func (tc *testChain) extend(count int, diff int64, sealEvery int) *testChain {
+	return tc.extendClaiming(count, diff, diff, sealEvery)
+}
+
+// extendClaiming is like extend, but the leaves of the new blocks claim the
+// difficulty claimed rather than the one in their headers.
+func (tc *testChain) extendClaiming(count int, diff, claimed int64, sealEvery int) *testChain {
+	next := &testChain{m: NewMMR(), headers: append([][]byte{}, tc.headers...)}
+	if tc.m != nil {
+		next.m = tc.m.Copy()
+	}
+	for i := 0; i < count; i++ {
+		h := &testHeader{
+			Number:     uint64(len(next.headers)),
+			Difficulty: big.NewInt(diff),
+			Unsealed:   i%sealEvery != 0,
+		}
+		if h.Number > 0 {
+			h.MRoot = next.m.GetRoot()
+		}
+		enc, _ := rlp.EncodeToBytes(h)
+		next.headers = append(next.headers, enc)
+		next.m.Push(NewNode(RlpHash(h), big.NewInt(claimed)))
+	}
+	return next
+}
+
+func (tc *testChain) withHeaders(p *ProofInfo) *ProofInfo {
+	for _, n := range SortAndRemoveRepeatForBlocks(append([]uint64{}, p.Checked...)) {
+		p.Headers = append(p.Headers, tc.headers[n])
+	}
+	return p
+}
+
+func (tc *testChain) ProveBlocks(blocks []uint64) (*ProofInfo, error) {
+	return tc.withHeaders(tc.m.ProveBlocks(blocks)), nil
+}
+
+func (tc *testChain) ProveWeights(weights []*big.Int) (*ProofInfo, error) {
+	return tc.ProveBlocks(tc.m.BlocksByWeight(weights))
+}
+
+func (tc *testChain) contender() *Contender {
+	proof, _ := tc.m.CreateNewProof(testParams())
+	return &Contender{Proof: tc.withHeaders(proof), Prover: tc}
+}
+
+var errUnsealed = errors.New("unsealed header")
+
+func checkTestSeal(raw []byte, leaf *ProofLeaf) error {
+	h := new(testHeader)
+	if err := rlp.DecodeBytes(raw, h); err != nil {
+		return err
+	}
+	if h.Unsealed {
+		return errUnsealed
+	}
+	return nil
+}
+
+// lyingProver answers every query with a proof of other blocks.
+type lyingProver struct{ *testChain }
+
+func (lp lyingProver) ProveBlocks(blocks []uint64) (*ProofInfo, error) {
+	return lp.testChain.ProveBlocks([]uint64{0})
+}
+
+func TestCompareProofs(t *testing.T) {
+	shared := new(testChain).extend(1000, 1000, 1)
+	light := shared.extend(500, 1000, 1)
+	heavy := shared.extend(300, 2000, 1)
+
+	res, err := CompareProofs(light.contender(), heavy.contender(), testParams(), decodeTestHeader, checkTestSeal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Winner != 1 || res.Fork != 1000 || res.Faults[0] != nil || res.Faults[1] != nil {
+		t.Fatalf("heavier fork lost: %+v", res)
+	}
+	if res.Work[0].Cmp(big.NewInt(500000)) != 0 || res.Work[1].Cmp(big.NewInt(600000)) != 0 {
+		t.Fatalf("wrong work after the fork: %v", res.Work)
+	}
+
+	// A chain extending the other one wins, the fork is the shorter chain.
+	res, err = CompareProofs(light.contender(), shared.contender(), testParams(), decodeTestHeader, checkTestSeal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Winner != 0 || res.Fork != 1000 {
+		t.Fatalf("longer chain lost: %+v", res)
+	}
+
+	// Identical chains tie.
+	res, err = CompareProofs(light.contender(), light.contender(), testParams(), decodeTestHeader, checkTestSeal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Winner != -1 || res.Fork != light.m.GetLeafNumber() {
+		t.Fatalf("identical chains do not tie: %+v", res)
+	}
+}
+
+func TestCompareProofsForgedTail(t *testing.T) {
+	// The adversary forks off the honest chain and, sealing only every tenth
+	// block, claims a tail far heavier than the honest one.
+	shared := new(testChain).extend(1000, 1000, 1)
+	honest := shared.extend(1000, 1000, 1)
+	forged := shared.extend(200, 100000, 10)
+
+	res, err := CompareProofs(honest.contender(), forged.contender(), testParams(), decodeTestHeader, checkTestSeal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Winner != 0 || res.Faults[0] != nil || !errors.Is(res.Faults[1], errUnsealed) {
+		t.Fatalf("forged tail won: %+v", res)
+	}
+
+	// Without checking the seals the forged tail looks heavier.
+	res, err = CompareProofs(honest.contender(), forged.contender(), testParams(), decodeTestHeader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Winner != 1 {
+		t.Fatalf("unchecked forged tail lost: %+v", res)
+	}
+
+	// Neither can sealed headers back leaves claiming more difficulty.
+	inflated := shared.extendClaiming(200, 1000, 100000, 1)
+	res, err = CompareProofs(honest.contender(), inflated.contender(), testParams(), decodeTestHeader, checkTestSeal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Winner != 0 || !errors.Is(res.Faults[1], ErrHeaderLeaf) {
+		t.Fatalf("inflated leaves won: %+v", res)
+	}
+
+	// Nor can a proof move difficulty onto the nodes it reveals, as node
+	// hashes commit to it.
+	raised := forged.contender()
+	extra := big.NewInt(1000000000)
+	for _, e := range raised.Proof.Elems {
+		if e.Cat == 1 {
+			e.Res = &proofRes{h: e.Res.h, td: new(big.Int).Add(e.Res.td, extra)}
+			break
+		}
+	}
+	raised.Proof.RootDifficulty = new(big.Int).Add(raised.Proof.RootDifficulty, extra)
+	res, err = CompareProofs(honest.contender(), raised, testParams(), decodeTestHeader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Winner != 0 || !errors.Is(res.Faults[1], ErrProofRootDiffer) {
+		t.Fatalf("raised difficulty won: %+v", res)
+	}
+
+	// A prover answering the wrong queries is disqualified.
+	liar := forged.contender()
+	liar.Prover = lyingProver{forged}
+	res, err = CompareProofs(honest.contender(), liar, testParams(), decodeTestHeader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Winner != 0 || !errors.Is(res.Faults[1], ErrBadAnswer) {
+		t.Fatalf("lying prover won: %+v", res)
+	}
+}
@@ -0,0 +1,164 @@
+package mmr
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+)
+
+var ErrInconsistent = errors.New("mmr does not extend the old one")
+
+// Root identifies an MMR by its root hash, total difficulty and leaf count,
+// which is all a light client keeps of it.
+type Root struct {
+	Hash       common.Hash
+	Difficulty *big.Int
+	LeafNumber uint64
+}
+
+// ProofNode is a node sent in a proof, with the difficulty and payload it
+// aggregates.
+type ProofNode struct {
+	Hash       common.Hash
+	Difficulty *big.Int
+	Payload    []byte
+}
+
+func newProofNode(n *Node) ProofNode {
+	return ProofNode{Hash: n.getHash(), Difficulty: n.getDifficulty(), Payload: n.getPayload()}
+}
+
+func (n *ProofNode) res() *proofRes {
+	return &proofRes{h: n.Hash, td: n.Difficulty, payload: n.Payload}
+}
+
+// ConsistencyProof proves that an MMR is an append-only extension of an older
+// one, i.e. that the old leaves are a prefix of the new ones.
+type ConsistencyProof struct {
+	Hasher   HasherID    // hash function of the mmr
+	Merger   MergerID    // payload schema of the mmr
+	Peaks    []ProofNode // peaks of the old MMR, largest first
+	Siblings []ProofNode // subtrees of the new MMR holding no old leaf, depth first
+}
+
+// ProveConsistency proves that m extends the MMR of its first oldLeafNum
+// leaves.
+func (m *Mmr) ProveConsistency(oldLeafNum uint64) (*ConsistencyProof, error) {
+	m = m.Snapshot()
+	if oldLeafNum == 0 || oldLeafNum > m.getLeafNumber() {
+		return nil, fmt.Errorf("%w: %d of %d", ErrLeafRange, oldLeafNum, m.getLeafNumber())
+	}
+	p := &ConsistencyProof{Hasher: m.hasher.ID(), Merger: mergerID(m.merger)}
+	for _, n := range m.peaksAt(oldLeafNum) {
+		p.Peaks = append(p.Peaks, newProofNode(n))
+	}
+	m.proveExtension(0, m.getLeafNumber(), 0, oldLeafNum, p)
+	return p, nil
+}
+
+// proveExtension adds the siblings of the subtree with n leaves starting at
+// leaf lo, whose nodes start at position off. Subtrees made of old leaves
+// only are old peaks, which the proof already holds.
+func (m *Mmr) proveExtension(off, n, lo, oldLeafNum uint64, p *ConsistencyProof) {
+	switch {
+	case lo+n <= oldLeafNum && IsPowerOfTwo(n):
+		return
+	case lo >= oldLeafNum:
+		root := m.getNode(off + leaf_to_node_number(n) - 1)
+		p.Siblings = append(p.Siblings, newProofNode(root))
+		return
+	}
+	left_leaf_number := get_left_leaf_number(n)
+	m.proveExtension(off, left_leaf_number, lo, oldLeafNum, p)
+	m.proveExtension(off+leaf_to_node_number(left_leaf_number), n-left_leaf_number, lo+left_leaf_number, oldLeafNum, p)
+}
+
+// Verify checks that the MMR identified by to extends the one identified by
+// from: the old peaks fold into the old root and difficulty, and together
+// with the new subtrees into the new ones. Node hashes commit to the
+// difficulties of their children, so the new difficulty is proven along with
+// the new root.
+func (p *ConsistencyProof) Verify(from, to *Root) error {
+	if from.LeafNumber == 0 || from.LeafNumber > to.LeafNumber {
+		return fmt.Errorf("%w: %d of %d", ErrLeafRange, from.LeafNumber, to.LeafNumber)
+	}
+	if len(p.Peaks) != len(peak_positions(from.LeafNumber)) {
+		return fmt.Errorf("%w: %d peaks for %d leaves", ErrProofShape, len(p.Peaks), from.LeafNumber)
+	}
+	h, err := HasherByID(p.Hasher)
+	if err != nil {
+		return err
+	}
+	g, err := MergerByID(p.Merger)
+	if err != nil {
+		return err
+	}
+	peaks := make([]*proofRes, len(p.Peaks))
+	for i, n := range append(append([]ProofNode{}, p.Peaks...), p.Siblings...) {
+		if n.Difficulty == nil || n.Difficulty.Sign() < 0 {
+			return fmt.Errorf("%w: node %d has no difficulty", ErrProofMalformed, i)
+		}
+		if err := checkPayload(g, n.Payload); err != nil {
+			return fmt.Errorf("node %d: %w", i, err)
+		}
+		if i < len(peaks) {
+			peaks[i] = n.res()
+		}
+	}
+	old := bagProofRes(h, g, peaks)
+	if !equal_hash(old.h, from.Hash) || from.Difficulty == nil || old.td.Cmp(from.Difficulty) != 0 {
+		return fmt.Errorf("%w: old peaks do not match the old root", ErrInconsistent)
+	}
+	v := &extensionVerifier{hasher: h, merger: g, peaks: peaks, siblings: p.Siblings}
+	root, err := v.subtree(to.LeafNumber, 0, from.LeafNumber)
+	if err != nil {
+		return err
+	}
+	if len(v.peaks) != 0 || len(v.siblings) != 0 {
+		return fmt.Errorf("%w: %d trailing nodes", ErrProofShape, len(v.peaks)+len(v.siblings))
+	}
+	if !equal_hash(root.h, to.Hash) || to.Difficulty == nil || root.td.Cmp(to.Difficulty) != 0 {
+		return ErrInconsistent
+	}
+	return nil
+}
+
+// extensionVerifier rebuilds the new MMR from the old peaks and the siblings
+// of a consistency proof, in the order ProveConsistency wrote them.
+type extensionVerifier struct {
+	hasher   Hasher
+	merger   Merger
+	peaks    []*proofRes
+	siblings []ProofNode
+}
+
+func (v *extensionVerifier) subtree(n, lo, oldLeafNum uint64) (*proofRes, error) {
+	switch {
+	case lo+n <= oldLeafNum && IsPowerOfTwo(n):
+		if len(v.peaks) == 0 {
+			return nil, fmt.Errorf("%w: too few peaks", ErrProofShape)
+		}
+		peak := v.peaks[0]
+		v.peaks = v.peaks[1:]
+		return peak, nil
+	case lo >= oldLeafNum:
+		if len(v.siblings) == 0 {
+			return nil, fmt.Errorf("%w: too few siblings", ErrProofShape)
+		}
+		s := v.siblings[0]
+		v.siblings = v.siblings[1:]
+		return s.res(), nil
+	}
+	left_leaf_number := get_left_leaf_number(n)
+	left, err := v.subtree(left_leaf_number, lo, oldLeafNum)
+	if err != nil {
+		return nil, err
+	}
+	right, err := v.subtree(n-left_leaf_number, lo+left_leaf_number, oldLeafNum)
+	if err != nil {
+		return nil, err
+	}
+	return mergeRes(v.hasher, v.merger, left, right), nil
+}
@@ -0,0 +1,62 @@
+package mmr
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func rootOf(m *Mmr, leafNum uint64) *Root {
+	r := m.BagPeaks(m.PeaksAt(leafNum))
+	return &Root{Hash: r.GetHash(), Difficulty: r.GetDifficulty(), LeafNumber: leafNum}
+}
+
+func TestProveConsistency(t *testing.T) {
+	m := NewMMR()
+	for i := 0; i < 1100; i++ {
+		m.Push(testLeaf(i))
+	}
+	to := rootOf(m, m.GetLeafNumber())
+	for _, old := range []uint64{1, 2, 3, 7, 8, 9, 511, 512, 513, 1000, 1099, 1100} {
+		p, err := m.ProveConsistency(old)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from := rootOf(m, old)
+		if err := p.Verify(from, to); err != nil {
+			t.Fatalf("%d leaves: %v", old, err)
+		}
+		// Forks and forged difficulties are refused.
+		fork := m.Copy()
+		for fork.GetLeafNumber() > old {
+			fork.Pop()
+		}
+		for fork.GetLeafNumber() < m.GetLeafNumber() {
+			fork.Push(testLeaf(int(fork.GetLeafNumber()) + 5000))
+		}
+		if old < m.GetLeafNumber() {
+			if err := p.Verify(from, rootOf(fork, fork.GetLeafNumber())); !errors.Is(err, ErrInconsistent) {
+				t.Fatalf("%d leaves: fork: have %v, want %v", old, err, ErrInconsistent)
+			}
+		}
+		heavier := *to
+		heavier.Difficulty = new(big.Int).Add(to.Difficulty, big.NewInt(1))
+		if err := p.Verify(from, &heavier); !errors.Is(err, ErrInconsistent) {
+			t.Fatalf("%d leaves: forged difficulty: have %v, want %v", old, err, ErrInconsistent)
+		}
+		if len(p.Siblings) > 0 {
+			p.Siblings[0].Difficulty = new(big.Int).Add(p.Siblings[0].Difficulty, big.NewInt(1))
+			if err := p.Verify(from, to); !errors.Is(err, ErrInconsistent) {
+				t.Fatalf("%d leaves: forged sibling: have %v, want %v", old, err, ErrInconsistent)
+			}
+			// Hashes commit to difficulties, so the new root can not be
+			// raised along with the sibling.
+			if err := p.Verify(from, &heavier); !errors.Is(err, ErrInconsistent) {
+				t.Fatalf("%d leaves: forged sibling and root: have %v, want %v", old, err, ErrInconsistent)
+			}
+		}
+	}
+	if _, err := m.ProveConsistency(1101); !errors.Is(err, ErrLeafRange) {
+		t.Fatalf("future leaf count: have %v, want %v", err, ErrLeafRange)
+	}
+}
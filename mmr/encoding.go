@@ -0,0 +1,393 @@
+package mmr
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+	"github.com/marcopoloprotocol/flyclientDemo/common/hexutil"
+	"github.com/marcopoloprotocol/flyclientDemo/rlp"
+)
+
+// ProofVersion is the version of the wire format written by EncodeRLP and
+// MarshalJSON. Decoding rejects every other version.
+const ProofVersion = uint64(7)
+
+var (
+	ErrProofVersion    = errors.New("unsupported proof version")
+	ErrProofMalformed  = errors.New("malformed proof")
+	ErrProofRootDiffer = errors.New("proof root element does not match proof header")
+)
+
+// rlpProofRes, rlpProofElem and rlpProofInfo are the canonical wire forms of
+// proofRes, ProofElem and ProofInfo, with all fields exported so that the rlp
+// package can see them.
+type rlpProofRes struct {
+	Hash       common.Hash
+	Difficulty *big.Int
+	Payload    []byte
+}
+type rlpProofElem struct {
+	Cat     uint8
+	Res     rlpProofRes
+	Right   bool
+	LeafNum uint64
+}
+
+// rlpProofParams stores C by its IEEE 754 bits, rlp has no floats.
+type rlpProofParams struct {
+	ChainID            uint64
+	Hasher             HasherID
+	Merger             MergerID
+	Lambda             uint64
+	C                  uint64
+	RightDifficulty    *big.Int
+	CheckpointInterval uint64
+	MaxCheckpoints     uint64
+}
+type rlpProofInfo struct {
+	Version        uint64
+	RootHash       common.Hash
+	RootDifficulty *big.Int
+	LeafNumber     uint64
+	Hasher         HasherID
+	Merger         MergerID
+	RootPayload    []byte
+	Elems          []rlpProofElem
+	Checked        []uint64
+	Params         *rlpProofParams `rlp:"nil"`
+	Headers        [][]byte
+}
+
+type jsonProofElem struct {
+	Cat        hexutil.Uint64 `json:"cat"`
+	Hash       common.Hash    `json:"hash"`
+	Difficulty *hexutil.Big   `json:"difficulty"`
+	Payload    hexutil.Bytes  `json:"payload,omitempty"`
+	Right      bool           `json:"right"`
+	LeafNum    hexutil.Uint64 `json:"leafNum"`
+}
+type jsonProofParams struct {
+	ChainID            hexutil.Uint64 `json:"chainId"`
+	Hasher             hexutil.Uint64 `json:"hasher"`
+	Merger             hexutil.Uint64 `json:"merger"`
+	Lambda             hexutil.Uint64 `json:"lambda"`
+	C                  float64        `json:"c"`
+	RightDifficulty    *hexutil.Big   `json:"rightDifficulty"`
+	CheckpointInterval hexutil.Uint64 `json:"checkpointInterval"`
+	MaxCheckpoints     hexutil.Uint64 `json:"maxCheckpoints"`
+}
+type jsonProofInfo struct {
+	Version        hexutil.Uint64   `json:"version"`
+	RootHash       common.Hash      `json:"rootHash"`
+	RootDifficulty *hexutil.Big     `json:"rootDifficulty"`
+	LeafNumber     hexutil.Uint64   `json:"leafNumber"`
+	Hasher         hexutil.Uint64   `json:"hasher"`
+	Merger         hexutil.Uint64   `json:"merger"`
+	RootPayload    hexutil.Bytes    `json:"rootPayload,omitempty"`
+	Elems          []*jsonProofElem `json:"elems"`
+	Checked        []hexutil.Uint64 `json:"checked"`
+	Params         *jsonProofParams `json:"params,omitempty"`
+	Headers        []hexutil.Bytes  `json:"headers,omitempty"`
+}
+
+func (p *ProofParams) toRLP() *rlpProofParams {
+	return &rlpProofParams{
+		ChainID:            p.ChainID,
+		Hasher:             p.Hasher,
+		Merger:             p.Merger,
+		Lambda:             p.Lambda,
+		C:                  math.Float64bits(p.C),
+		RightDifficulty:    p.RightDifficulty,
+		CheckpointInterval: p.CheckpointInterval,
+		MaxCheckpoints:     p.MaxCheckpoints,
+	}
+}
+
+func (p *rlpProofParams) params() *ProofParams {
+	return &ProofParams{
+		ChainID:            p.ChainID,
+		Hasher:             p.Hasher,
+		Merger:             p.Merger,
+		Lambda:             p.Lambda,
+		C:                  math.Float64frombits(p.C),
+		RightDifficulty:    p.RightDifficulty,
+		CheckpointInterval: p.CheckpointInterval,
+		MaxCheckpoints:     p.MaxCheckpoints,
+	}
+}
+
+func (p *ProofInfo) toRLP() *rlpProofInfo {
+	enc := &rlpProofInfo{
+		Version:        ProofVersion,
+		RootHash:       p.RootHash,
+		RootDifficulty: p.RootDifficulty,
+		LeafNumber:     p.LeafNumber,
+		Hasher:         p.Hasher,
+		Merger:         p.Merger,
+		RootPayload:    p.RootPayload,
+		Elems:          make([]rlpProofElem, len(p.Elems)),
+		Checked:        p.Checked,
+		Headers:        p.Headers,
+	}
+	if p.Params != nil {
+		enc.Params = p.Params.toRLP()
+	}
+	for i, e := range p.Elems {
+		enc.Elems[i] = rlpProofElem{
+			Cat:     e.Cat,
+			Res:     rlpProofRes{Hash: e.Res.h, Difficulty: e.Res.td, Payload: e.Res.payload},
+			Right:   e.Right,
+			LeafNum: e.LeafNum,
+		}
+	}
+	return enc
+}
+
+func (p *ProofInfo) fromRLP(dec *rlpProofInfo) {
+	p.RootHash = dec.RootHash
+	p.RootDifficulty = dec.RootDifficulty
+	p.LeafNumber = dec.LeafNumber
+	p.Hasher = dec.Hasher
+	p.Merger = dec.Merger
+	p.RootPayload = nonEmpty(dec.RootPayload)
+	p.Checked = dec.Checked
+	p.Params = nil
+	if dec.Params != nil {
+		p.Params = dec.Params.params()
+	}
+	p.Headers = nil
+	if len(dec.Headers) > 0 {
+		p.Headers = dec.Headers
+	}
+	p.Elems = make([]*ProofElem, len(dec.Elems))
+	for i, e := range dec.Elems {
+		p.Elems[i] = &ProofElem{
+			Cat:     e.Cat,
+			Res:     &proofRes{h: e.Res.Hash, td: e.Res.Difficulty, payload: nonEmpty(e.Res.Payload)},
+			Right:   e.Right,
+			LeafNum: e.LeafNum,
+		}
+	}
+}
+
+// nonEmpty returns b, or nil if it is empty. Decoders return empty payloads
+// where the prover had none.
+func nonEmpty(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+// EncodeRLP implements rlp.Encoder. The proof is validated first, so only
+// well-formed proofs ever reach the wire.
+func (p *ProofInfo) EncodeRLP(w io.Writer) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	return rlp.Encode(w, p.toRLP())
+}
+
+// DecodeRLP implements rlp.Decoder.
+func (p *ProofInfo) DecodeRLP(s *rlp.Stream) error {
+	var dec rlpProofInfo
+	if err := s.Decode(&dec); err != nil {
+		return err
+	}
+	if dec.Version != ProofVersion {
+		return fmt.Errorf("%w: %d", ErrProofVersion, dec.Version)
+	}
+	p.fromRLP(&dec)
+	return p.Validate()
+}
+
+// MarshalJSON implements json.Marshaler, using hex strings for all numbers.
+func (p *ProofInfo) MarshalJSON() ([]byte, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	enc := &jsonProofInfo{
+		Version:        hexutil.Uint64(ProofVersion),
+		RootHash:       p.RootHash,
+		RootDifficulty: (*hexutil.Big)(p.RootDifficulty),
+		LeafNumber:     hexutil.Uint64(p.LeafNumber),
+		Hasher:         hexutil.Uint64(p.Hasher),
+		Merger:         hexutil.Uint64(p.Merger),
+		RootPayload:    p.RootPayload,
+		Elems:          make([]*jsonProofElem, len(p.Elems)),
+		Checked:        make([]hexutil.Uint64, len(p.Checked)),
+	}
+	for i, e := range p.Elems {
+		enc.Elems[i] = &jsonProofElem{
+			Cat:        hexutil.Uint64(e.Cat),
+			Hash:       e.Res.h,
+			Difficulty: (*hexutil.Big)(e.Res.td),
+			Payload:    e.Res.payload,
+			Right:      e.Right,
+			LeafNum:    hexutil.Uint64(e.LeafNum),
+		}
+	}
+	for i, v := range p.Checked {
+		enc.Checked[i] = hexutil.Uint64(v)
+	}
+	if p.Params != nil {
+		enc.Params = &jsonProofParams{
+			ChainID:            hexutil.Uint64(p.Params.ChainID),
+			Hasher:             hexutil.Uint64(p.Params.Hasher),
+			Merger:             hexutil.Uint64(p.Params.Merger),
+			Lambda:             hexutil.Uint64(p.Params.Lambda),
+			C:                  p.Params.C,
+			RightDifficulty:    (*hexutil.Big)(p.Params.RightDifficulty),
+			CheckpointInterval: hexutil.Uint64(p.Params.CheckpointInterval),
+			MaxCheckpoints:     hexutil.Uint64(p.Params.MaxCheckpoints),
+		}
+	}
+	for _, h := range p.Headers {
+		enc.Headers = append(enc.Headers, h)
+	}
+	return json.Marshal(enc)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Unknown fields are rejected.
+func (p *ProofInfo) UnmarshalJSON(input []byte) error {
+	var dec jsonProofInfo
+	d := json.NewDecoder(bytes.NewReader(input))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&dec); err != nil {
+		return err
+	}
+	if uint64(dec.Version) != ProofVersion {
+		return fmt.Errorf("%w: %d", ErrProofVersion, dec.Version)
+	}
+	if dec.RootDifficulty == nil {
+		return fmt.Errorf("%w: missing rootDifficulty", ErrProofMalformed)
+	}
+	if dec.Hasher > math.MaxUint8 || (dec.Params != nil && dec.Params.Hasher > math.MaxUint8) {
+		return fmt.Errorf("%w: invalid hasher", ErrProofMalformed)
+	}
+	if dec.Merger > math.MaxUint8 || (dec.Params != nil && dec.Params.Merger > math.MaxUint8) {
+		return fmt.Errorf("%w: invalid merger", ErrProofMalformed)
+	}
+	r := &rlpProofInfo{
+		Version:        uint64(dec.Version),
+		RootHash:       dec.RootHash,
+		RootDifficulty: dec.RootDifficulty.ToInt(),
+		LeafNumber:     uint64(dec.LeafNumber),
+		Hasher:         HasherID(dec.Hasher),
+		Merger:         MergerID(dec.Merger),
+		RootPayload:    dec.RootPayload,
+		Elems:          make([]rlpProofElem, len(dec.Elems)),
+		Checked:        make([]uint64, len(dec.Checked)),
+	}
+	for i, e := range dec.Elems {
+		if e == nil || e.Difficulty == nil {
+			return fmt.Errorf("%w: elem %d has no difficulty", ErrProofMalformed, i)
+		}
+		if e.Cat > 2 {
+			return fmt.Errorf("%w: elem %d has invalid cat %d", ErrProofMalformed, i, e.Cat)
+		}
+		r.Elems[i] = rlpProofElem{
+			Cat:     uint8(e.Cat),
+			Res:     rlpProofRes{Hash: e.Hash, Difficulty: e.Difficulty.ToInt(), Payload: e.Payload},
+			Right:   e.Right,
+			LeafNum: uint64(e.LeafNum),
+		}
+	}
+	for i, v := range dec.Checked {
+		r.Checked[i] = uint64(v)
+	}
+	if dec.Params != nil {
+		if dec.Params.RightDifficulty == nil {
+			return fmt.Errorf("%w: missing rightDifficulty", ErrProofMalformed)
+		}
+		r.Params = &rlpProofParams{
+			ChainID:            uint64(dec.Params.ChainID),
+			Hasher:             HasherID(dec.Params.Hasher),
+			Merger:             MergerID(dec.Params.Merger),
+			Lambda:             uint64(dec.Params.Lambda),
+			C:                  math.Float64bits(dec.Params.C),
+			RightDifficulty:    dec.Params.RightDifficulty.ToInt(),
+			CheckpointInterval: uint64(dec.Params.CheckpointInterval),
+			MaxCheckpoints:     uint64(dec.Params.MaxCheckpoints),
+		}
+	}
+	for _, h := range dec.Headers {
+		r.Headers = append(r.Headers, h)
+	}
+	p.fromRLP(r)
+	return p.Validate()
+}
+
+// Validate checks that the proof is structurally sound: every element is
+// complete, the trailing root element agrees with the proof header, the
+// checked blocks lie inside the MMR, the parameters name the proof's hash
+// function and merger and, if present, there is one header per checked
+// block. It does not verify the proof itself, see VerifyRequiredBlocks and
+// VerifyProof for that.
+func (p *ProofInfo) Validate() error {
+	if p.RootDifficulty == nil || p.RootDifficulty.Sign() < 0 {
+		return fmt.Errorf("%w: invalid root difficulty", ErrProofMalformed)
+	}
+	if p.LeafNumber == 0 {
+		return fmt.Errorf("%w: empty mmr", ErrProofMalformed)
+	}
+	if len(p.Elems) < 2 {
+		return fmt.Errorf("%w: too few elements (%d)", ErrProofMalformed, len(p.Elems))
+	}
+	children := 0
+	for i, e := range p.Elems {
+		if e == nil || e.Res == nil || e.Res.td == nil || e.Res.td.Sign() < 0 {
+			return fmt.Errorf("%w: elem %d is incomplete", ErrProofMalformed, i)
+		}
+		last := i == len(p.Elems)-1
+		switch {
+		case e.Cat == 0 && !last, e.Cat != 0 && last:
+			return fmt.Errorf("%w: root element must be last", ErrProofMalformed)
+		case e.Cat > 2:
+			return fmt.Errorf("%w: elem %d has invalid cat %d", ErrProofMalformed, i, e.Cat)
+		case e.Cat == 2:
+			children++
+		}
+	}
+	root := p.Elems[len(p.Elems)-1]
+	if root.LeafNum != p.LeafNumber || !equal_hash(root.Res.h, p.RootHash) ||
+		root.Res.td.Cmp(p.RootDifficulty) != 0 || !bytes.Equal(root.Res.payload, p.RootPayload) {
+		return ErrProofRootDiffer
+	}
+	unique := 0
+	for i, v := range p.Checked {
+		if v >= p.LeafNumber {
+			return fmt.Errorf("%w: checked block %d out of range", ErrProofMalformed, v)
+		}
+		if i > 0 && v < p.Checked[i-1] {
+			return fmt.Errorf("%w: checked blocks not sorted", ErrProofMalformed)
+		}
+		if i == 0 || v != p.Checked[i-1] {
+			unique++
+		}
+	}
+	if unique != children {
+		return fmt.Errorf("%w: %d checked blocks but %d child elements", ErrProofMalformed, unique, children)
+	}
+	if p.Params != nil {
+		if err := p.Params.Validate(); err != nil {
+			return err
+		}
+		if p.Params.Hasher != p.Hasher {
+			return fmt.Errorf("%w: parameters name hasher %d, proof uses %d", ErrProofMalformed, p.Params.Hasher, p.Hasher)
+		}
+		if p.Params.Merger != p.Merger {
+			return fmt.Errorf("%w: parameters name merger %d, proof uses %d", ErrProofMalformed, p.Params.Merger, p.Merger)
+		}
+	}
+	if p.Headers != nil && len(p.Headers) != unique {
+		return fmt.Errorf("%w: %d headers for %d checked blocks", ErrProofMalformed, len(p.Headers), unique)
+	}
+	return nil
+}
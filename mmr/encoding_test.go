@@ -0,0 +1,112 @@
+package mmr
+
+import (
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common/hexutil"
+	"github.com/marcopoloprotocol/flyclientDemo/rlp"
+)
+
+func newTestProof(count int) *ProofInfo {
+	m := NewMMR()
+	for i := 0; i < count; i++ {
+		m.Push(NewNode(BytesToHash(IntToBytes(i)), big.NewInt(1000)))
+	}
+	proof, _ := m.CreateNewProof(testParams())
+	return proof
+}
+
+func checkSameProof(t *testing.T, want, got *ProofInfo) {
+	if want.String() != got.String() {
+		t.Fatalf("proof mismatch:\nwant %v\ngot  %v", want, got)
+	}
+	if !reflect.DeepEqual(want.Checked, got.Checked) {
+		t.Fatalf("checked mismatch: want %v, got %v", want.Checked, got.Checked)
+	}
+	if !reflect.DeepEqual(want.Headers, got.Headers) {
+		t.Fatalf("headers mismatch: want %x, got %x", want.Headers, got.Headers)
+	}
+}
+
+func TestProofInfoRLP(t *testing.T) {
+	proof := newTestProof(1500)
+	enc, err := rlp.EncodeToBytes(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := new(ProofInfo)
+	if err := rlp.DecodeBytes(enc, dec); err != nil {
+		t.Fatal(err)
+	}
+	checkSameProof(t, proof, dec)
+
+	pBlocks, err := VerifyRequiredBlocks(dec, testParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dec.VerifyProof(pBlocks, nil) {
+		t.Fatal("decoded proof does not verify")
+	}
+}
+
+func TestProofInfoJSON(t *testing.T) {
+	proof := newTestProof(777)
+	for range SortAndRemoveRepeatForBlocks(append([]uint64{}, proof.Checked...)) {
+		proof.Headers = append(proof.Headers, []byte{0xc0})
+	}
+	enc, err := json.Marshal(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := new(ProofInfo)
+	if err := json.Unmarshal(enc, dec); err != nil {
+		t.Fatal(err)
+	}
+	checkSameProof(t, proof, dec)
+
+	// unknown fields and foreign versions are refused
+	var raw map[string]interface{}
+	json.Unmarshal(enc, &raw)
+	raw["version"] = "0x1"
+	bad, _ := json.Marshal(raw)
+	if err := json.Unmarshal(bad, new(ProofInfo)); err == nil {
+		t.Fatal("accepted unknown version")
+	}
+	raw["version"] = hexutil.EncodeUint64(ProofVersion)
+	raw["extra"] = "0x1"
+	bad, _ = json.Marshal(raw)
+	if err := json.Unmarshal(bad, new(ProofInfo)); err == nil {
+		t.Fatal("accepted unknown field")
+	}
+}
+
+func TestProofInfoValidate(t *testing.T) {
+	proof := newTestProof(100)
+	if err := proof.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []func(p *ProofInfo){
+		func(p *ProofInfo) { p.RootDifficulty = nil },
+		func(p *ProofInfo) { p.LeafNumber++ },
+		func(p *ProofInfo) { p.RootHash[0]++ },
+		func(p *ProofInfo) { p.Elems = p.Elems[:len(p.Elems)-1] },
+		func(p *ProofInfo) { p.Elems[0].Cat = 3 },
+		func(p *ProofInfo) { p.Elems[0].Res = nil },
+		func(p *ProofInfo) { p.Checked = append(p.Checked, p.LeafNumber) },
+		func(p *ProofInfo) { p.Checked[0], p.Checked[1] = p.Checked[len(p.Checked)-1], p.Checked[0] },
+		func(p *ProofInfo) { p.Headers = [][]byte{{0xc0}} },
+	}
+	for i, corrupt := range tests {
+		p := newTestProof(100)
+		corrupt(p)
+		if err := p.Validate(); err == nil {
+			t.Errorf("test %d: corrupted proof passed validation", i)
+		}
+		if _, err := rlp.EncodeToBytes(p); err == nil {
+			t.Errorf("test %d: corrupted proof was encoded", i)
+		}
+	}
+}
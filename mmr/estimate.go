@@ -0,0 +1,200 @@
+package mmr
+
+import (
+	"errors"
+	"math"
+	"math/big"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+	"github.com/marcopoloprotocol/flyclientDemo/rlp"
+)
+
+var ErrEmptyProfile = errors.New("difficulty profile has no difficulty")
+
+// DifficultyProfile gives the difficulty of each leaf of a chain.
+type DifficultyProfile func(leaf uint64) *big.Int
+
+// ConstantDifficulty is the profile of a chain whose blocks all have
+// difficulty d.
+func ConstantDifficulty(d *big.Int) DifficultyProfile {
+	return func(uint64) *big.Int { return d }
+}
+
+// ProofEstimate is the expected shape of a proof made by CreateNewProof, see
+// EstimateProof.
+type ProofEstimate struct {
+	// Queries is the number of samples, exactly as the proof will have.
+	Queries uint64
+	// Blocks is the expected number of distinct sampled blocks, which is
+	// also the number of headers the proof carries.
+	Blocks float64
+	// Elems is the expected number of proof elements.
+	Elems float64
+	// Hashes is the expected number of nodes the verifier rehashes to
+	// rebuild the root, a measure of the verification cost.
+	Hashes float64
+	// Size is the expected RLP encoded size in bytes, without headers.
+	Size float64
+}
+
+// EstimateProof predicts the proof CreateNewProof makes for a chain of leaves
+// blocks with the given difficulties. The samples are independent, so the
+// expectations are exact up to float rounding, a single proof varies around
+// them. It takes time linear in leaves.
+func EstimateProof(leaves uint64, profile DifficultyProfile, params *ProofParams) (*ProofEstimate, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	// prefix[i] is the total difficulty of the first i leaves.
+	prefix, total := make([]float64, leaves+1), new(big.Int)
+	for i := uint64(0); i < leaves; i++ {
+		total.Add(total, profile(i))
+		prefix[i+1], _ = new(big.Float).SetInt(total).Float64()
+	}
+	if total.Sign() <= 0 {
+		return nil, ErrEmptyProfile
+	}
+	g, err := MergerByID(params.Merger)
+	if err != nil {
+		return nil, err
+	}
+	var rootPayload []byte
+	if g != nil {
+		rootPayload = make([]byte, g.PayloadSize())
+	}
+	e := &estimator{
+		prefix:  prefix,
+		queries: params.requiredQueries(total, leaves),
+		payload: uint64(rlp.ListSize(uint64(len(rootPayload)))),
+	}
+	right, _ := new(big.Float).SetInt(params.RightDifficulty).Float64()
+	if total := prefix[leaves]; right < total {
+		e.logDelta = math.Log(right / total)
+	}
+	e.subtree(0, leaves)
+
+	// The elements but the root are the leaves of a binary tree, whose inner
+	// nodes the verifier rehashes.
+	est := &ProofEstimate{Queries: e.queries, Blocks: e.blocks, Elems: e.elems + 1}
+	est.Hashes = math.Max(0, est.Elems-2)
+
+	// Everything but the elements and the checked blocks has a known size.
+	base, err := rlp.EncodeToBytes(&rlpProofInfo{
+		Version:        ProofVersion,
+		RootDifficulty: total,
+		LeafNumber:     leaves,
+		RootPayload:    rootPayload,
+		Params:         params.toRLP(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	content, _, err := rlp.SplitList(base)
+	if err != nil {
+		return nil, err
+	}
+	root := e.elemSize(prefix[leaves], leaves)
+	elems := uint64(e.size + root)
+	checked := e.queries * uint64(uintSize(leaves-1))
+	payload := uint64(len(content)) - 2 + rlp.ListSize(elems) + rlp.ListSize(checked)
+	est.Size = float64(rlp.ListSize(payload)) - float64(elems) + e.size + root
+	return est, nil
+}
+
+// estimator accumulates the expected contents of a proof over the subtrees
+// of an MMR.
+type estimator struct {
+	prefix   []float64
+	queries  uint64
+	payload  uint64  // encoded size of a node payload
+	logDelta float64 // log(right/total), 0 if all samples hit the first leaf
+
+	blocks, elems, size float64
+}
+
+// sampled returns the probability that one query samples a leaf in [lo, hi).
+func (e *estimator) sampled(lo, hi uint64) float64 {
+	return e.cdf(e.prefix[hi]) - e.cdf(e.prefix[lo])
+}
+
+// cdf returns the probability that one query samples below difficulty x, see
+// sampler.
+func (e *estimator) cdf(x float64) float64 {
+	total := e.prefix[len(e.prefix)-1]
+	if e.logDelta == 0 {
+		if x > 0 {
+			return 1
+		}
+		return 0
+	}
+	if x >= total {
+		return 1
+	}
+	return math.Min(1, math.Log1p(-x/total)/e.logDelta)
+}
+
+// missed returns the probability that no query samples with probability p.
+func (e *estimator) missed(p float64) float64 {
+	if p >= 1 {
+		return 0
+	}
+	return math.Exp(float64(e.queries) * math.Log1p(-p))
+}
+
+// subtree adds the expectations of the subtree of n leaves from leaf lo,
+// provided it is sampled.
+func (e *estimator) subtree(lo, n uint64) {
+	if n == 1 {
+		hit := 1 - e.missed(e.sampled(lo, lo+1))
+		e.blocks += hit
+		e.elems += hit
+		e.size += hit * e.elemSize(e.prefix[lo+1]-e.prefix[lo], 0)
+		return
+	}
+	l := get_left_leaf_number(n)
+	pl, pr := e.sampled(lo, lo+l), e.sampled(lo+l, lo+n)
+	none := e.missed(pl + pr)
+	// A child is a sibling element if only the other one is sampled.
+	if onlyRight := e.missed(pl) - none; onlyRight > 0 {
+		e.elems += onlyRight
+		e.size += onlyRight * e.elemSize(e.prefix[lo+l]-e.prefix[lo], 0)
+	}
+	if onlyLeft := e.missed(pr) - none; onlyLeft > 0 {
+		e.elems += onlyLeft
+		e.size += onlyLeft * e.elemSize(e.prefix[lo+n]-e.prefix[lo+l], 0)
+	}
+	if pl > 0 {
+		e.subtree(lo, l)
+	}
+	if pr > 0 {
+		e.subtree(lo+l, n-l)
+	}
+}
+
+// elemSize returns the encoded size of a proof element for a node of
+// difficulty td, with a payload of the merger of the proof.
+func (e *estimator) elemSize(td float64, leafNum uint64) float64 {
+	res := rlp.ListSize(uint64(len(common.Hash{})+1) + uint64(bigSize(td)) + e.payload)
+	return float64(rlp.ListSize(1 + res + 1 + uint64(uintSize(leafNum))))
+}
+
+// uintSize returns the encoded size of v.
+func uintSize(v uint64) int {
+	if v < 128 {
+		return 1
+	}
+	n := 0
+	for ; v > 0; v >>= 8 {
+		n++
+	}
+	return 1 + n
+}
+
+// bigSize returns the encoded size of the integer closest to v.
+func bigSize(v float64) int {
+	if v < 128 {
+		return 1
+	}
+	_, bits := math.Frexp(v)
+	return 1 + (bits+7)/8
+}
@@ -0,0 +1,77 @@
+package mmr
+
+import (
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/marcopoloprotocol/flyclientDemo/rlp"
+)
+
+func TestEstimateProof(t *testing.T) {
+	rising := func(leaf uint64) *big.Int { return big.NewInt(int64(1000 + leaf)) }
+	tests := []struct {
+		leaves  uint64
+		profile DifficultyProfile
+		merger  Merger
+	}{
+		{1500, ConstantDifficulty(big.NewInt(1000)), nil},
+		{6000, ConstantDifficulty(big.NewInt(1000)), nil},
+		{6000, rising, nil},
+		{6000, ConstantDifficulty(big.NewInt(1000)), TimeRangeMerger},
+	}
+	for i, tt := range tests {
+		params := testParams()
+		params.Merger = mergerID(tt.merger)
+		est, err := EstimateProof(tt.leaves, tt.profile, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Average a few proofs of chains with different roots.
+		const runs = 8
+		var blocks, elems, size float64
+		for run := 0; run < runs; run++ {
+			m := NewMMRWithMerger(SHA3, tt.merger)
+			for j := uint64(0); j < tt.leaves; j++ {
+				h := BytesToHash(IntToBytes(run<<32 | int(j)))
+				if tt.merger == nil {
+					m.Push(NewNode(h, tt.profile(j)))
+				} else {
+					m.Push(NewNodeWithPayload(h, tt.profile(j), TimeRangePayload(j, j)))
+				}
+			}
+			proof, _ := m.CreateNewProof(params)
+			if uint64(len(proof.Checked)) != est.Queries {
+				t.Fatalf("test %d: %d queries, estimated %d", i, len(proof.Checked), est.Queries)
+			}
+			enc, err := rlp.EncodeToBytes(proof)
+			if err != nil {
+				t.Fatal(err)
+			}
+			blocks += float64(len(SortAndRemoveRepeatForBlocks(proof.Checked))) / runs
+			elems += float64(len(proof.Elems)) / runs
+			size += float64(len(enc)) / runs
+		}
+		for _, c := range []struct {
+			name      string
+			have, est float64
+		}{{"blocks", blocks, est.Blocks}, {"elems", elems, est.Elems}, {"size", size, est.Size}} {
+			if math.Abs(c.have-c.est) > 0.05*c.have {
+				t.Errorf("test %d: %s %.1f, estimated %.1f", i, c.name, c.have, c.est)
+			}
+		}
+		if est.Hashes < est.Blocks || est.Hashes > est.Elems {
+			t.Errorf("test %d: implausible hashes %.1f", i, est.Hashes)
+		}
+	}
+	if _, err := EstimateProof(10, ConstantDifficulty(new(big.Int)), testParams()); err != ErrEmptyProfile {
+		t.Fatalf("have %v, want %v", err, ErrEmptyProfile)
+	}
+}
+
+func BenchmarkEstimateProof(b *testing.B) {
+	params := DefaultProofParams()
+	for i := 0; i < b.N; i++ {
+		EstimateProof(1000000, ConstantDifficulty(big.NewInt(1000)), params)
+	}
+}
@@ -0,0 +1,225 @@
+package mmr
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+	bn256 "github.com/marcopoloprotocol/flyclientDemo/crypto/bn256/cloudflare"
+	"github.com/marcopoloprotocol/flyclientDemo/rlp"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+var (
+	ErrUnknownHasher  = errors.New("unknown hash function")
+	ErrHasherMismatch = errors.New("hash function mismatch")
+)
+
+// HasherID identifies the hash function of an MMR. Proofs record it, so that
+// verifiers rehash them with the same function.
+type HasherID uint8
+
+const (
+	HashSHA3      HasherID = iota // SHA3-256, the default
+	HashKeccak256                 // Keccak-256 as used by Ethereum
+	HashBlake2b                   // BLAKE2b-256
+	HashSHA256d                   // SHA-256 applied twice, as used by Bitcoin
+	HashMiMC                      // MiMC-7 over the bn256 scalar field
+)
+
+// Hasher is the hash function of an MMR, chosen when it is created. Merge
+// returns the hash of the parent of two nodes, committing to aggregate, the
+// encoded difficulties and payloads of the two, unless it is nil. Sum returns
+// the hash of arbitrary data such as an encoded block header.
+type Hasher interface {
+	ID() HasherID
+	Sum(data []byte) common.Hash
+	Merge(left, right common.Hash, aggregate []byte) common.Hash
+}
+
+// The built-in hash functions, registered under their IDs.
+var (
+	SHA3      Hasher = &digestHasher{id: HashSHA3, sum: sha3.Sum256}
+	Keccak256 Hasher = &digestHasher{id: HashKeccak256, sum: keccak256}
+	Blake2b   Hasher = &digestHasher{id: HashBlake2b, sum: blake2b.Sum256}
+	SHA256d   Hasher = &digestHasher{id: HashSHA256d, sum: sha256d}
+	MiMC      Hasher = newMiMCHasher()
+)
+
+var (
+	hashersLock sync.RWMutex
+	hashers     = map[HasherID]Hasher{
+		HashSHA3:      SHA3,
+		HashKeccak256: Keccak256,
+		HashBlake2b:   Blake2b,
+		HashSHA256d:   SHA256d,
+		HashMiMC:      MiMC,
+	}
+)
+
+// RegisterHasher makes h available to verifiers under its ID, replacing the
+// hasher registered under it before. Chains with their own hash function
+// register it, typically from an init function.
+func RegisterHasher(h Hasher) {
+	hashersLock.Lock()
+	defer hashersLock.Unlock()
+	hashers[h.ID()] = h
+}
+
+// HasherByID returns the hasher registered under id.
+func HasherByID(id HasherID) (Hasher, error) {
+	hashersLock.RLock()
+	defer hashersLock.RUnlock()
+	h, ok := hashers[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownHasher, id)
+	}
+	return h, nil
+}
+
+// RlpHashWith returns the hash of the RLP encoding of x, like RlpHash does
+// with SHA3.
+func RlpHashWith(h Hasher, x interface{}) common.Hash {
+	enc, _ := rlp.EncodeToBytes(x)
+	return h.Sum(enc)
+}
+
+// digestHasher adapts a byte oriented hash function. The parent of two nodes
+// is the hash of the RLP encoding of the pair of their hashes followed by the
+// aggregate.
+type digestHasher struct {
+	id  HasherID
+	sum func(data []byte) [32]byte
+}
+
+func (h *digestHasher) ID() HasherID {
+	return h.id
+}
+func (h *digestHasher) Sum(data []byte) common.Hash {
+	return h.sum(data)
+}
+
+// Merge writes the encoding of the two hashes directly, it is fixed, rather
+// than through the reflection based rlp encoder.
+func (h *digestHasher) Merge(left, right common.Hash, aggregate []byte) common.Hash {
+	const pairLen = 2 + 2*(1+common.HashLength)
+	var buf [pairLen + 64]byte
+	enc := buf[:pairLen]
+	enc[0], enc[1] = 0xf8, 2*(1+common.HashLength)
+	enc[2], enc[3+common.HashLength] = 0x80+common.HashLength, 0x80+common.HashLength
+	copy(enc[3:], left[:])
+	copy(enc[4+common.HashLength:], right[:])
+	return h.sum(append(enc, aggregate...))
+}
+
+func keccak256(data []byte) (h [32]byte) {
+	hw := sha3.NewLegacyKeccak256()
+	hw.Write(data)
+	hw.Sum(h[:0])
+	return h
+}
+
+func sha256d(data []byte) [32]byte {
+	h := sha256.Sum256(data)
+	return sha256.Sum256(h[:])
+}
+
+// mimcRounds is the number of rounds of MiMC-7 over the bn256 scalar field,
+// enough for x^7 to reach the full field: ceil(254 / log2(7)).
+const mimcRounds = 91
+
+// mimcHasher is MiMC-7 over the scalar field of bn256, which costs a few
+// hundred constraints per hash in a SNARK circuit over that curve instead of
+// tens of thousands for the byte oriented functions. Hashes are field
+// elements in big endian. Inputs are absorbed one field element at a time in
+// Miyaguchi-Preneel mode, h = h + x + E_h(x), starting from h = 0.
+type mimcHasher struct {
+	constants []*big.Int // round constants, the first one is zero
+}
+
+// newMiMCHasher derives the round constants by hashing the seed "mimc"
+// repeatedly with Keccak-256, each reduced into the field.
+func newMiMCHasher() *mimcHasher {
+	h := &mimcHasher{constants: make([]*big.Int, mimcRounds)}
+	h.constants[0] = new(big.Int)
+	seed := keccak256([]byte("mimc"))
+	c := new(big.Int).SetBytes(seed[:])
+	for i := 1; i < mimcRounds; i++ {
+		seed = keccak256(c.Bytes())
+		c.SetBytes(seed[:])
+		h.constants[i] = new(big.Int).Mod(c, bn256.Order)
+	}
+	return h
+}
+
+func (h *mimcHasher) ID() HasherID {
+	return HashMiMC
+}
+
+// encrypt returns E_k(x) = (...((x+k)^7 + k + c_1)^7 ...)^7 + k.
+func (h *mimcHasher) encrypt(x, k *big.Int) *big.Int {
+	var t, t2 big.Int
+	r := new(big.Int)
+	for i, c := range h.constants {
+		if i == 0 {
+			t.Add(x, k)
+		} else {
+			t.Add(r, k)
+			t.Add(&t, c)
+		}
+		t.Mod(&t, bn256.Order)
+		t2.Mul(&t, &t).Mod(&t2, bn256.Order)
+		r.Mul(&t2, &t2).Mod(r, bn256.Order)
+		r.Mul(r, &t2).Mod(r, bn256.Order)
+		r.Mul(r, &t).Mod(r, bn256.Order)
+	}
+	return r.Add(r, k).Mod(r, bn256.Order)
+}
+
+func (h *mimcHasher) hash(elems ...*big.Int) common.Hash {
+	r := new(big.Int)
+	for _, x := range elems {
+		e := h.encrypt(x, r)
+		r.Add(r, x).Add(r, e).Mod(r, bn256.Order)
+	}
+	var out common.Hash
+	r.FillBytes(out[:])
+	return out
+}
+
+// Sum absorbs data as mimcElems does.
+func (h *mimcHasher) Sum(data []byte) common.Hash {
+	return h.hash(mimcElems(nil, data)...)
+}
+
+// Merge absorbs the two hashes as field elements, followed by the aggregate
+// as Sum absorbs data unless it is nil. Hashes made by the hasher are field
+// elements already, other leaf hashes are reduced into the field.
+func (h *mimcHasher) Merge(left, right common.Hash, aggregate []byte) common.Hash {
+	l := new(big.Int).SetBytes(left[:])
+	r := new(big.Int).SetBytes(right[:])
+	elems := []*big.Int{l.Mod(l, bn256.Order), r.Mod(r, bn256.Order)}
+	if aggregate != nil {
+		elems = mimcElems(elems, aggregate)
+	}
+	return h.hash(elems...)
+}
+
+// mimcElems appends the length of data followed by its 31 byte chunks, each
+// of which is below the field modulus, to elems.
+func mimcElems(elems []*big.Int, data []byte) []*big.Int {
+	elems = append(elems, new(big.Int).SetUint64(uint64(len(data))))
+	for len(data) > 0 {
+		n := 31
+		if len(data) < n {
+			n = len(data)
+		}
+		elems = append(elems, new(big.Int).SetBytes(data[:n]))
+		data = data[n:]
+	}
+	return elems
+}
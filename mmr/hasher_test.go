@@ -0,0 +1,190 @@
+package mmr
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+	bn256 "github.com/marcopoloprotocol/flyclientDemo/crypto/bn256/cloudflare"
+	"github.com/marcopoloprotocol/flyclientDemo/diskdb/memorydb"
+	"github.com/marcopoloprotocol/flyclientDemo/rlp"
+)
+
+var testHashers = []Hasher{SHA3, Keccak256, Blake2b, SHA256d, MiMC}
+
+func TestHasherSum(t *testing.T) {
+	tests := []struct {
+		h    Hasher
+		want string
+	}{
+		{SHA3, "0x3a985da74fe225b2045c172d6bd390bd855f086e3e9d525b46bfe24511431532"},
+		{Keccak256, "0x4e03657aea45a94fc7d47ba826c8d667c0d1e6e33a64a036ec44f58fa12d6c45"},
+		{Blake2b, "0xbddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+		{SHA256d, "0x4f8b42c22dd3729b519ba6f68d2da7cc5b2d606d05daed5ad5128cc03e6c6358"},
+	}
+	for _, test := range tests {
+		if have := test.h.Sum([]byte("abc")); have.Hex() != test.want {
+			t.Errorf("hasher %d: have %s, want %s", test.h.ID(), have.Hex(), test.want)
+		}
+	}
+	for _, h := range testHashers {
+		if have, err := HasherByID(h.ID()); err != nil || have != h {
+			t.Errorf("hasher %d not registered: %v", h.ID(), err)
+		}
+	}
+	if _, err := HasherByID(HasherID(200)); !errors.Is(err, ErrUnknownHasher) {
+		t.Fatalf("have %v, want %v", err, ErrUnknownHasher)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		left, right := RlpHash(uint64(i)), RlpHash(uint64(i+1000))
+		for _, h := range []Hasher{SHA3, Keccak256, Blake2b, SHA256d} {
+			if have, want := h.Merge(left, right, nil), RlpHashWith(h, []common.Hash{left, right}); have != want {
+				t.Fatalf("hasher %d: merge = %x, want %x", h.ID(), have, want)
+			}
+		}
+		if have, want := SHA3.Merge(left, right, nil), RlpHash([]common.Hash{left, right}); have != want {
+			t.Fatalf("merge = %x, want %x", have, want)
+		}
+		for _, h := range testHashers {
+			d := encodeAggregate(big.NewInt(int64(i)), big.NewInt(1), nil, nil)
+			if h.Merge(left, right, d) == h.Merge(left, right, nil) {
+				t.Fatalf("hasher %d: merge ignores the aggregate", h.ID())
+			}
+			if h.Merge(left, right, d) == h.Merge(left, right, encodeAggregate(big.NewInt(int64(i)), big.NewInt(2), nil, nil)) {
+				t.Fatalf("hasher %d: merge ignores the difficulty", h.ID())
+			}
+		}
+	}
+}
+
+func TestMiMC(t *testing.T) {
+	left, right := RlpHash(uint64(1)), RlpHash(uint64(2))
+	h := MiMC.Merge(left, right, nil)
+	if h.Big().Cmp(bn256.Order) >= 0 {
+		t.Fatalf("%x is not a field element", h)
+	}
+	if h == MiMC.Merge(right, left, nil) {
+		t.Fatal("merge is symmetric")
+	}
+	// Hashes are taken modulo the field order.
+	small := common.BigToHash(big.NewInt(5))
+	wrapped := common.BigToHash(new(big.Int).Add(small.Big(), bn256.Order))
+	if MiMC.Merge(wrapped, right, nil) != MiMC.Merge(small, right, nil) {
+		t.Fatal("merge does not reduce into the field")
+	}
+	// The length is absorbed, so trailing zero bytes change the hash.
+	if MiMC.Sum([]byte{1}) == MiMC.Sum([]byte{1, 0}) || MiMC.Sum(nil) == MiMC.Sum([]byte{0}) {
+		t.Fatal("sum ignores the length")
+	}
+	// Pins the round constants and the mode.
+	want := "0x06d4571fb9634e4bed32e265f91a373a852c476656c5c13b09bc133ac61bc5a6"
+	if have := MiMC.Merge(common.Hash{}, common.Hash{}, nil).Hex(); have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+}
+
+func TestHasherProofs(t *testing.T) {
+	roots := make(map[common.Hash]bool)
+	for _, h := range testHashers {
+		m := NewMMRWithHasher(h)
+		for i := 0; i < 300; i++ {
+			m.Push(testLeaf(i))
+		}
+		if roots[m.GetRoot()] {
+			t.Fatalf("hasher %d: root of another hasher", h.ID())
+		}
+		roots[m.GetRoot()] = true
+		if have := m.BagPeaks(m.PeaksAt(300)); have.GetHash() != m.GetRoot() {
+			t.Fatalf("hasher %d: bagged peaks differ from the root", h.ID())
+		}
+
+		params := testParams()
+		params.RightDifficulty = big.NewInt(10000)
+		proof, _ := m.CreateNewProof(params)
+		if proof.Hasher != h.ID() || proof.Params.Hasher != h.ID() {
+			t.Fatalf("hasher %d: proof records %d", h.ID(), proof.Hasher)
+		}
+		enc, err := rlp.EncodeToBytes(proof)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec := new(ProofInfo)
+		if err := rlp.DecodeBytes(enc, dec); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := VerifyRequiredBlocks(dec, params); h != SHA3 && !errors.Is(err, ErrHasherMismatch) {
+			t.Fatalf("hasher %d: have %v, want %v", h.ID(), err, ErrHasherMismatch)
+		}
+		params.Hasher = h.ID()
+		pBlocks, err := VerifyRequiredBlocks(dec, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !dec.VerifyProof(pBlocks, nil) {
+			t.Fatalf("hasher %d: proof rejected", h.ID())
+		}
+		if _, err := dec.Leaves(); err != nil {
+			t.Fatalf("hasher %d: %v", h.ID(), err)
+		}
+
+		// Rehashing with another function does not reach the root.
+		other := HashSHA3
+		if h == SHA3 {
+			other = HashKeccak256
+		}
+		dec.Hasher, dec.Params = other, nil
+		if _, err := dec.Tree(); !errors.Is(err, ErrProofRootDiffer) {
+			t.Fatalf("hasher %d: have %v, want %v", h.ID(), err, ErrProofRootDiffer)
+		}
+
+		incl, err := m.ProveLeaves([]uint64{3, 150, 299})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes := []common.Hash{testLeaf(3).getHash(), testLeaf(150).getHash(), testLeaf(299).getHash()}
+		if err := incl.Verify(m.GetRoot(), 300, hashes); err != nil {
+			t.Fatalf("hasher %d: %v", h.ID(), err)
+		}
+		cons, err := m.ProveConsistency(100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old := m.BagPeaks(m.PeaksAt(100))
+		from := &Root{Hash: old.GetHash(), Difficulty: old.GetDifficulty(), LeafNumber: 100}
+		to := &Root{Hash: m.GetRoot(), Difficulty: m.GetRootDifficulty(), LeafNumber: 300}
+		if err := cons.Verify(from, to); err != nil {
+			t.Fatalf("hasher %d: %v", h.ID(), err)
+		}
+	}
+}
+
+func TestOpenMMRWithHasher(t *testing.T) {
+	db := memorydb.New()
+	m, err := OpenMMRWithHasher(db, nil, Blake2b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := NewMMRWithHasher(Blake2b)
+	for i := 0; i < 100; i++ {
+		m.Push(testLeaf(i))
+		want.Push(testLeaf(i))
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenMMR(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Hasher() != Blake2b {
+		t.Fatalf("reopened with hasher %d", reopened.Hasher().ID())
+	}
+	checkSameMmr(t, want, reopened)
+	if _, err := OpenMMRWithHasher(db, nil, Keccak256); !errors.Is(err, ErrHasherMismatch) {
+		t.Fatalf("have %v, want %v", err, ErrHasherMismatch)
+	}
+}
@@ -0,0 +1,96 @@
+package mmr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+)
+
+var (
+	ErrNoHeaderDecoder = errors.New("no header decoder given")
+	ErrHeaderLeaf      = errors.New("sampled header does not match its leaf")
+	ErrHeaderMRoot     = errors.New("sampled header does not commit to the preceding mmr")
+)
+
+// SampledHeader holds the fields of a block header the proof verifier checks
+// against the MMR: the header must hash to its leaf, carry the leaf's
+// difficulty and payload, and commit in MRoot to the MMR over all blocks
+// before it.
+type SampledHeader struct {
+	Hash       common.Hash
+	Difficulty *big.Int
+	Payload    []byte // leaf payload for the chain's merger, nil without one
+	MRoot      common.Hash
+}
+
+// HeaderDecoder decodes a header carried in ProofInfo.Headers, hashing it
+// with h, the hash function of the proven MMR. The mmr package does not know
+// the block format, so the chain passes its decoder to the verifying methods.
+type HeaderDecoder func(raw []byte, h Hasher) (*SampledHeader, error)
+
+// VerifyHeaders checks the headers carried by the proof, one per checked
+// block in ascending order, against the proven MMR. Each header has to be the
+// leaf it is sampled as, and its MRoot has to be the root of the MMR over all
+// leaves before it, recomputed from the proof. This ties every sampled block
+// to the history the prover claims, the core of the FlyClient argument. The
+// headers are decoded with dec.
+func (p *ProofInfo) VerifyHeaders(dec HeaderDecoder) error {
+	_, err := p.verifyHeaders(dec)
+	return err
+}
+
+// CheckHeaders verifies the headers carried by the proof like VerifyHeaders,
+// then runs check on each of them with the leaf it is sampled as. Errors of
+// check are returned as is.
+func (p *ProofInfo) CheckHeaders(dec HeaderDecoder, check HeaderCheck) error {
+	leaves, err := p.verifyHeaders(dec)
+	if err != nil {
+		return err
+	}
+	return checkHeaders(p, leaves, check)
+}
+
+// verifyHeaders implements VerifyHeaders, returning the checked leaves.
+func (p *ProofInfo) verifyHeaders(dec HeaderDecoder) ([]*ProofLeaf, error) {
+	leaves, err := p.Leaves()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.checkLeaves(leaves, dec); err != nil {
+		return nil, err
+	}
+	return leaves, nil
+}
+
+// checkLeaves checks the headers carried by the proof against leaves, the
+// checked leaves of its proven tree, decoding them with dec.
+func (p *ProofInfo) checkLeaves(leaves []*ProofLeaf, dec HeaderDecoder) error {
+	if len(p.Headers) != len(leaves) {
+		return fmt.Errorf("%w: %d headers for %d checked blocks", ErrProofMalformed, len(p.Headers), len(leaves))
+	}
+	if dec == nil {
+		return ErrNoHeaderDecoder
+	}
+	hasher, err := HasherByID(p.Hasher)
+	if err != nil {
+		return err
+	}
+	for i, leaf := range leaves {
+		h, err := dec(p.Headers[i], hasher)
+		if err != nil {
+			return fmt.Errorf("header of block %d: %w", leaf.Number, err)
+		}
+		if h.Hash != leaf.Hash || h.Difficulty == nil || h.Difficulty.Cmp(leaf.Difficulty) != 0 ||
+			!bytes.Equal(h.Payload, leaf.Payload) {
+			return fmt.Errorf("%w: block %d", ErrHeaderLeaf, leaf.Number)
+		}
+		// The first leaf is the genesis block, which has no history.
+		if leaf.Number > 0 && h.MRoot != leaf.PrefixRoot {
+			return fmt.Errorf("%w: block %d has %s, want %s", ErrHeaderMRoot, leaf.Number, h.MRoot, leaf.PrefixRoot)
+		}
+	}
+	return nil
+}
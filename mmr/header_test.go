@@ -0,0 +1,107 @@
+package mmr
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+	"github.com/marcopoloprotocol/flyclientDemo/rlp"
+)
+
+// testHeader is a minimal block header committing to the MMR before it.
+type testHeader struct {
+	Number     uint64
+	Difficulty *big.Int
+	MRoot      common.Hash
+	Unsealed   bool // set by provers forging blocks without the work behind them
+}
+
+func decodeTestHeader(raw []byte, hasher Hasher) (*SampledHeader, error) {
+	h := new(testHeader)
+	if err := rlp.DecodeBytes(raw, h); err != nil {
+		return nil, err
+	}
+	return &SampledHeader{Hash: RlpHashWith(hasher, h), Difficulty: h.Difficulty, MRoot: h.MRoot}, nil
+}
+
+// newHeaderChain builds an MMR over count test headers and a proof carrying
+// the sampled ones.
+func newHeaderChain(t *testing.T, count int, forge uint64) *ProofInfo {
+	m := NewMMR()
+	headers := make([][]byte, count)
+	for i := 0; i < count; i++ {
+		h := &testHeader{Number: uint64(i), Difficulty: big.NewInt(1000)}
+		if i > 0 {
+			h.MRoot = m.GetRoot()
+		}
+		if i > 0 && uint64(i) == forge {
+			h.MRoot[0]++
+		}
+		headers[i], _ = rlp.EncodeToBytes(h)
+		m.Push(NewNode(RlpHash(h), h.Difficulty))
+	}
+	proof, _ := m.CreateNewProof(testParams())
+	for _, n := range SortAndRemoveRepeatForBlocks(append([]uint64{}, proof.Checked...)) {
+		proof.Headers = append(proof.Headers, headers[n])
+	}
+	return proof
+}
+
+func TestVerifyHeaders(t *testing.T) {
+	proof := newHeaderChain(t, 1200, 0)
+	if err := proof.VerifyHeaders(decodeTestHeader); err != nil {
+		t.Fatal(err)
+	}
+	pBlocks, err := VerifyRequiredBlocks(proof, testParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proof.VerifyProof(pBlocks, decodeTestHeader) {
+		t.Fatal("valid proof rejected")
+	}
+
+	// A sampled header committing to a different history fails the proof.
+	checked := SortAndRemoveRepeatForBlocks(append([]uint64{}, proof.Checked...))
+	forged := newHeaderChain(t, 1200, checked[len(checked)-1])
+	if err := forged.VerifyHeaders(decodeTestHeader); !errors.Is(err, ErrHeaderMRoot) {
+		t.Fatalf("forged MRoot: have %v, want %v", err, ErrHeaderMRoot)
+	}
+	if forged.VerifyProof(pBlocks, decodeTestHeader) {
+		t.Fatal("proof with forged MRoot accepted")
+	}
+
+	// VerifyProofHeaders says why and returns the leaves of the headers.
+	leaves, err := proof.VerifyProofHeaders(pBlocks, decodeTestHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, leaf := range leaves {
+		if leaf.Number != checked[i] {
+			t.Fatalf("leaf %d: have block %d, want %d", i, leaf.Number, checked[i])
+		}
+	}
+	fBlocks, err := VerifyRequiredBlocks(forged, testParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := forged.VerifyProofHeaders(fBlocks, decodeTestHeader); !errors.Is(err, ErrHeaderMRoot) {
+		t.Fatalf("forged MRoot: have %v, want %v", err, ErrHeaderMRoot)
+	}
+	moved := append([]*ProofBlock{}, pBlocks...)
+	moved[0] = &ProofBlock{Number: moved[0].Number, AggrWeight: new(big.Int).Set(proof.RootDifficulty)}
+	if _, err := proof.VerifyProofHeaders(moved, decodeTestHeader); !errors.Is(err, ErrWeightNotCovered) {
+		t.Fatalf("moved sample: have %v, want %v", err, ErrWeightNotCovered)
+	}
+
+	// Headers out of order do not match their leaves.
+	swapped := newHeaderChain(t, 1200, 0)
+	swapped.Headers[1], swapped.Headers[2] = swapped.Headers[2], swapped.Headers[1]
+	if err := swapped.VerifyHeaders(decodeTestHeader); !errors.Is(err, ErrHeaderLeaf) {
+		t.Fatalf("swapped headers: have %v, want %v", err, ErrHeaderLeaf)
+	}
+
+	if err := proof.VerifyHeaders(nil); err != ErrNoHeaderDecoder {
+		t.Fatalf("no decoder: have %v, want %v", err, ErrNoHeaderDecoder)
+	}
+}
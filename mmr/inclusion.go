@@ -0,0 +1,203 @@
+package mmr
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+)
+
+var (
+	ErrLeafRange       = errors.New("leaf out of range")
+	ErrLeafNotIncluded = errors.New("leaves are not included in the mmr")
+)
+
+// InclusionProof proves that a set of leaves is part of an MMR. Subtrees
+// shared by the proven leaves are recomputed by the verifier rather than sent,
+// so proving many leaves at once is cheaper than proving them one by one.
+type InclusionProof struct {
+	Hasher   HasherID    // hash function of the mmr
+	Merger   MergerID    // payload schema of the mmr
+	Leaves   []uint64    // proven leaves, sorted and without duplicates
+	Siblings []ProofNode // roots of the subtrees holding no proven leaf, depth first
+	// LeafDifficulties and LeafPayloads hold the difficulties and payloads of
+	// the leaves, in the same order. LeafPayloads is empty without a merger.
+	LeafDifficulties []*big.Int
+	LeafPayloads     [][]byte
+}
+
+// ProveLeaves creates an inclusion proof for the given leaves.
+func (m *Mmr) ProveLeaves(indices []uint64) (*InclusionProof, error) {
+	m = m.Snapshot()
+	leaves := SortAndRemoveRepeatForBlocks(append([]uint64{}, indices...))
+	if len(leaves) == 0 {
+		return nil, fmt.Errorf("%w: no leaves", ErrLeafRange)
+	}
+	if last := leaves[len(leaves)-1]; last >= m.getLeafNumber() {
+		return nil, fmt.Errorf("%w: %d of %d", ErrLeafRange, last, m.getLeafNumber())
+	}
+	p := &InclusionProof{Hasher: m.hasher.ID(), Merger: mergerID(m.merger), Leaves: leaves}
+	for _, n := range leaves {
+		leaf := m.getNode(GetNodeFromLeaf(n))
+		p.LeafDifficulties = append(p.LeafDifficulties, leaf.getDifficulty())
+		if m.merger != nil {
+			p.LeafPayloads = append(p.LeafPayloads, leaf.getPayload())
+		}
+	}
+	m.proveSubtree(0, m.getLeafNumber(), 0, leaves, p)
+	return p, nil
+}
+
+// proveSubtree adds the siblings of the subtree with n leaves starting at
+// leaf lo, whose nodes start at position off.
+func (m *Mmr) proveSubtree(off, n, lo uint64, leaves []uint64, p *InclusionProof) {
+	if n == 1 {
+		return
+	}
+	left_leaf_number := get_left_leaf_number(n)
+	split := 0
+	for split < len(leaves) && leaves[split] < lo+left_leaf_number {
+		split++
+	}
+	right_off := off + leaf_to_node_number(left_leaf_number)
+	if split > 0 {
+		m.proveSubtree(off, left_leaf_number, lo, leaves[:split], p)
+	} else {
+		p.Siblings = append(p.Siblings, newProofNode(m.getNode(right_off-1)))
+	}
+	if split < len(leaves) {
+		m.proveSubtree(right_off, n-left_leaf_number, lo+left_leaf_number, leaves[split:], p)
+	} else {
+		p.Siblings = append(p.Siblings, newProofNode(m.getNode(off+leaf_to_node_number(n)-2)))
+	}
+}
+
+// Verify checks that the leaves of the proof, with the given hashes, are part
+// of the MMR with the given root and leaf count. It needs no other state. Node
+// hashes do not commit to the leaf count, it only fixes the shape of the tree
+// the siblings are folded into. They do commit to difficulties and payloads,
+// so on success LeafDifficulties and LeafPayloads are those of the leaves.
+func (p *InclusionProof) Verify(root common.Hash, leafNumber uint64, hashes []common.Hash) error {
+	if len(p.Leaves) == 0 || len(hashes) != len(p.Leaves) {
+		return fmt.Errorf("%w: %d hashes for %d leaves", ErrProofMalformed, len(hashes), len(p.Leaves))
+	}
+	for i, n := range p.Leaves {
+		if n >= leafNumber {
+			return fmt.Errorf("%w: %d of %d", ErrLeafRange, n, leafNumber)
+		}
+		if i > 0 && n <= p.Leaves[i-1] {
+			return fmt.Errorf("%w: leaves not sorted", ErrProofMalformed)
+		}
+	}
+	h, err := HasherByID(p.Hasher)
+	if err != nil {
+		return err
+	}
+	g, err := MergerByID(p.Merger)
+	if err != nil {
+		return err
+	}
+	if len(p.LeafDifficulties) != len(p.Leaves) {
+		return fmt.Errorf("%w: %d difficulties for %d leaves", ErrProofMalformed, len(p.LeafDifficulties), len(p.Leaves))
+	}
+	leaves := make([]*proofRes, len(p.Leaves))
+	for i := range leaves {
+		if d := p.LeafDifficulties[i]; d == nil || d.Sign() < 0 {
+			return fmt.Errorf("%w: leaf %d has no difficulty", ErrProofMalformed, i)
+		}
+		leaves[i] = &proofRes{h: hashes[i], td: p.LeafDifficulties[i]}
+	}
+	if g == nil {
+		if len(p.LeafPayloads) != 0 {
+			return fmt.Errorf("%w: leaf payloads without a merger", ErrProofMalformed)
+		}
+	} else {
+		if len(p.LeafPayloads) != len(p.Leaves) {
+			return fmt.Errorf("%w: %d payloads for %d leaves", ErrProofMalformed, len(p.LeafPayloads), len(p.Leaves))
+		}
+		for i := range leaves {
+			leaves[i].payload = p.LeafPayloads[i]
+		}
+	}
+	for i, n := range append(append([]*proofRes{}, leaves...), siblingRes(p.Siblings)...) {
+		if n.td == nil || n.td.Sign() < 0 {
+			return fmt.Errorf("%w: node %d has no difficulty", ErrProofMalformed, i)
+		}
+		if err := checkPayload(g, n.payload); err != nil {
+			return fmt.Errorf("node %d: %w", i, err)
+		}
+	}
+	v := &inclusionVerifier{hasher: h, merger: g, leaves: leaves, siblings: p.Siblings}
+	got, err := v.subtree(leafNumber, 0, p.Leaves)
+	if err != nil {
+		return err
+	}
+	if len(v.siblings) != 0 {
+		return fmt.Errorf("%w: %d trailing siblings", ErrProofShape, len(v.siblings))
+	}
+	if !equal_hash(got.h, root) {
+		return ErrLeafNotIncluded
+	}
+	return nil
+}
+
+func siblingRes(siblings []ProofNode) []*proofRes {
+	res := make([]*proofRes, len(siblings))
+	for i := range siblings {
+		res[i] = siblings[i].res()
+	}
+	return res
+}
+
+// inclusionVerifier consumes the leaves and siblings of an inclusion proof in
+// the order ProveLeaves wrote them.
+type inclusionVerifier struct {
+	hasher   Hasher
+	merger   Merger
+	leaves   []*proofRes
+	siblings []ProofNode
+}
+
+func (v *inclusionVerifier) subtree(n, lo uint64, leaves []uint64) (*proofRes, error) {
+	if n == 1 {
+		leaf := v.leaves[0]
+		v.leaves = v.leaves[1:]
+		return leaf, nil
+	}
+	left_leaf_number := get_left_leaf_number(n)
+	split := 0
+	for split < len(leaves) && leaves[split] < lo+left_leaf_number {
+		split++
+	}
+	var (
+		left, right *proofRes
+		err         error
+	)
+	if split > 0 {
+		left, err = v.subtree(left_leaf_number, lo, leaves[:split])
+	} else {
+		left, err = v.sibling()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if split < len(leaves) {
+		right, err = v.subtree(n-left_leaf_number, lo+left_leaf_number, leaves[split:])
+	} else {
+		right, err = v.sibling()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return mergeRes(v.hasher, v.merger, left, right), nil
+}
+
+func (v *inclusionVerifier) sibling() (*proofRes, error) {
+	if len(v.siblings) == 0 {
+		return nil, fmt.Errorf("%w: too few siblings", ErrProofShape)
+	}
+	s := v.siblings[0]
+	v.siblings = v.siblings[1:]
+	return s.res(), nil
+}
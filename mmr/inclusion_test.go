@@ -0,0 +1,82 @@
+package mmr
+
+import (
+	"errors"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+)
+
+func leafHashes(leaves []uint64) []common.Hash {
+	hashes := make([]common.Hash, len(leaves))
+	for i, n := range leaves {
+		hashes[i] = testLeaf(int(n)).GetHash()
+	}
+	return hashes
+}
+
+func TestProveLeaves(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for _, count := range []int{1, 2, 3, 7, 100, 1023, 1024, 1025, 3000} {
+		m := NewMMR()
+		for i := 0; i < count; i++ {
+			m.Push(testLeaf(i))
+		}
+		for k := 0; k < 10; k++ {
+			var indices []uint64
+			for i := rnd.Intn(20); i >= 0; i-- {
+				indices = append(indices, uint64(rnd.Intn(count)))
+			}
+			p, err := m.ProveLeaves(indices)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Verify(m.GetRoot(), uint64(count), leafHashes(p.Leaves)); err != nil {
+				t.Fatalf("%d leaves, proving %v: %v", count, p.Leaves, err)
+			}
+			// A wrong leaf hash fails verification.
+			hashes := leafHashes(p.Leaves)
+			hashes[len(hashes)-1][0]++
+			if err := p.Verify(m.GetRoot(), uint64(count), hashes); !errors.Is(err, ErrLeafNotIncluded) {
+				t.Fatalf("%d leaves: tampered hash: have %v, want %v", count, err, ErrLeafNotIncluded)
+			}
+			// So does a wrong leaf difficulty, unless the leaf is the root.
+			p.LeafDifficulties[0] = new(big.Int).Add(p.LeafDifficulties[0], big.NewInt(1))
+			if err := p.Verify(m.GetRoot(), uint64(count), leafHashes(p.Leaves)); count > 1 && !errors.Is(err, ErrLeafNotIncluded) {
+				t.Fatalf("%d leaves: tampered difficulty: have %v, want %v", count, err, ErrLeafNotIncluded)
+			}
+			if err := p.Verify(m.GetRoot(), p.Leaves[len(p.Leaves)-1], leafHashes(p.Leaves)); !errors.Is(err, ErrLeafRange) {
+				t.Fatalf("%d leaves: too small leaf count: have %v, want %v", count, err, ErrLeafRange)
+			}
+		}
+	}
+}
+
+func TestProveLeavesShared(t *testing.T) {
+	m := NewMMR()
+	for i := 0; i < 4096; i++ {
+		m.Push(testLeaf(i))
+	}
+	var indices []uint64
+	separate := 0
+	for i := uint64(2000); i < 2064; i++ {
+		indices = append(indices, i)
+		p, _ := m.ProveLeaves([]uint64{i})
+		separate += len(p.Siblings)
+	}
+	p, err := m.ProveLeaves(indices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Verify(m.GetRoot(), 4096, leafHashes(p.Leaves)); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Siblings) >= separate/10 {
+		t.Fatalf("batched proof has %d siblings, separate proofs %d", len(p.Siblings), separate)
+	}
+	if _, err := m.ProveLeaves([]uint64{4096}); !errors.Is(err, ErrLeafRange) {
+		t.Fatalf("out of range leaf: have %v, want %v", err, ErrLeafRange)
+	}
+}
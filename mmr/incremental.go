@@ -0,0 +1,160 @@
+package mmr
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+var (
+	ErrNothingNew        = errors.New("no leaves after the trusted mmr")
+	ErrWeightNotCovered  = errors.New("sampled difficulty not covered by the proof")
+	ErrTrustedLeafNumber = errors.New("proof does not start at the trusted mmr")
+	ErrStaleCheckpoint   = errors.New("trusted mmr is older than the kept checkpoints")
+)
+
+// IncrementalProof brings a verifier trusting the MMR of the first Trusted
+// leaves up to date. Only the new leaves are sampled, the consistency link
+// shows the trusted MMR is a prefix of the new one.
+type IncrementalProof struct {
+	Trusted uint64            // leaf count of the trusted MMR
+	Proof   *ProofInfo        // proof of the new MMR, sampling leaves from Trusted on
+	Link    *ConsistencyProof // links the trusted MMR to the one of Proof
+}
+
+// CreateIncrementalProof creates a proof for a verifier which already trusts
+// the MMR of the first trusted leaves of m. The sampled range and so the proof
+// shrink with the work added since. Verifiers trusting an MMR older than the
+// last params.MaxCheckpoints sync points get ErrStaleCheckpoint and have to
+// catch up with a full proof.
+func (m *Mmr) CreateIncrementalProof(params *ProofParams, trusted uint64) (*IncrementalProof, error) {
+	m = m.Snapshot()
+	if trusted >= m.getLeafNumber() {
+		return nil, fmt.Errorf("%w: trusted %d of %d", ErrNothingNew, trusted, m.getLeafNumber())
+	}
+	if cps := params.checkpoints(m.getLeafNumber()); len(cps) > 0 && trusted < cps[len(cps)-1] {
+		return nil, fmt.Errorf("%w: trusted %d, oldest checkpoint %d", ErrStaleCheckpoint, trusted, cps[len(cps)-1])
+	}
+	link, err := m.ProveConsistency(trusted)
+	if err != nil {
+		return nil, err
+	}
+	params = params.Copy()
+	params.Hasher, params.Merger = m.hasher.ID(), mergerID(m.merger)
+	old := m.BagPeaks(m.peaksAt(trusted))
+	from := &Root{Hash: old.getHash(), Difficulty: old.getDifficulty(), LeafNumber: trusted}
+	to := &Root{Hash: m.GetRoot(), Difficulty: m.GetRootDifficulty(), LeafNumber: m.getLeafNumber()}
+	work := new(big.Int).Sub(to.Difficulty, from.Difficulty)
+	t := incrementalTranscript(from, to, params)
+	weights := sampleRange(t, from.Difficulty, work, to.LeafNumber-trusted, params)
+	proof := m.ProveBlocks(m.BlocksByWeight(weights))
+	proof.Params = params
+	return &IncrementalProof{Trusted: trusted, Proof: proof, Link: link}, nil
+}
+
+// Verify checks the proof against the MMR the verifier trusts. The proof must
+// have been made with parameters at least as strong as required. If it
+// carries the sampled headers they are decoded with dec and verified too, see
+// VerifyHeaders.
+func (p *IncrementalProof) Verify(trusted *Root, required *ProofParams, dec HeaderDecoder) error {
+	_, err := p.VerifyHeaders(trusted, required, dec)
+	return err
+}
+
+// VerifyHeaders is like Verify, but returns the leaves the headers of the
+// proof are sampled as, in the order of the headers, so they can be checked
+// further without rebuilding the proven tree. The leaves are nil if the proof
+// carries no headers.
+func (p *IncrementalProof) VerifyHeaders(trusted *Root, required *ProofParams, dec HeaderDecoder) ([]*ProofLeaf, error) {
+	if p.Proof == nil || p.Link == nil {
+		return nil, fmt.Errorf("%w: incomplete incremental proof", ErrProofMalformed)
+	}
+	params := p.Proof.Params
+	if params == nil {
+		return nil, ErrMissingParams
+	}
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	if err := params.Covers(required); err != nil {
+		return nil, err
+	}
+	if p.Link.Hasher != p.Proof.Hasher {
+		return nil, fmt.Errorf("%w: link hashed with %d, proof with %d", ErrHasherMismatch, p.Link.Hasher, p.Proof.Hasher)
+	}
+	if p.Link.Merger != p.Proof.Merger {
+		return nil, fmt.Errorf("%w: link merged with %d, proof with %d", ErrMergerMismatch, p.Link.Merger, p.Proof.Merger)
+	}
+	if p.Trusted != trusted.LeafNumber {
+		return nil, fmt.Errorf("%w: have %d, want %d", ErrTrustedLeafNumber, p.Trusted, trusted.LeafNumber)
+	}
+	if p.Proof.LeafNumber <= trusted.LeafNumber {
+		return nil, ErrNothingNew
+	}
+	to := &Root{Hash: p.Proof.RootHash, Difficulty: p.Proof.RootDifficulty, LeafNumber: p.Proof.LeafNumber}
+	if err := p.Link.Verify(trusted, to); err != nil {
+		return nil, err
+	}
+	work := new(big.Int).Sub(to.Difficulty, trusted.Difficulty)
+	if work.Sign() <= 0 {
+		return nil, ErrNothingNew
+	}
+	leaves, err := p.Proof.Leaves()
+	if err != nil {
+		return nil, err
+	}
+	t := incrementalTranscript(trusted, to, params)
+	weights := sampleRange(t, trusted.Difficulty, work, to.LeafNumber-trusted.LeafNumber, params)
+	if err := coverWeights(leaves, weights, trusted.LeafNumber); err != nil {
+		return nil, err
+	}
+	if p.Proof.Headers == nil {
+		return nil, nil
+	}
+	if err := p.Proof.checkLeaves(leaves, dec); err != nil {
+		return nil, err
+	}
+	return leaves, nil
+}
+
+// incrementalTranscript returns the transcript of an incremental proof
+// extending from to to.
+func incrementalTranscript(from, to *Root, params *ProofParams) *Transcript {
+	t := NewTranscript(incrementalDomain)
+	t.AbsorbRoot("trusted", from)
+	t.AbsorbRoot("root", to)
+	t.AbsorbParams(params)
+	return t
+}
+
+// sampleRange draws the aggregated difficulties to sample from the leaves
+// holding the work difficulty after start, leaves of them in total. Like in
+// CreateNewProof recent blocks are sampled more often, and the number of
+// samples follows from the security parameters.
+func sampleRange(t *Transcript, start, work *big.Int, leaves uint64, params *ProofParams) []*big.Int {
+	s := newSampler(work, params.RightDifficulty)
+	queries := params.requiredQueries(work, leaves)
+
+	weights := make([]*big.Int, 0, queries)
+	for i := uint64(0); i < queries; i++ {
+		w := s.sample(t.Squeeze(i))
+		weights = append(weights, w.Add(w, start))
+	}
+	sort.Slice(weights, func(i, j int) bool { return weights[i].Cmp(weights[j]) < 0 })
+	return weights
+}
+
+// coverWeights checks that every weight falls into one of the proven leaves,
+// all of which must be at or after leaf first.
+func coverWeights(leaves []*ProofLeaf, weights []*big.Int, first uint64) error {
+	for _, w := range weights {
+		i := sort.Search(len(leaves), func(i int) bool {
+			return new(big.Int).Add(leaves[i].PrefixDifficulty, leaves[i].Difficulty).Cmp(w) > 0
+		})
+		if i == len(leaves) || leaves[i].PrefixDifficulty.Cmp(w) > 0 || leaves[i].Number < first {
+			return fmt.Errorf("%w: %v", ErrWeightNotCovered, w)
+		}
+	}
+	return nil
+}
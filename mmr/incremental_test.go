@@ -0,0 +1,67 @@
+package mmr
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIncrementalProof(t *testing.T) {
+	chain := new(testChain).extend(20000, 1000, 1)
+	m := chain.m
+	trusted := rootOf(m, 19000)
+	p, err := m.CreateIncrementalProof(testParams(), trusted.LeafNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.withHeaders(p.Proof)
+	if err := p.Verify(trusted, testParams(), decodeTestHeader); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range p.Proof.Checked {
+		if n < trusted.LeafNumber {
+			t.Fatalf("sampled trusted leaf %d", n)
+		}
+	}
+	full, _ := m.CreateNewProof(testParams())
+	if len(p.Proof.Elems) >= len(full.Elems) {
+		t.Fatalf("incremental proof has %d elements, full proof %d", len(p.Proof.Elems), len(full.Elems))
+	}
+
+	required := testParams()
+	required.Lambda++
+	if err := p.Verify(trusted, required, decodeTestHeader); !errors.Is(err, ErrWeakParams) {
+		t.Fatalf("stronger requirements: have %v, want %v", err, ErrWeakParams)
+	}
+
+	// The proof is only good for the trusted MMR it was made for.
+	if err := p.Verify(rootOf(m, 18000), testParams(), decodeTestHeader); !errors.Is(err, ErrTrustedLeafNumber) {
+		t.Fatalf("other trusted mmr: have %v, want %v", err, ErrTrustedLeafNumber)
+	}
+	forked := *trusted
+	forked.Hash[0]++
+	if err := p.Verify(&forked, testParams(), decodeTestHeader); !errors.Is(err, ErrInconsistent) {
+		t.Fatalf("forked trusted mmr: have %v, want %v", err, ErrInconsistent)
+	}
+
+	// Samples moved into the trusted range do not cover the new work.
+	moved := chain.withHeaders(m.ProveBlocks([]uint64{0, 1, 2}))
+	moved.Params = p.Proof.Params
+	bad := &IncrementalProof{Trusted: p.Trusted, Proof: moved, Link: p.Link}
+	if err := bad.Verify(trusted, testParams(), decodeTestHeader); !errors.Is(err, ErrWeightNotCovered) {
+		t.Fatalf("moved samples: have %v, want %v", err, ErrWeightNotCovered)
+	}
+
+	if _, err := m.CreateIncrementalProof(testParams(), m.GetLeafNumber()); !errors.Is(err, ErrNothingNew) {
+		t.Fatalf("up to date verifier: have %v, want %v", err, ErrNothingNew)
+	}
+
+	// Verifiers behind the kept checkpoints need a full proof.
+	params := testParams()
+	params.CheckpointInterval, params.MaxCheckpoints = 1000, 5
+	if _, err := m.CreateIncrementalProof(params, 15000); err != nil {
+		t.Fatalf("trusted oldest checkpoint: %v", err)
+	}
+	if _, err := m.CreateIncrementalProof(params, 14999); !errors.Is(err, ErrStaleCheckpoint) {
+		t.Fatalf("stale verifier: have %v, want %v", err, ErrStaleCheckpoint)
+	}
+}
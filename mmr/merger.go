@@ -0,0 +1,176 @@
+package mmr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+)
+
+var (
+	ErrUnknownMerger  = errors.New("unknown payload merger")
+	ErrMergerMismatch = errors.New("payload merger mismatch")
+	ErrPayload        = errors.New("invalid node payload")
+)
+
+// MergerID identifies the payload schema of an MMR. Proofs record it, so that
+// verifiers aggregate the payloads the same way.
+type MergerID uint8
+
+const (
+	NoMerger  MergerID = iota // nodes carry no payload, the default
+	TimeRange                 // minimum and maximum timestamp, see TimeRangeMerger
+)
+
+// Merger defines an aggregate committed by the nodes of an MMR besides their
+// difficulty. Every leaf carries a payload, e.g. the timestamp of its block,
+// and every inner node the payload Merge computes from its children. The hash
+// of an inner node commits to the difficulties and payloads of both children,
+// so proofs bind the aggregates of the subtrees they reveal.
+type Merger interface {
+	ID() MergerID
+	// Merge returns the payload of the parent of two nodes.
+	Merge(left, right []byte) []byte
+	// Validate checks a payload received in a proof.
+	Validate(payload []byte) error
+	// PayloadSize returns the length of the payloads, used to estimate the
+	// size of proofs.
+	PayloadSize() int
+}
+
+var (
+	mergersLock sync.RWMutex
+	mergers     = map[MergerID]Merger{
+		TimeRange: TimeRangeMerger,
+	}
+)
+
+// RegisterMerger makes g available to verifiers under its ID, replacing the
+// merger registered under it before.
+func RegisterMerger(g Merger) {
+	mergersLock.Lock()
+	defer mergersLock.Unlock()
+	mergers[g.ID()] = g
+}
+
+// MergerByID returns the merger registered under id, nil for NoMerger.
+func MergerByID(id MergerID) (Merger, error) {
+	if id == NoMerger {
+		return nil, nil
+	}
+	mergersLock.RLock()
+	defer mergersLock.RUnlock()
+	g, ok := mergers[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownMerger, id)
+	}
+	return g, nil
+}
+
+// mergerID returns the ID of g, which may be nil.
+func mergerID(g Merger) MergerID {
+	if g == nil {
+		return NoMerger
+	}
+	return g.ID()
+}
+
+// checkPayload checks a payload received in a proof: it is valid for g or
+// absent without a merger.
+func checkPayload(g Merger, payload []byte) error {
+	if g == nil {
+		if len(payload) != 0 {
+			return fmt.Errorf("%w: payload without a merger", ErrPayload)
+		}
+		return nil
+	}
+	return g.Validate(payload)
+}
+
+// mergeHash returns the hash of the parent of two nodes, which commits to
+// their hashes, difficulties and payloads. A proof can thereby not shift
+// difficulty between nodes without changing the root.
+func mergeHash(h Hasher, left, right common.Hash, ld, rd *big.Int, lp, rp []byte) common.Hash {
+	return h.Merge(left, right, encodeAggregate(ld, rd, lp, rp))
+}
+
+// encodeAggregate encodes the difficulties and payloads of two nodes, each as
+// its length followed by its bytes.
+func encodeAggregate(ld, rd *big.Int, lp, rp []byte) []byte {
+	var (
+		enc = make([]byte, 0, 64)
+		buf [binary.MaxVarintLen64]byte
+	)
+	for _, b := range [][]byte{ld.Bytes(), rd.Bytes(), lp, rp} {
+		n := binary.PutUvarint(buf[:], uint64(len(b)))
+		enc = append(enc, buf[:n]...)
+		enc = append(enc, b...)
+	}
+	return enc
+}
+
+// mergePayload returns the payload of the parent of two nodes, nil without a
+// merger.
+func mergePayload(g Merger, lp, rp []byte) []byte {
+	if g == nil {
+		return nil
+	}
+	return g.Merge(lp, rp)
+}
+
+// TimeRangeMerger aggregates the minimum and maximum timestamp of the leaves
+// of a subtree. Payloads are the two timestamps as 8 byte big endian numbers,
+// see TimeRangePayload.
+var TimeRangeMerger Merger = timeRangeMerger{}
+
+type timeRangeMerger struct{}
+
+// TimeRangePayload returns the payload of a node whose leaves have timestamps
+// from min to max. A leaf has min == max.
+func TimeRangePayload(min, max uint64) []byte {
+	var p [16]byte
+	binary.BigEndian.PutUint64(p[:8], min)
+	binary.BigEndian.PutUint64(p[8:], max)
+	return p[:]
+}
+
+// DecodeTimeRange returns the timestamps of a TimeRangeMerger payload.
+func DecodeTimeRange(payload []byte) (min, max uint64, err error) {
+	if err := TimeRangeMerger.Validate(payload); err != nil {
+		return 0, 0, err
+	}
+	return binary.BigEndian.Uint64(payload[:8]), binary.BigEndian.Uint64(payload[8:]), nil
+}
+
+func (timeRangeMerger) ID() MergerID {
+	return TimeRange
+}
+
+func (timeRangeMerger) PayloadSize() int {
+	return 16
+}
+
+func (timeRangeMerger) Merge(left, right []byte) []byte {
+	lmin, lmax, _ := DecodeTimeRange(left)
+	rmin, rmax, _ := DecodeTimeRange(right)
+	if rmin < lmin {
+		lmin = rmin
+	}
+	if rmax > lmax {
+		lmax = rmax
+	}
+	return TimeRangePayload(lmin, lmax)
+}
+
+func (timeRangeMerger) Validate(payload []byte) error {
+	if len(payload) != 16 {
+		return fmt.Errorf("%w: time range of %d bytes", ErrPayload, len(payload))
+	}
+	if binary.BigEndian.Uint64(payload[:8]) > binary.BigEndian.Uint64(payload[8:]) {
+		return fmt.Errorf("%w: time range ends before it starts", ErrPayload)
+	}
+	return nil
+}
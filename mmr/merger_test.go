@@ -0,0 +1,200 @@
+package mmr
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+	"github.com/marcopoloprotocol/flyclientDemo/diskdb/memorydb"
+	"github.com/marcopoloprotocol/flyclientDemo/rlp"
+)
+
+// testTime returns a timestamp of leaf i, not in leaf order.
+func testTime(i int) uint64 {
+	return 1000000 + uint64(i*7919%5003)
+}
+
+func testTimedLeaf(i int) *Node {
+	t := testTime(i)
+	return NewNodeWithPayload(BytesToHash(IntToBytes(i)), big.NewInt(int64(1000+i)), TimeRangePayload(t, t))
+}
+
+// testTimeRange returns the time range of leaves [from, to).
+func testTimeRange(from, to int) []byte {
+	min, max := testTime(from), testTime(from)
+	for i := from; i < to; i++ {
+		if t := testTime(i); t < min {
+			min = t
+		} else if t > max {
+			max = t
+		}
+	}
+	return TimeRangePayload(min, max)
+}
+
+func TestTimeRangeMerger(t *testing.T) {
+	p := TimeRangeMerger.Merge(TimeRangePayload(5, 9), TimeRangePayload(2, 7))
+	if min, max, err := DecodeTimeRange(p); err != nil || min != 2 || max != 9 {
+		t.Fatalf("have %d-%d (%v), want 2-9", min, max, err)
+	}
+	for _, bad := range [][]byte{nil, make([]byte, 15), TimeRangePayload(3, 2)} {
+		if err := TimeRangeMerger.Validate(bad); !errors.Is(err, ErrPayload) {
+			t.Fatalf("%x: have %v, want %v", bad, err, ErrPayload)
+		}
+	}
+	if g, err := MergerByID(TimeRange); err != nil || g != TimeRangeMerger {
+		t.Fatalf("time range merger not registered: %v", err)
+	}
+	if g, err := MergerByID(NoMerger); err != nil || g != nil {
+		t.Fatalf("have %v (%v), want no merger", g, err)
+	}
+}
+
+func TestMergerMmr(t *testing.T) {
+	const leaves = 1500
+	m, batch := NewMMRWithMerger(SHA3, TimeRangeMerger), NewMMRWithMerger(SHA3, TimeRangeMerger)
+	plain := NewMMR()
+	db := memorydb.New()
+	disk, err := OpenMMRWithMerger(db, nil, SHA3, TimeRangeMerger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := make([]*Node, leaves)
+	for i := range nodes {
+		nodes[i] = testTimedLeaf(i)
+		m.Push(nodes[i])
+		disk.Push(nodes[i])
+		plain.Push(testLeaf(i))
+		if have, want := m.GetRootNode().GetPayload(), testTimeRange(0, i+1); !bytes.Equal(have, want) {
+			t.Fatalf("%d leaves: root payload %x, want %x", i+1, have, want)
+		}
+	}
+	batch.PushBatch(nodes)
+	if batch.GetRoot() != m.GetRoot() || !bytes.Equal(batch.GetRootNode().GetPayload(), m.GetRootNode().GetPayload()) {
+		t.Fatal("batch push differs from push")
+	}
+	if plain.GetRoot() == m.GetRoot() {
+		t.Fatal("root does not commit to payloads")
+	}
+	if err := disk.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenMMR(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Merger() != TimeRangeMerger || reopened.GetRoot() != m.GetRoot() {
+		t.Fatal("reopened mmr lost its merger")
+	}
+	reopened.Pop()
+	if !bytes.Equal(reopened.GetRootNode().GetPayload(), testTimeRange(0, leaves-1)) {
+		t.Fatal("stored payloads lost")
+	}
+	if _, err := OpenMMRWithHasher(db, nil, SHA3); !errors.Is(err, ErrMergerMismatch) {
+		t.Fatalf("have %v, want %v", err, ErrMergerMismatch)
+	}
+	view, err := m.PrefixAt(700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root := m.BagPeaks(m.PeaksAt(700)); root.GetHash() != view.GetRoot() || !bytes.Equal(root.GetPayload(), testTimeRange(0, 700)) {
+		t.Fatal("view of the first 700 leaves has the wrong root")
+	}
+}
+
+func TestMergerProofs(t *testing.T) {
+	m := NewMMRWithMerger(SHA3, TimeRangeMerger)
+	for i := 0; i < 3000; i++ {
+		m.Push(testTimedLeaf(i))
+	}
+	params := testParams()
+	params.Merger = TimeRange
+	proof, _ := m.CreateNewProof(params)
+	if proof.Merger != TimeRange || !bytes.Equal(proof.RootPayload, testTimeRange(0, 3000)) {
+		t.Fatal("proof does not record the aggregate")
+	}
+	enc, err := rlp.EncodeToBytes(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := new(ProofInfo)
+	if err := rlp.DecodeBytes(enc, dec); err != nil {
+		t.Fatal(err)
+	}
+	js, err := json.Marshal(dec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec = new(ProofInfo)
+	if err := json.Unmarshal(js, dec); err != nil {
+		t.Fatal(err)
+	}
+	pBlocks, err := VerifyRequiredBlocks(dec, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dec.VerifyProof(pBlocks, nil) {
+		t.Fatal("proof rejected")
+	}
+	leaves, err := dec.Leaves()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leaf := range leaves {
+		n := int(leaf.Number)
+		if !bytes.Equal(leaf.Payload, testTimeRange(n, n+1)) {
+			t.Fatalf("leaf %d: payload %x", n, leaf.Payload)
+		}
+		if n > 0 && !bytes.Equal(leaf.PrefixPayload, testTimeRange(0, n)) {
+			t.Fatalf("leaf %d: prefix payload %x, want %x", n, leaf.PrefixPayload, testTimeRange(0, n))
+		}
+	}
+	if _, err := VerifyRequiredBlocks(dec, testParams()); !errors.Is(err, ErrMergerMismatch) {
+		t.Fatalf("have %v, want %v", err, ErrMergerMismatch)
+	}
+
+	// The payloads of siblings are bound by the hashes of their parents.
+	for _, e := range dec.Elems {
+		if e.Cat == 1 {
+			e.Res.payload = TimeRangePayload(0, 1<<40)
+			break
+		}
+	}
+	if _, err := dec.Tree(); !errors.Is(err, ErrProofRootDiffer) {
+		t.Fatalf("have %v, want %v", err, ErrProofRootDiffer)
+	}
+
+	incl, err := m.ProveLeaves([]uint64{10, 2999})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := []common.Hash{testTimedLeaf(10).getHash(), testTimedLeaf(2999).getHash()}
+	if err := incl.Verify(m.GetRoot(), 3000, hashes); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(incl.LeafPayloads[0], testTimeRange(10, 11)) {
+		t.Fatal("inclusion proof has the wrong leaf payload")
+	}
+	incl.LeafPayloads[0] = TimeRangePayload(5, 5)
+	if err := incl.Verify(m.GetRoot(), 3000, hashes); !errors.Is(err, ErrLeafNotIncluded) {
+		t.Fatalf("have %v, want %v", err, ErrLeafNotIncluded)
+	}
+
+	cons, err := m.ProveConsistency(1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := m.BagPeaks(m.PeaksAt(1000))
+	from := &Root{Hash: old.GetHash(), Difficulty: old.GetDifficulty(), LeafNumber: 1000}
+	to := &Root{Hash: m.GetRoot(), Difficulty: m.GetRootDifficulty(), LeafNumber: 3000}
+	if err := cons.Verify(from, to); err != nil {
+		t.Fatal(err)
+	}
+	cons.Siblings[0].Payload = TimeRangePayload(0, 0)
+	if err := cons.Verify(from, to); !errors.Is(err, ErrInconsistent) {
+		t.Fatalf("have %v, want %v", err, ErrInconsistent)
+	}
+}
@@ -6,20 +6,17 @@ import (
 	"strings"
 
 	"errors"
-	"math"
 	"math/big"
+	"math/bits"
+	"runtime"
 	"sort"
+	"sync"
 
 	"github.com/marcopoloprotocol/flyclientDemo/common"
 	"github.com/marcopoloprotocol/flyclientDemo/rlp"
 	"golang.org/x/crypto/sha3"
 )
 
-const (
-	c      = float64(0.5)
-	lambda = uint64(50)
-)
-
 func BytesToHash(b []byte) common.Hash {
 	var a common.Hash
 	a.SetBytes(b)
@@ -38,6 +35,7 @@ func equal_hash(h1, h2 common.Hash) bool {
 type Node struct {
 	value      common.Hash
 	difficulty *big.Int
+	payload    []byte // aggregate of the MMR's Merger, nil without one
 	index      uint64 // position in array
 }
 
@@ -47,6 +45,16 @@ func NewNode(v common.Hash, d *big.Int) *Node {
 		difficulty: new(big.Int).Set(d),
 	}
 }
+
+// NewNodeWithPayload returns a leaf carrying a payload for the Merger of the
+// MMR it is pushed to.
+func NewNodeWithPayload(v common.Hash, d *big.Int, payload []byte) *Node {
+	return &Node{
+		value:      v,
+		difficulty: new(big.Int).Set(d),
+		payload:    common.CopyBytes(payload),
+	}
+}
 func (n *Node) getHash() common.Hash {
 	return n.value
 }
@@ -65,74 +73,27 @@ func (n *Node) setIndex(i uint64) {
 func (n *Node) getIndex() uint64 {
 	return n.index
 }
+func (n *Node) getPayload() []byte {
+	return n.payload
+}
 func (n *Node) clone() *Node {
 	return &Node{
 		value:      n.value,
 		difficulty: new(big.Int).Set(n.difficulty),
+		payload:    n.payload,
 		index:      n.index,
 	}
 }
 func (n *Node) hasChildren(m *Mmr) bool {
-	elem_node_number, curr_root_node_number, aggr_node_number := n.index, m.GetSize(), uint64(0)
-	for {
-		if curr_root_node_number > 2 {
-			leaf_number := node_to_leaf_number(curr_root_node_number)
-			left_tree_leaf_number := get_left_leaf_number(leaf_number)
-			left_tree_node_number := leaf_to_node_number(left_tree_leaf_number)
-			if (aggr_node_number + curr_root_node_number) == (elem_node_number + 1) {
-				return true
-			}
-
-			if elem_node_number < (aggr_node_number + left_tree_node_number) {
-				// branch left
-				curr_root_node_number = left_tree_node_number
-			} else {
-				// branch right
-				curr_root_node_number = curr_root_node_number - left_tree_node_number - 1
-				aggr_node_number += left_tree_node_number
-			}
-		} else {
-			break
-		}
-	}
-	return false
+	_, _, ok := m.children(n.index)
+	return ok
 }
 func (n *Node) getChildren(m *Mmr) (*Node, *Node) {
-	elem_node_number, curr_root_node_number, aggr_node_number := n.index, m.GetSize(), uint64(0)
-
-	for {
-		if curr_root_node_number > 2 {
-			leaf_number := node_to_leaf_number(curr_root_node_number)
-			left_tree_leaf_number := get_left_leaf_number(leaf_number)
-			left_tree_node_number := leaf_to_node_number(left_tree_leaf_number)
-
-			if (aggr_node_number + curr_root_node_number) == (elem_node_number + 1) {
-				leaf_number = node_to_leaf_number(curr_root_node_number)
-				left_tree_leaf_number = get_left_leaf_number(leaf_number)
-				left_tree_node_number = leaf_to_node_number(left_tree_leaf_number)
-
-				left_node_position := aggr_node_number + left_tree_node_number - 1
-				right_node_position := aggr_node_number + curr_root_node_number - 2
-
-				left_elem, right_elem := m.getNode(left_node_position), m.getNode(right_node_position)
-
-				return left_elem, right_elem
-			}
-
-			if elem_node_number < (aggr_node_number + left_tree_node_number) {
-				// branch left
-				curr_root_node_number = left_tree_node_number
-			} else {
-				// branch right
-				curr_root_node_number = curr_root_node_number - left_tree_node_number - 1
-				aggr_node_number += left_tree_node_number
-			}
-		} else {
-			break
-		}
+	left, right, ok := m.children(n.index)
+	if !ok {
+		panic("This node has no children!")
 	}
-
-	panic("This node has no children!")
+	return m.getNode(left), m.getNode(right)
 }
 func (n *Node) String() string {
 	return fmt.Sprintf("{value:%s, index:%v,difficulty:%v}", n.value.Hex(), n.index, n.difficulty)
@@ -160,15 +121,10 @@ func (p *ProofInfo) String() string {
 
 /////////////////////////////////////////////////////////////////////////////////
 type proofRes struct {
-	h  common.Hash
-	td *big.Int
-}
-type VerifyElem struct {
-	Res        *proofRes
-	Index      uint64
-	LeafNumber uint64
+	h       common.Hash
+	td      *big.Int
+	payload []byte
 }
-
 type ProofElem struct {
 	Cat     uint8 // 0--root,1--node,2 --child
 	Res     *proofRes
@@ -179,51 +135,22 @@ type ProofInfo struct {
 	RootHash       common.Hash
 	RootDifficulty *big.Int
 	LeafNumber     uint64
+	Hasher         HasherID // hash function of the MMR
+	Merger         MergerID // payload schema of the MMR
+	RootPayload    []byte   // payload of the root, nil without a merger
 	Elems          []*ProofElem
 	Checked        []uint64
-}
-type ProofElems []*ProofElem
-
-func (p *ProofElems) pop_back() *ProofElem {
-	if len(*p) <= 0 {
-		return nil
-	}
-	index := len(*p) - 1
-	last := (*p)[index]
-	*p = append((*p)[:index], (*p)[index+1:]...)
-	return last
-}
-func (p *ProofElems) pop_front() *ProofElem {
-	if len(*p) <= 0 {
-		return nil
-	}
-	index := 0
-	last := (*p)[index]
-	*p = append((*p)[:index], (*p)[index+1:]...)
-	return last
-}
-func (p *ProofElems) is_empty() bool {
-	return len(*p) == 0
-}
-
-type VerifyElems []*VerifyElem
-
-func (v *VerifyElems) pop_back() *VerifyElem {
-	if len(*v) <= 0 {
-		return nil
-	}
-	index := len(*v) - 1
-	last := (*v)[index]
-	*v = append((*v)[:index], (*v)[index+1:]...)
-	return last
-}
-func (v *VerifyElems) is_empty() bool {
-	return len(*v) == 0
+	Params         *ProofParams // parameters the proof was made with
+	// Headers holds the encoded header of every checked block, in ascending
+	// block order, see VerifyHeaders.
+	Headers [][]byte
 }
 
+// ProofBlock is a block sampled by VerifyRequiredBlocks, together with the
+// aggregated difficulty which selected it.
 type ProofBlock struct {
 	Number     uint64
-	AggrWeight float64
+	AggrWeight *big.Int
 }
 
 func (p *ProofBlock) equal(oth *ProofBlock) bool {
@@ -235,15 +162,6 @@ func (p *ProofBlock) equal(oth *ProofBlock) bool {
 
 type ProofBlocks []*ProofBlock
 
-func (p *ProofBlocks) pop() *ProofBlock {
-	if len(*p) <= 0 {
-		return nil
-	}
-	index := len(*p) - 1
-	last := (*p)[index]
-	*p = append((*p)[:index], (*p)[index+1:]...)
-	return last
-}
 func (a ProofBlocks) Len() int           { return len(a) }
 func (a ProofBlocks) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ProofBlocks) Less(i, j int) bool { return a[i].Number < a[j].Number }
@@ -265,143 +183,198 @@ func (p *elemNodes) push(n *Node) {
 
 //////////////////////////////////////////////////////////////////////////////////////
 
+// Mmr is safe for one writer and many readers. Push, Pop and Flush must not
+// be called concurrently with each other, the accessors may be called at any
+// time. Proofs are made from a Snapshot taken when they start, so they are
+// consistent and do not hold up the writer while it keeps appending.
 type Mmr struct {
-	values  []*Node
+	lock    sync.RWMutex // held for writing by Push, Pop and Flush
+	values  nodeStore
+	hasher  Hasher
+	merger  Merger // nil if the nodes carry no payload
 	curSize uint64 // unused
 	leafNum uint64
 }
 
+// NewMMR returns an empty in-memory MMR hashing with SHA3.
 func NewMMR() *Mmr {
+	return NewMMRWithHasher(SHA3)
+}
+
+// NewMMRWithHasher returns an empty in-memory MMR hashing with h.
+func NewMMRWithHasher(h Hasher) *Mmr {
+	return NewMMRWithMerger(h, nil)
+}
+
+// NewMMRWithMerger returns an empty in-memory MMR hashing with h, whose nodes
+// carry payloads aggregated by g. Its leaves must be created with
+// NewNodeWithPayload.
+func NewMMRWithMerger(h Hasher, g Merger) *Mmr {
 	return &Mmr{
-		values:  make([]*Node, 0, 0),
+		values:  &memStore{values: make([]*Node, 0, 0)},
+		hasher:  h,
+		merger:  g,
 		curSize: 0,
 		leafNum: 0,
 	}
 }
+
+// Hasher returns the hash function of the MMR.
+func (m *Mmr) Hasher() Hasher {
+	return m.hasher
+}
+
+// Merger returns the payload merger of the MMR, nil if it has none.
+func (m *Mmr) Merger() Merger {
+	return m.merger
+}
 func (m *Mmr) getNode(pos uint64) *Node {
-	if int(pos) > int(len(m.values)-1) {
-		return nil
-	}
-	return m.values[pos]
+	return m.values.get(pos)
+}
+func (m *Mmr) appendNode(n *Node) {
+	n.index = m.values.size()
+	m.values.append(n)
 }
 func (m *Mmr) getLeafNumber() uint64 {
 	return m.leafNum
 }
+func (m *Mmr) GetLeafNumber() uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.leafNum
+}
 func (m *Mmr) Pop() *Node {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	if m.leafNum <= 0 {
 		return nil
 	}
-	peakNode, curr_tree_number, aggr_node_number := elemNodes(make([]*Node, 0, 0)), m.leafNum, uint64(0)
-	for !IsPowerOfTwo(curr_tree_number) {
-		m.removeLastElem()
-		left_tree_number := NextPowerOfTwo(curr_tree_number) / 2
-		aggr_node_number += left_tree_number
-		right_tree_number := curr_tree_number - left_tree_number
-
-		left_root_node_number := GetNodeFromLeaf(aggr_node_number) - 1
-		peakNode.push(m.getNode(left_root_node_number))
-		curr_tree_number = right_tree_number
-	}
-	peakNode.push(m.GetRootNode())
-	lastPeak := peakNode.pop()
-	tmp, remove := m.splitPeak(lastPeak)
-	if remove == nil {
-		return nil
-	}
-	m.removeLastLeafNode(remove)
-	peakNode = append(peakNode, tmp...)
-	for len(peakNode) > 1 {
-		right := peakNode.pop()
-		left := peakNode.pop()
-		parent := merge(left, right)
-		m.values = append(m.values, parent)
-		parent.index = uint64(len(m.values) - 1)
-		peakNode.push(parent)
-	}
-	return remove
-}
-func (m *Mmr) splitPeak(lastPeak *Node) ([]*Node, *Node) {
-	peakNodes := elemNodes(make([]*Node, 0, 0))
-	height := pos_height_in_tree(lastPeak.index)
-	if height == 0 {
-		return peakNodes, lastPeak
-	}
-	peaksize := (uint64(1) << uint64(height+1)) - 1
-	offset := lastPeak.index + 1 - peaksize
-	peaksize = peaksize - 1
-
-	for peaksize > 0 {
-		m.removeLastElem()
-		height, pos := left_peak_height_pos(peaksize)
-		if height == 0 {
-			peakNodes.push(m.getNode(pos + offset))
-			return peakNodes, m.getNode(pos + offset + 1)
-		}
-		if height > 0 {
-			leafPeak := m.getNode(pos + offset)
-			peakNodes.push(leafPeak)
-			height, pos = get_right_peak(height, pos, peaksize)
-			rightPeak := m.getNode(pos + offset)
-			peaksize = (uint64(1) << uint64(height+1)) - 1
-			offset = rightPeak.index + 1 - peaksize
-			peaksize = peaksize - 1
-		}
+	// The last leaf follows the complete subtrees of all others, everything
+	// from it on is dropped and the remaining peaks are bagged again.
+	m.leafNum--
+	leaf := m.getNode(GetNodeFromLeaf(m.leafNum))
+	m.values.truncate(leaf.index)
+	if m.leafNum > 0 {
+		m.bagPeaks()
 	}
-	return peakNodes, nil
-}
-func (m *Mmr) removeLastLeafNode(leaf *Node) {
-	index := leaf.index
-	m.values = append(m.values[:index], m.values[index+1:]...)
-	m.leafNum = m.leafNum - 1
-	return
+	return leaf
 }
 
 func (m *Mmr) Push(newElem *Node) {
-	if len(m.values) <= 0 {
-		m.values, m.leafNum, m.curSize = append(m.values, newElem), 1, 1
-		newElem.index = 0
-	} else {
-		nodes_to_hash, curr_tree_number, aggr_node_number := elemNodes(make([]*Node, 0, 0)), m.leafNum, uint64(0)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// Drop the nodes bagging the peaks, append the leaf and the complete
+	// subtrees it closes, like a binary increment of the leaf number, then
+	// bag the peaks again.
+	m.values.truncate(GetNodeFromLeaf(m.leafNum))
+	m.pushSubtree([]*Node{newElem}, 0)
+	m.bagPeaks()
+}
+
+// batchSubtree is the leaf count of the subtrees PushBatch hashes
+// concurrently.
+const batchSubtree = 1 << 10
+
+// PushBatch appends leaves like calling Push for each of them. The complete
+// subtrees of batchSubtree leaves are hashed concurrently and the peaks are
+// bagged only once, so it is much faster for many leaves.
+func (m *Mmr) PushBatch(leaves []*Node) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(leaves) == 0 {
+		return
+	}
+	m.values.truncate(GetNodeFromLeaf(m.leafNum))
+	// Leaves up to the first subtree boundary are pushed one by one.
+	for len(leaves) > 0 && m.leafNum%batchSubtree != 0 {
+		m.pushSubtree(leaves[:1], 0)
+		leaves = leaves[1:]
+	}
+	trees := make([][]*Node, len(leaves)/batchSubtree)
+	var (
+		wg   sync.WaitGroup
+		next = make(chan int, len(trees))
+	)
+	for i := range trees {
+		next <- i
+	}
+	close(next)
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				t := &Mmr{values: &memStore{values: make([]*Node, 0, 2*batchSubtree-1)}, hasher: m.hasher, merger: m.merger}
+				for _, leaf := range leaves[i*batchSubtree : (i+1)*batchSubtree] {
+					t.pushSubtree([]*Node{leaf}, 0)
+				}
+				trees[i] = t.values.(*memStore).values
+			}
+		}()
+	}
+	wg.Wait()
+	height := bits.TrailingZeros(batchSubtree)
+	for _, nodes := range trees {
+		m.pushSubtree(nodes, height)
+	}
+	for _, leaf := range leaves[len(trees)*batchSubtree:] {
+		m.pushSubtree([]*Node{leaf}, 0)
+	}
+	m.bagPeaks()
+}
 
-		for !IsPowerOfTwo(curr_tree_number) {
-			m.removeLastElem()
-			left_tree_number := NextPowerOfTwo(curr_tree_number) / 2
-			aggr_node_number += left_tree_number
-			right_tree_number := curr_tree_number - left_tree_number
+// pushSubtree appends the nodes of a complete subtree of 2^height leaves, in
+// position order, and the nodes of the complete subtrees it closes, like a
+// binary increment of the leaf number. The peaks are left unbagged.
+func (m *Mmr) pushSubtree(nodes []*Node, height int) {
+	for _, n := range nodes {
+		m.appendNode(n)
+	}
+	right, h := nodes[len(nodes)-1], height
+	for n := m.leafNum >> uint(height); n&1 == 1; n >>= 1 {
+		right = merge(m.hasher, m.merger, m.getNode(right.index-sibling_offset(h)), right)
+		m.appendNode(right)
+		h++
+	}
+	m.leafNum += 1 << uint(height)
+}
 
-			left_root_node_number := GetNodeFromLeaf(aggr_node_number) - 1
-			nodes_to_hash.push(m.getNode(left_root_node_number))
-			curr_tree_number = right_tree_number
-		}
-		nodes_to_hash.push(m.GetRootNode())
-		m.values = append(m.values, newElem)
-		newElem.index = uint64(len(m.values) - 1)
-		nodes_to_hash.push(newElem)
-
-		for len(nodes_to_hash) > 1 {
-			right := nodes_to_hash.pop()
-			left := nodes_to_hash.pop()
-			parent := merge(left, right)
-			m.values = append(m.values, parent)
-			parent.index = uint64(len(m.values) - 1)
-			nodes_to_hash.push(parent)
-		}
-		m.leafNum += 1
+// bagPeaks appends the nodes folding the peaks from right to left into the
+// root. They follow the complete subtrees, each right after its right child.
+func (m *Mmr) bagPeaks() {
+	peaks := peak_positions(m.leafNum)
+	root := m.getNode(peaks[len(peaks)-1])
+	for i := len(peaks) - 2; i >= 0; i-- {
+		root = merge(m.hasher, m.merger, m.getNode(peaks[i]), root)
+		m.appendNode(root)
 	}
 }
-func (m *Mmr) removeLastElem() {
-	if len(m.values) <= 0 {
-		return
+
+// children returns the positions of the children of the node at pos. Nodes
+// of complete subtrees sit at the standard MMR positions, their children
+// follow from the height. The nodes bagging the peaks follow all complete
+// subtrees and take a peak as their left child.
+func (m *Mmr) children(pos uint64) (uint64, uint64, bool) {
+	if std := GetNodeFromLeaf(m.leafNum); pos >= std {
+		peaks := peak_positions(m.leafNum)
+		return peaks[len(peaks)-2-int(pos-std)], pos - 1, true
+	}
+	height := pos_height_in_tree(pos)
+	if height == 0 {
+		return 0, 0, false
 	}
-	index := len(m.values) - 1
-	m.values = append(m.values[:index], m.values[index+1:]...)
-	return
+	return pos - (uint64(1) << uint64(height)), pos - 1, true
 }
-func (m *Mmr) GetRootNode() *Node {
-	if len(m.values) <= 0 {
+func (m *Mmr) rootNode() *Node {
+	if m.values.size() <= 0 {
 		return nil
 	}
-	return m.values[len(m.values)-1]
+	return m.values.get(m.values.size() - 1)
+}
+func (m *Mmr) GetRootNode() *Node {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.rootNode()
 }
 func (m *Mmr) GetRoot() common.Hash {
 	root := m.GetRootNode()
@@ -412,7 +385,9 @@ func (m *Mmr) GetRoot() common.Hash {
 	}
 }
 func (m *Mmr) GetSize() uint64 {
-	return uint64(len(m.values))
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.values.size()
 }
 func (m *Mmr) GetRootDifficulty() *big.Int {
 	root := m.GetRootNode()
@@ -423,410 +398,207 @@ func (m *Mmr) GetRootDifficulty() *big.Int {
 	}
 }
 func (m *Mmr) GetChildByAggrWeightDisc(weight *big.Int) uint64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.childByAggrWeight(weight)
+}
+func (m *Mmr) childByAggrWeight(weight *big.Int) uint64 {
 	AggrWeight, aggr_node_number, curr_tree_number := big.NewInt(0), uint64(0), m.leafNum
-	for {
-		if curr_tree_number > 1 {
-			left_tree_number := curr_tree_number / 2
-			if !IsPowerOfTwo(curr_tree_number) {
-				left_tree_number = NextPowerOfTwo(curr_tree_number) / 2
-			}
-			n := m.getNode(GetNodeFromLeaf(aggr_node_number+left_tree_number) - 1)
-			if n == nil {
-				panic("wrong pos1")
-			}
-			left_tree_difficulty := n.getDifficulty()
-			if weight.Cmp(new(big.Int).Add(AggrWeight, left_tree_difficulty)) >= 0 {
-				// branch right
-				aggr_node_number += left_tree_number
-				left_root_node_number := GetNodeFromLeaf(aggr_node_number) - 1
-				n1 := m.getNode(left_root_node_number)
-				if n1 == nil {
-					panic("wrong pos2")
-				}
-				AggrWeight = new(big.Int).Add(AggrWeight, n1.getDifficulty())
-				curr_tree_number = curr_tree_number - left_tree_number
-			} else {
-				// branch left
-				curr_tree_number = left_tree_number
-			}
+	limit := new(big.Int)
+	for curr_tree_number > 1 {
+		left_tree_number := get_left_leaf_number(curr_tree_number)
+		// the left subtree is complete, its root closes its leaves
+		n := m.getNode(GetNodeFromLeaf(aggr_node_number+left_tree_number) - 1)
+		if n == nil {
+			panic("wrong pos1")
+		}
+		if weight.Cmp(limit.Add(AggrWeight, n.difficulty)) >= 0 {
+			// branch right
+			aggr_node_number += left_tree_number
+			AggrWeight.Set(limit)
+			curr_tree_number = curr_tree_number - left_tree_number
 		} else {
-			break
+			// branch left
+			curr_tree_number = left_tree_number
 		}
 	}
 	return aggr_node_number
 }
+
+// GetChildByAggrWeight returns the leaf holding the given fraction of the
+// root difficulty. Proofs sample with GetChildByAggrWeightDisc, which is exact.
 func (m *Mmr) GetChildByAggrWeight(weight float64) uint64 {
-	root_weight := m.GetRootDifficulty()
-	v1, _ := new(big.Float).Mul(new(big.Float).SetInt(root_weight), big.NewFloat(weight)).Int64()
-	weight_disc := big.NewInt(v1)
-	return m.GetChildByAggrWeightDisc(weight_disc)
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	root_weight := m.rootNode().getDifficulty()
+	weight_disc, _ := new(big.Float).Mul(new(big.Float).SetInt(root_weight), big.NewFloat(weight)).Int(nil)
+	return m.childByAggrWeight(weight_disc)
 }
 
 func (m *Mmr) Copy() *Mmr {
-	tmp := NewMMR()
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	tmp := NewMMRWithMerger(m.hasher, m.merger)
 	tmp.curSize = m.curSize
 	tmp.leafNum = m.leafNum
-	for _, n := range m.values {
-		tmp.values = append(tmp.values, n.clone())
+	for i := uint64(0); i < m.values.size(); i++ {
+		tmp.values.append(m.values.get(i).clone())
 	}
 	return tmp
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////
 
-func generateProofRecursive(currentNode *Node, blocks []uint64, proofs []*ProofElem,
-	max_left_tree_leaf_number uint64, startDepth int, leaf_number_sub_tree uint64, space uint64,
-	m *Mmr) []*ProofElem {
-	if !currentNode.hasChildren(m) {
-		proofs = append(proofs, &ProofElem{
-			Cat:     2,
-			Right:   false,
-			LeafNum: 0,
-			Res: &proofRes{
-				h:  currentNode.getHash(),
-				td: currentNode.getDifficulty(),
-			},
-		})
-		return proofs
-	}
-	left_node, right_node := currentNode.getChildren(m)
-	pos := binary_search(blocks, max_left_tree_leaf_number)
-	left, right := splitAt(blocks, pos)
-	next_left_leaf_number_subtree := get_left_leaf_number(leaf_number_sub_tree)
-	if len(left) != 0 {
-		depth := get_depth(next_left_leaf_number_subtree)
-		diff := uint64(0)
-		if depth >= 1 {
-			diff = uint64(math.Pow(float64(2), float64(depth-1)))
-		}
-		proofs = generateProofRecursive(left_node, left, proofs,
-			max_left_tree_leaf_number-diff,
-			startDepth, next_left_leaf_number_subtree,
-			space+1, m)
-	} else {
-		proofs = append(proofs, &ProofElem{
-			Cat:     1,
-			Right:   false,
-			LeafNum: 0,
-			Res: &proofRes{
-				h:  left_node.getHash(),
-				td: left_node.getDifficulty(),
-			},
-		})
-	}
-	if len(right) != 0 {
-		depth := get_depth(leaf_number_sub_tree - next_left_leaf_number_subtree)
-		diff := uint64(0)
-		if depth >= 1 {
-			diff = uint64(math.Pow(float64(2), float64(depth-1)))
-		}
-		proofs = generateProofRecursive(right_node, right, proofs,
-			max_left_tree_leaf_number+diff, startDepth,
-			leaf_number_sub_tree-next_left_leaf_number_subtree,
-			space+1, m)
-	} else {
-		proofs = append(proofs, &ProofElem{
-			Cat:     1,
-			Right:   true,
-			LeafNum: 0,
-			Res: &proofRes{
-				h:  right_node.getHash(),
-				td: right_node.getDifficulty(),
-			},
-		})
-	}
-	return proofs
-}
-
-func (m *Mmr) genProof(right_difficulty *big.Int, blocks []uint64) *ProofInfo {
+func (m *Mmr) genProof(blocks []uint64) *ProofInfo {
 	blocks = SortAndRemoveRepeatForBlocks(blocks)
-	proofs, rootNode, depth := []*ProofElem{}, m.GetRootNode(), get_depth(m.getLeafNumber())
-	max_leaf_num := uint64(math.Pow(float64(2), float64(depth-1)))
-	proofs = generateProofRecursive(rootNode, blocks, proofs, max_leaf_num, depth,
-		m.getLeafNumber(), 0, m)
-
-	proofs = append(proofs, &ProofElem{
+	rootNode := m.GetRootNode()
+	tree := m.proofTree(0, m.getLeafNumber(), 0, blocks)
+	proofs := append(tree.elems(make([]*ProofElem, 0, 2*len(blocks)*get_depth(m.getLeafNumber())), false), &ProofElem{
 		Cat:     0,
 		Right:   false,
 		LeafNum: m.getLeafNumber(),
 		Res: &proofRes{
-			h:  rootNode.getHash(),
-			td: rootNode.getDifficulty(),
+			h:       rootNode.getHash(),
+			td:      rootNode.getDifficulty(),
+			payload: rootNode.getPayload(),
 		},
 	})
 	return &ProofInfo{
-		RootHash:       m.GetRoot(),
-		RootDifficulty: m.GetRootDifficulty(),
+		RootHash:       rootNode.getHash(),
+		RootDifficulty: rootNode.getDifficulty(),
 		LeafNumber:     m.getLeafNumber(),
+		Hasher:         m.hasher.ID(),
+		Merger:         mergerID(m.merger),
+		RootPayload:    rootNode.getPayload(),
 		Elems:          proofs,
 	}
 }
 
-func (m *Mmr) CreateNewProof(right_difficulty *big.Int) (*ProofInfo, []uint64, []uint64) {
-	root_hash := m.GetRoot()
-	r1, _ := new(big.Float).SetInt(right_difficulty).Float64()
-	r2, _ := new(big.Float).SetInt(new(big.Int).Add(m.GetRootDifficulty(), right_difficulty)).Float64()
-	required_queries := uint64(vd_calculate_m(float64(lambda), c, r1, r2, m.getLeafNumber()) + 1.0)
-
-	weights, blocks := []float64{}, []uint64{}
-	for i := 0; i < int(required_queries); i++ {
-		h := RlpHash([]interface{}{root_hash, uint64(i)})
-		random := Hash_to_f64(h)
-		r3, _ := new(big.Float).SetInt(m.GetRootDifficulty()).Float64()
-		AggrWeight := cdf(random, vd_calculate_delta(r1, r3))
-		weights = append(weights, AggrWeight)
-	}
-	sort.Float64s(weights)
-	for _, v := range weights {
-		b := m.GetChildByAggrWeight(v)
+// CreateNewProof creates a FlyClient proof of m with the given parameters and
+// returns it with the numbers of the sampled blocks. Their Hasher and Merger
+// are replaced by the ones of m.
+func (m *Mmr) CreateNewProof(params *ProofParams) (*ProofInfo, []uint64) {
+	m = m.Snapshot()
+	params = params.Copy()
+	params.Hasher, params.Merger = m.hasher.ID(), mergerID(m.merger)
+	root := &Root{Hash: m.GetRoot(), Difficulty: m.GetRootDifficulty(), LeafNumber: m.getLeafNumber()}
+	blocks := []uint64{}
+	for _, v := range proofWeights(root, params) {
+		b := m.childByAggrWeight(v)
 		blocks = append(blocks, b)
 	}
-	// Pick up at specific sync point
-	// Add extra blocks, which are used for syncing from an already available state
-	// 1. block : first block of current 30_000 block interval
-	// 2. block : first block of previous 30_000 block interval
-	// 3. block : first block of third last 30_000 block interaval
-	// 4. block : first block of fourth last 30_000 block interval
-	// 5. block : first block of fiftf last 30_000 block interval
-	// 6. block : first block of sixth last 30_000 block interval
-	// 7. block : first block of seventh last 30_000 block interval
-	// 8. block : first block of eighth last 30_000 block interval
-	// 9. block : first block of ninth last 30_000 block interval
-	// 10. block: first block of tenth last 30_000 block interval
-	extra_blocks, current_block := []uint64{}, ((m.getLeafNumber()-1)/30000)*30000
-	added := 0
-	for {
-		if current_block > 30000 && added < 10 {
-			// blocks = append(blocks, current_block)
-			extra_blocks = append(extra_blocks, current_block)
-			current_block -= 30000
-			added += 1
-		} else {
-			break
-		}
-	}
-
 	sort.Slice(blocks, func(i, j int) bool {
 		return blocks[i] < blocks[j]
 	})
-	info := m.genProof(right_difficulty, blocks)
+	info := m.genProof(blocks)
 	info.Checked = blocks
-	return info, blocks, extra_blocks
+	info.Params = params
+	return info, blocks
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////
 
-func get_root(nodes []*VerifyElem) (common.Hash, *big.Int) {
-	tmp := []*VerifyElem{}
-	for _, v := range nodes {
-		tmp = append(tmp, v)
-	}
-	tmp_nodes := VerifyElems(tmp)
-	for {
-		if len(tmp_nodes) > 1 {
-			node2 := tmp_nodes.pop_back()
-			node1 := tmp_nodes.pop_back()
-			hash := merge2(node1.Res.h, node2.Res.h)
-			tmp_nodes = append(tmp_nodes, &VerifyElem{
-				Res: &proofRes{
-					h:  hash,
-					td: new(big.Int).Add(node1.Res.td, node2.Res.td),
-				},
-				Index:      math.MaxUint64, // uint64(-1) .. none
-				LeafNumber: math.MaxUint64, // uint64(-1) .. none
-			})
-		} else {
-			break
-		}
+// VerifyProof checks the proof for the blocks sampled by VerifyRequiredBlocks:
+// the proven tree has to recompute to the root and every sampled aggregated
+// difficulty has to fall into the block it selects. The tree is rehashed and
+// checked concurrently for large proofs. If the proof carries the sampled
+// headers they are decoded with dec and verified too, see VerifyHeaders; dec
+// may be nil for proofs without headers.
+func (p *ProofInfo) VerifyProof(blocks []*ProofBlock, dec HeaderDecoder) bool {
+	_, err := p.VerifyProofHeaders(blocks, dec)
+	return err == nil
+}
+
+// VerifyProofHeaders is like VerifyProof, but tells why a proof is invalid and
+// returns the leaves its headers are sampled as, in the order of the headers,
+// so they can be checked further without rebuilding the proven tree. The
+// leaves are nil if the proof carries no headers.
+func (p *ProofInfo) VerifyProofHeaders(blocks []*ProofBlock, dec HeaderDecoder) ([]*ProofLeaf, error) {
+	tree, err := p.Tree()
+	if err != nil {
+		return nil, err
 	}
-	if len(tmp_nodes) >= 1 {
-		return tmp_nodes[0].Res.h, tmp_nodes[0].Res.td
+	return p.verifyTree(tree, blocks, dec)
+}
+
+// verifyTree implements VerifyProofHeaders for tree, the proven tree of p.
+func (p *ProofInfo) verifyTree(tree *ProofTree, blocks []*ProofBlock, dec HeaderDecoder) ([]*ProofLeaf, error) {
+	if !tree.covers(blocks) {
+		return nil, ErrWeightNotCovered
+	}
+	if p.Headers == nil {
+		return nil, nil
 	}
-	return common.Hash{0}, nil
+	leaves := p.leavesOf(tree)
+	if err := p.checkLeaves(leaves, dec); err != nil {
+		return nil, err
+	}
+	return leaves, nil
 }
-func (p *ProofInfo) VerifyProof(blocks []*ProofBlock) bool {
-	blocks = SortAndRemoveRepeatForProofBlocks(blocks)
-	blocks = reverseForProofBlocks(blocks)
-	proof_blocks := ProofBlocks(blocks)
 
-	proofs := ProofElems(p.Elems)
-	root_elem := proofs.pop_back()
-	if root_elem == nil || root_elem.Cat != 0 {
-		return false
+// covers reports whether every sampled aggregated difficulty falls into the
+// checked leaf of t it selects, and every checked leaf is selected.
+func (t *ProofTree) covers(blocks []*ProofBlock) bool {
+	weights := make(map[uint64][]*big.Int)
+	for _, b := range blocks {
+		weights[b.Number] = append(weights[b.Number], b.AggrWeight)
 	}
-	if len(proofs) == 1 {
-		if it := proofs.pop_back(); it != nil {
-			if it.Cat == 2 {
-				return equal_hash(it.Res.h, root_elem.Res.h)
-			}
-		}
+	if len(weights) != t.count {
 		return false
 	}
-	nodes := VerifyElems([]*VerifyElem{})
-	for {
-		if !proofs.is_empty() {
-			proof_elem := proofs.pop_front()
-			if proof_elem.Cat == 2 {
-				proof_block := proof_blocks.pop()
-				number := proof_block.Number
-
-				if !nodes.is_empty() {
-					//TODO: Verification of previous MMR should happen here
-					//weil in einem Ethereum block header kein mmr hash vorhanden ist, kann man
-					//dies nicht überprüfen, wenn doch irgendwann vorhanden, dann einfach
-					//'block_header.mmr == old_root_hash' überprüfen
-					_, left_difficulty := get_root(nodes)
-					left, middle := new(big.Float).SetInt(left_difficulty), new(big.Float).Mul(new(big.Float).SetInt(root_elem.Res.td), big.NewFloat(proof_block.AggrWeight))
-					right := new(big.Float).Add(new(big.Float).SetInt(left_difficulty), new(big.Float).SetInt(proof_elem.Res.td))
-					if left.Cmp(middle) > 0 || right.Cmp(middle) <= 0 {
-						// "aggregated difficulty is not correct, should coincide with: {} <= {} < {}",left, middle, right
-						return false
-					}
-				}
-				if number%2 == 0 && number != (root_elem.LeafNum-1) {
-					right_node := proofs.pop_front()
-					right_node_hash, right_node_diff := right_node.Res.h, new(big.Int).Set(right_node.Res.td)
-					if right_node.Cat == 2 || right_node.Cat == 1 {
-						if right_node.Cat == 2 {
-							proof_blocks.pop()
-						}
-					} else {
-						// Expected ???
-						return false
-					}
-					hash := merge2(proof_elem.Res.h, right_node_hash)
-					nodes = append(nodes, &VerifyElem{
-						Res: &proofRes{
-							h:  hash,
-							td: new(big.Int).Add(proof_elem.Res.td, right_node_diff),
-						},
-						Index:      number / 2,
-						LeafNumber: root_elem.LeafNum / 2,
-					})
-				} else {
-					res0 := nodes.pop_back()
-					hash := merge2(res0.Res.h, proof_elem.Res.h)
-					nodes = append(nodes, &VerifyElem{
-						Res: &proofRes{
-							h:  hash,
-							td: new(big.Int).Add(proof_elem.Res.td, res0.Res.td),
-						},
-						Index:      number / 2,
-						LeafNumber: root_elem.LeafNum / 2,
-					})
-				}
-			} else if proof_elem.Cat == 1 {
-				if proof_elem.Right {
-					left_node := nodes.pop_back()
-					hash := merge2(left_node.Res.h, proof_elem.Res.h)
-					nodes = append(nodes, &VerifyElem{
-						Res: &proofRes{
-							h:  hash,
-							td: new(big.Int).Add(left_node.Res.td, proof_elem.Res.td),
-						},
-						Index:      left_node.Index / 2,
-						LeafNumber: left_node.LeafNumber / 2,
-					})
-				} else {
-					nodes = append(nodes, &VerifyElem{
-						Res:        proof_elem.Res,
-						Index:      math.MaxUint64, // UINT64(-1)
-						LeafNumber: math.MaxUint64, // UINT64(-1)
-					})
-				}
-			} else if proof_elem.Cat == 0 {
-				// do nothing
-			} else {
-				panic("invalid Cat...")
-			}
-			for {
-				if len(nodes) > 1 {
-					node2 := nodes.pop_back()
-					node1 := nodes.pop_back()
-					if node2.Index == math.MaxUint64 || (node2.Index%2 != 1 && !proofs.is_empty()) {
-						nodes = append(nodes, node1)
-						nodes = append(nodes, node2)
-						break
-					}
-					hash := merge2(node1.Res.h, node2.Res.h)
-					nodes = append(nodes, &VerifyElem{
-						Res: &proofRes{
-							h:  hash,
-							td: new(big.Int).Add(node1.Res.td, node2.Res.td),
-						},
-						Index:      node2.Index / 2,
-						LeafNumber: node2.LeafNumber / 2,
-					})
-				} else {
-					break
-				}
+	ok := make([]bool, t.count)
+	t.eachChecked(0, nil, func(i int, leaf *ProofTree, peaks []*ProofTree) {
+		left := new(big.Int)
+		for _, peak := range peaks {
+			left.Add(left, peak.Difficulty)
+		}
+		right := new(big.Int).Add(left, leaf.Difficulty)
+		ws := weights[leaf.Number]
+		for _, w := range ws {
+			if w == nil || left.Cmp(w) > 0 || right.Cmp(w) <= 0 {
+				return
 			}
-		} else {
-			break
+		}
+		ok[i] = len(ws) > 0
+	})
+	for _, v := range ok {
+		if !v {
+			return false
 		}
 	}
+	return true
+}
 
-	res0 := nodes.pop_back()
-	if res0 != nil {
-		return equal_hash(root_elem.Res.h, res0.Res.h) && root_elem.Res.td.Cmp(res0.Res.td) == 0
+// VerifyRequiredBlocks recomputes the blocks the proof has to sample and
+// checks the proof samples as many. The proof must have been made with
+// parameters at least as strong as required.
+func VerifyRequiredBlocks(info *ProofInfo, required *ProofParams) ([]*ProofBlock, error) {
+	params := info.Params
+	if params == nil {
+		return nil, ErrMissingParams
 	}
-	return false
-}
-func VerifyRequiredBlocks(info *ProofInfo, right_difficulty *big.Int) ([]*ProofBlock, error) {
-	blocks := info.Checked
-	root_hash := info.RootHash
-	root_difficulty := info.RootDifficulty
-	root_leaf_number := info.LeafNumber
-	r1, _ := new(big.Float).SetInt(right_difficulty).Float64()
-	r2, _ := new(big.Float).SetInt(new(big.Int).Add(root_difficulty, right_difficulty)).Float64()
-	required_queries := uint64(vd_calculate_m(float64(lambda), c, r1, r2, root_leaf_number) + 1.0)
-	extra_blocks, current_block := []uint64{}, ((root_leaf_number-1)/30000)*30000
-	added := 0
-	for {
-		if current_block > 30000 && added < 10 {
-			extra_blocks = append(extra_blocks, current_block)
-			current_block -= 30000
-			added += 1
-		} else {
-			break
-		}
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	if err := params.Covers(required); err != nil {
+		return nil, err
 	}
+	blocks := info.Checked
+	root := &Root{Hash: info.RootHash, Difficulty: info.RootDifficulty, LeafNumber: info.LeafNumber}
+	required_queries := params.requiredQueries(root.Difficulty, root.LeafNumber)
 
 	// required queries can contain the same block number multiple times
 	// TODO: maybe multiple blocks can be pruned away?
 	if required_queries != uint64(len(blocks)) {
 		return nil, errors.New(fmt.Sprintf("false number of blocks provided: required: %v, got: %v", required_queries, len(blocks)))
 	}
-	weights := []float64{}
-	for i := 0; i < int(required_queries); i++ {
-		h := RlpHash([]interface{}{root_hash, uint64(i)})
-		random := Hash_to_f64(h)
-		r3, _ := new(big.Float).SetInt(root_difficulty).Float64()
-		AggrWeight := cdf(random, vd_calculate_delta(r1, r3))
-		weights = append(weights, AggrWeight)
-	}
-	sort.Float64s(weights)
-	proof_blocks, weight_pos := []*ProofBlock{}, 0
-
-	for _, v := range blocks {
-		AggrWeight := weights[weight_pos]
-		// if len(extra_blocks) > 0 {
-		// 	index := len(extra_blocks) - 1
-		// 	curr_extra_block := extra_blocks[index]
-		// 	if v == curr_extra_block {
-		// 		extra_blocks = append(extra_blocks[:index], extra_blocks[index+1:]...)
-		// 		AggrWeight = 0 // 0--none
-		// 	} else {
-		// 		weight_pos++
-		// 	}
-		// } else {
-		// 	weight_pos++
-		// }
-		AggrWeight = weights[weight_pos]
-		weight_pos++
+	weights := proofWeights(root, params)
+	proof_blocks := []*ProofBlock{}
+
+	for i, v := range blocks {
 		proof_blocks = append(proof_blocks, &ProofBlock{
 			Number:     v,
-			AggrWeight: AggrWeight,
+			AggrWeight: weights[i],
 		})
 	}
 	return proof_blocks, nil
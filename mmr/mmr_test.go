@@ -6,9 +6,11 @@ import (
 	"fmt"
 	"math"
 	"math/big"
+	"sync"
 	"testing"
 
 	"github.com/marcopoloprotocol/flyclientDemo/common"
+	"github.com/marcopoloprotocol/flyclientDemo/diskdb/memorydb"
 )
 
 func IntToBytes(n int) []byte {
@@ -73,17 +75,17 @@ func Test05(t *testing.T) {
 			difficulty: big.NewInt(1000),
 		})
 	}
-	right_difficulty := big.NewInt(1000)
+	params := testParams()
 	fmt.Println("leaf_number:", mmr.getLeafNumber(), "root_difficulty:", mmr.GetRootDifficulty())
-	proof, blocks, eblocks := mmr.CreateNewProof(right_difficulty)
-	fmt.Println("blocks_len:", len(blocks), "blocks:", blocks, "eblocks:", len(eblocks))
+	proof, blocks := mmr.CreateNewProof(params)
+	fmt.Println("blocks_len:", len(blocks), "blocks:", blocks)
 	fmt.Println("proof:", proof)
-	pBlocks, err := VerifyRequiredBlocks(proof, right_difficulty)
+	pBlocks, err := VerifyRequiredBlocks(proof, params)
 	if err != nil {
 		fmt.Println("err:", err)
 		return
 	}
-	b := proof.VerifyProof(pBlocks)
+	b := proof.VerifyProof(pBlocks, nil)
 	fmt.Println("b:", b)
 	fmt.Println("finish")
 }
@@ -111,17 +113,105 @@ func test_O6(count int) {
 	// r := mmr.Pop()
 	// fmt.Println("last:", r)
 	// fmt.Println(mmr.GetSize(), mmr.GetRootNode())
-	right_difficulty := big.NewInt(1000)
+	params := testParams()
 	// fmt.Println("leaf_number:", mmr.getLeafNumber(), "root_difficulty:", mmr.GetRootDifficulty())
-	proof, _, _ := mmr.CreateNewProof(right_difficulty)
+	proof, _ := mmr.CreateNewProof(params)
 	// fmt.Println("blocks_len:", len(blocks), "blocks:", blocks, "eblocks:", len(eblocks))
 	// fmt.Println("proof:", proof)
-	pBlocks, err := VerifyRequiredBlocks(proof, right_difficulty)
+	pBlocks, err := VerifyRequiredBlocks(proof, params)
 	if err != nil {
 		fmt.Println("err:", err)
 		return
 	}
-	b := proof.VerifyProof(pBlocks)
+	b := proof.VerifyProof(pBlocks, nil)
 	fmt.Println("b:", b)
 	fmt.Println("finish:", count)
 }
+
+var (
+	benchOnce sync.Once
+	benchMmr  *Mmr
+)
+
+// benchMMR returns an MMR of a million leaves, shared by the benchmarks which
+// must not modify it.
+func benchMMR() *Mmr {
+	benchOnce.Do(func() {
+		benchMmr = NewMMR()
+		for i := 0; i < 1000000; i++ {
+			benchMmr.Push(NewNode(BytesToHash(IntToBytes(i)), big.NewInt(1000)))
+		}
+	})
+	return benchMmr
+}
+
+func BenchmarkPush(b *testing.B) {
+	m := benchMMR().Snapshot()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Push(NewNode(BytesToHash(IntToBytes(i)), big.NewInt(1000)))
+	}
+}
+
+func BenchmarkPop(b *testing.B) {
+	m := benchMMR().Snapshot()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if m.GetLeafNumber() == 1 {
+			b.StopTimer()
+			m = benchMMR().Snapshot()
+			b.StartTimer()
+		}
+		m.Pop()
+	}
+}
+
+func BenchmarkCreateNewProof(b *testing.B) {
+	m := benchMMR()
+	params := DefaultProofParams()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.CreateNewProof(params)
+	}
+}
+
+func TestPushBatch(t *testing.T) {
+	tests := []struct{ before, batch int }{
+		{0, 0}, {0, 1}, {0, 1024}, {0, 5000}, {1, 3000}, {1000, 2048}, {1024, 4096}, {3000, 10},
+	}
+	for _, tt := range tests {
+		want, have := NewMMR(), NewMMR()
+		disk, _ := OpenMMR(memorydb.New(), nil)
+		var leaves []*Node
+		for i := 0; i < tt.before+tt.batch; i++ {
+			want.Push(testLeaf(i))
+			if i < tt.before {
+				have.Push(testLeaf(i))
+				disk.Push(testLeaf(i))
+			} else {
+				leaves = append(leaves, testLeaf(i))
+			}
+		}
+		have.PushBatch(leaves)
+		disk.PushBatch(leaves)
+		for _, m := range []*Mmr{have, disk} {
+			checkSameMmr(t, want, m)
+			for pos := uint64(0); pos < want.GetSize(); pos++ {
+				if n := m.getNode(pos); n.getHash() != want.getNode(pos).getHash() || n.getIndex() != pos {
+					t.Fatalf("%d+%d leaves: node %d differs", tt.before, tt.batch, pos)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkPushBatch(b *testing.B) {
+	leaves := make([]*Node, 1000000)
+	for i := range leaves {
+		leaves[i] = NewNode(BytesToHash(IntToBytes(i)), big.NewInt(1000))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		NewMMR().PushBatch(leaves)
+	}
+}
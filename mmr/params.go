@@ -0,0 +1,139 @@
+package mmr
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+var (
+	ErrMissingParams = errors.New("proof carries no parameters")
+	ErrWeakParams    = errors.New("proof parameters are weaker than required")
+	ErrChainID       = errors.New("proof is for another chain")
+)
+
+// ProofParams are the security parameters of a FlyClient proof. The prover
+// picks them and records them in the proof, the verifier states the minimum
+// it accepts.
+type ProofParams struct {
+	// ChainID tells the proofs of different chains apart.
+	ChainID uint64
+	// Hasher and Merger are the hash function and payload schema of the
+	// chain's MMR. Provers take them from their MMR.
+	Hasher HasherID
+	Merger MergerID
+	// Lambda is the security parameter, an adversary succeeds with a
+	// probability of at most 2^-Lambda.
+	Lambda uint64
+	// C is the fraction of the honest chain's work an adversary is assumed
+	// to be able to produce, in (0, 1).
+	C float64
+	// RightDifficulty is the difficulty at the tail of the chain which is not
+	// sampled but has to be checked manually.
+	RightDifficulty *big.Int
+	// CheckpointInterval is the number of blocks between the sync points of
+	// the chain. Incremental proofs are only made for verifiers trusting an
+	// MMR from the oldest of the last MaxCheckpoints sync points on, others
+	// need a full proof.
+	CheckpointInterval uint64
+	MaxCheckpoints     uint64
+}
+
+// DefaultProofParams returns the parameters used unless configured otherwise.
+func DefaultProofParams() *ProofParams {
+	return &ProofParams{
+		ChainID:            1,
+		Lambda:             50,
+		C:                  0.5,
+		RightDifficulty:    big.NewInt(100000),
+		CheckpointInterval: 30000,
+		MaxCheckpoints:     10,
+	}
+}
+
+// Copy returns a deep copy of the parameters.
+func (p *ProofParams) Copy() *ProofParams {
+	cpy := *p
+	cpy.RightDifficulty = new(big.Int).Set(p.RightDifficulty)
+	return &cpy
+}
+
+// Validate checks that the parameters are usable.
+func (p *ProofParams) Validate() error {
+	switch {
+	case p.Lambda == 0:
+		return fmt.Errorf("%w: zero lambda", ErrProofMalformed)
+	case !(p.C > 0 && p.C < 1):
+		return fmt.Errorf("%w: c %v not in (0, 1)", ErrProofMalformed, p.C)
+	case p.RightDifficulty == nil || p.RightDifficulty.Sign() <= 0:
+		return fmt.Errorf("%w: invalid right difficulty", ErrProofMalformed)
+	case p.CheckpointInterval == 0:
+		return fmt.Errorf("%w: zero checkpoint interval", ErrProofMalformed)
+	}
+	return nil
+}
+
+// Covers reports whether proofs made with p are for the same chain and at
+// least as secure as ones made with required: they tolerate as strong an
+// adversary with as small a failure probability, and leave no more difficulty
+// unsampled.
+func (p *ProofParams) Covers(required *ProofParams) error {
+	switch {
+	case p.ChainID != required.ChainID:
+		return fmt.Errorf("%w: chain %d, want %d", ErrChainID, p.ChainID, required.ChainID)
+	case p.Hasher != required.Hasher:
+		return fmt.Errorf("%w: hasher %d, want %d", ErrHasherMismatch, p.Hasher, required.Hasher)
+	case p.Merger != required.Merger:
+		return fmt.Errorf("%w: merger %d, want %d", ErrMergerMismatch, p.Merger, required.Merger)
+	case p.Lambda < required.Lambda:
+		return fmt.Errorf("%w: lambda %d, want at least %d", ErrWeakParams, p.Lambda, required.Lambda)
+	case p.C < required.C:
+		return fmt.Errorf("%w: c %v, want at least %v", ErrWeakParams, p.C, required.C)
+	case p.RightDifficulty.Cmp(required.RightDifficulty) > 0:
+		return fmt.Errorf("%w: right difficulty %v, want at most %v", ErrWeakParams, p.RightDifficulty, required.RightDifficulty)
+	}
+	return nil
+}
+
+// requiredQueries returns the number of samples needed for leaves leaves
+// holding difficulty total. It follows vd_calculate_m in fixed point, so
+// prover and verifier agree on it on every platform:
+//
+//	m = (lambda + log2(c*n)) / log2(L/(L-K))
+//
+// with L = log2((total+right)/right) and K = log2(1/c). One sample is taken
+// more than m rounds down to, and at least one if m is not positive.
+func (p *ProofParams) requiredQueries(total *big.Int, leaves uint64) uint64 {
+	c, _ := new(big.Float).SetFloat64(p.C).Rat(nil)
+	k := fixedLog2(c.Denom(), c.Num())
+	l := fixedLog2(new(big.Int).Add(total, p.RightDifficulty), p.RightDifficulty)
+	if l.Cmp(k) <= 0 {
+		return 1
+	}
+	num := new(big.Int).Lsh(new(big.Int).SetUint64(p.Lambda), fixedBits)
+	num.Add(num, fixedLog2(new(big.Int).SetUint64(leaves), big.NewInt(1)))
+	num.Sub(num, k)
+	if num.Sign() <= 0 {
+		return 1
+	}
+	den := fixedLog2(l, new(big.Int).Sub(l, k))
+	return new(big.Int).Quo(num, den).Uint64() + 1
+}
+
+// checkpoints returns the sync points of an MMR with leaf_number leaves: the
+// first block of each of the last MaxCheckpoints complete intervals, newest
+// first.
+func (p *ProofParams) checkpoints(leaf_number uint64) []uint64 {
+	extra_blocks, current_block := []uint64{}, ((leaf_number-1)/p.CheckpointInterval)*p.CheckpointInterval
+	added := uint64(0)
+	for {
+		if current_block > p.CheckpointInterval && added < p.MaxCheckpoints {
+			extra_blocks = append(extra_blocks, current_block)
+			current_block -= p.CheckpointInterval
+			added += 1
+		} else {
+			break
+		}
+	}
+	return extra_blocks
+}
@@ -0,0 +1,89 @@
+package mmr
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/marcopoloprotocol/flyclientDemo/rlp"
+)
+
+// testParams are the default parameters with a right difficulty small enough
+// for test chains of a few thousand blocks of difficulty 1000.
+func testParams() *ProofParams {
+	params := DefaultProofParams()
+	params.RightDifficulty = big.NewInt(1000)
+	return params
+}
+
+func TestProofParams(t *testing.T) {
+	proof := newTestProof(1500)
+	enc, err := rlp.EncodeToBytes(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := new(ProofInfo)
+	if err := rlp.DecodeBytes(enc, dec); err != nil {
+		t.Fatal(err)
+	}
+	if dec.Params.RightDifficulty.Cmp(proof.Params.RightDifficulty) != 0 || dec.Params.C != proof.Params.C {
+		t.Fatalf("params mismatch: want %+v, got %+v", proof.Params, dec.Params)
+	}
+
+	// Stronger requirements than the proof was made with are refused.
+	tests := []func(p *ProofParams){
+		func(p *ProofParams) { p.Lambda++ },
+		func(p *ProofParams) { p.C = 0.6 },
+		func(p *ProofParams) { p.RightDifficulty = big.NewInt(999) },
+	}
+	for i, strengthen := range tests {
+		required := testParams()
+		strengthen(required)
+		if _, err := VerifyRequiredBlocks(dec, required); !errors.Is(err, ErrWeakParams) {
+			t.Errorf("test %d: have %v, want %v", i, err, ErrWeakParams)
+		}
+	}
+	// Weaker ones are fine, the proof is checked with its own parameters.
+	required := testParams()
+	required.Lambda, required.C = 40, 0.4
+	pBlocks, err := VerifyRequiredBlocks(dec, required)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dec.VerifyProof(pBlocks, nil) {
+		t.Fatal("valid proof rejected")
+	}
+
+	// Parameters weakened after the fact change the number of samples.
+	dec.Params.Lambda = 60
+	if _, err := VerifyRequiredBlocks(dec, testParams()); err == nil {
+		t.Fatal("proof with forged parameters accepted")
+	}
+	dec.Params = nil
+	if _, err := VerifyRequiredBlocks(dec, testParams()); err != ErrMissingParams {
+		t.Fatalf("no params: have %v, want %v", err, ErrMissingParams)
+	}
+}
+
+func TestRequiredQueries(t *testing.T) {
+	// The fixed-point count agrees with the floating-point formula up to
+	// rounding.
+	for _, c := range []float64{0.1, 0.5, 0.75, 0.9} {
+		for _, leaves := range []uint64{1, 2, 100, 1 << 20, 1 << 40} {
+			for _, total := range []int64{0, 500, 1000, 1e6, 1e12, 1e18} {
+				params := testParams()
+				params.C = c
+				r1 := float64(params.RightDifficulty.Int64())
+				m := vd_calculate_m(float64(params.Lambda), c, r1, r1+float64(total), leaves)
+				want := uint64(1)
+				if m > 0 {
+					want = uint64(m + 1.0)
+				}
+				have := params.requiredQueries(big.NewInt(total), leaves)
+				if have+1 < want || have > want+1 {
+					t.Errorf("c %v, %d leaves, total %d: have %d queries, want %d", c, leaves, total, have, want)
+				}
+			}
+		}
+	}
+}
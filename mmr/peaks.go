@@ -0,0 +1,70 @@
+package mmr
+
+import (
+	"math/big"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+)
+
+// The peaks of an MMR are the roots of its complete subtrees, from the largest
+// (leftmost) to the smallest. They are all that is needed to compute its root
+// or to append to it, which makes them a compact stand-in for MMRs that are
+// not materialized, such as the ones of side chains.
+
+func (n *Node) GetHash() common.Hash {
+	return n.getHash()
+}
+func (n *Node) GetDifficulty() *big.Int {
+	return n.getDifficulty()
+}
+func (n *Node) GetPayload() []byte {
+	return common.CopyBytes(n.getPayload())
+}
+
+// PeaksAt returns the peaks of the MMR made of the first leafNum leaves of m.
+// Complete subtrees never move once written, so they are read straight from m.
+func (m *Mmr) PeaksAt(leafNum uint64) []*Node {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.peaksAt(leafNum)
+}
+func (m *Mmr) peaksAt(leafNum uint64) []*Node {
+	if leafNum > m.leafNum {
+		return nil
+	}
+	positions := peak_positions(leafNum)
+	peaks := make([]*Node, len(positions))
+	for i, pos := range positions {
+		peaks[i] = m.getNode(pos)
+	}
+	return peaks
+}
+
+// AppendToPeaks returns the peaks of the MMR with the given peaks and leafNum
+// leaves after leaf has been appended to it. The peaks are merged with the
+// hasher and merger of m, its nodes are not used. The input slice is not
+// modified.
+func (m *Mmr) AppendToPeaks(peaks []*Node, leafNum uint64, leaf *Node) []*Node {
+	res := elemNodes(append(append(make([]*Node, 0, len(peaks)+1), peaks...), leaf))
+	// Appending a leaf carries like a binary increment of the leaf number.
+	for n := leafNum; n&1 == 1; n >>= 1 {
+		right := res.pop()
+		left := res.pop()
+		res.push(merge(m.hasher, m.merger, left, right))
+	}
+	return res
+}
+
+// BagPeaks folds the peaks from right to left into the root of their MMR, the
+// same way Push does. Like AppendToPeaks it only uses the hasher and merger of
+// m. It returns nil for an empty MMR.
+func (m *Mmr) BagPeaks(peaks []*Node) *Node {
+	if len(peaks) == 0 {
+		return nil
+	}
+	root := peaks[len(peaks)-1]
+	for i := len(peaks) - 2; i >= 0; i-- {
+		root = merge(m.hasher, m.merger, peaks[i], root)
+	}
+	return root
+}
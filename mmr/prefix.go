@@ -0,0 +1,81 @@
+package mmr
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+)
+
+var ErrProofShape = errors.New("proof does not match the shape of the mmr")
+
+// ProofLeaf is a leaf checked by a proof, together with the root of the MMR
+// over all leaves before it. A block header commits to exactly that root, so
+// comparing the two ties the sampled header to the proven MMR.
+type ProofLeaf struct {
+	Number           uint64
+	Hash             common.Hash
+	Difficulty       *big.Int
+	PrefixRoot       common.Hash // root of the MMR over leaves [0, Number)
+	PrefixDifficulty *big.Int    // total difficulty of leaves [0, Number)
+	Payload          []byte      // payload of the leaf, nil without a merger
+	PrefixPayload    []byte      // aggregated payload of leaves [0, Number), nil for the first leaf
+}
+
+// mergeRes returns the parent of two nodes of a proof.
+func mergeRes(h Hasher, g Merger, left, right *proofRes) *proofRes {
+	return &proofRes{
+		h:       mergeHash(h, left.h, right.h, left.td, right.td, left.payload, right.payload),
+		td:      new(big.Int).Add(left.td, right.td),
+		payload: mergePayload(g, left.payload, right.payload),
+	}
+}
+
+// bagProofRes folds peaks into the root of their MMR like BagPeaks.
+func bagProofRes(h Hasher, g Merger, peaks []*proofRes) *proofRes {
+	if len(peaks) == 0 {
+		return &proofRes{h: common.Hash{}, td: new(big.Int)}
+	}
+	root := peaks[len(peaks)-1]
+	for i := len(peaks) - 2; i >= 0; i-- {
+		root = mergeRes(h, g, peaks[i], root)
+	}
+	return root
+}
+
+// Leaves rebuilds the proven tree and returns the checked leaves in ascending
+// order, each with the root of the MMR preceding it. It fails unless the
+// proof recomputes to RootHash and RootDifficulty. The prefix roots of large
+// proofs are computed concurrently.
+func (p *ProofInfo) Leaves() ([]*ProofLeaf, error) {
+	t, err := p.Tree()
+	if err != nil {
+		return nil, err
+	}
+	return p.leavesOf(t), nil
+}
+
+// leavesOf returns the checked leaves of t, the proven tree of p.
+func (p *ProofInfo) leavesOf(t *ProofTree) []*ProofLeaf {
+	// Both are known, or Tree would have failed.
+	h, _ := HasherByID(p.Hasher)
+	g, _ := MergerByID(p.Merger)
+	leaves := make([]*ProofLeaf, t.count)
+	t.eachChecked(0, nil, func(i int, leaf *ProofTree, peaks []*ProofTree) {
+		path := make([]*proofRes, len(peaks))
+		for j, peak := range peaks {
+			path[j] = peak.res()
+		}
+		prefix := bagProofRes(h, g, path)
+		leaves[i] = &ProofLeaf{
+			Number:           leaf.Number,
+			Hash:             leaf.Hash,
+			Difficulty:       new(big.Int).Set(leaf.Difficulty),
+			PrefixRoot:       prefix.h,
+			PrefixDifficulty: prefix.td,
+			Payload:          common.CopyBytes(leaf.Payload),
+			PrefixPayload:    prefix.payload,
+		}
+	})
+	return leaves
+}
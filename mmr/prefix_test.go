@@ -0,0 +1,49 @@
+package mmr
+
+import (
+	"testing"
+)
+
+func TestProofLeaves(t *testing.T) {
+	for _, count := range []int{1, 2, 3, 7, 100, 1023, 1024, 1025, 2500} {
+		m := NewMMR()
+		for i := 0; i < count; i++ {
+			m.Push(testLeaf(i))
+		}
+		proof, _ := m.CreateNewProof(testParams())
+		leaves, err := proof.Leaves()
+		if err != nil {
+			t.Fatalf("%d leaves: %v", count, err)
+		}
+		if len(leaves) != len(SortAndRemoveRepeatForBlocks(proof.Checked)) {
+			t.Fatalf("%d leaves: got %d proof leaves for %v", count, len(leaves), proof.Checked)
+		}
+		for _, leaf := range leaves {
+			if leaf.Hash != testLeaf(int(leaf.Number)).GetHash() {
+				t.Fatalf("%d leaves: wrong hash for leaf %d", count, leaf.Number)
+			}
+			prefix := m.BagPeaks(m.PeaksAt(leaf.Number))
+			if leaf.Number == 0 {
+				if leaf.PrefixDifficulty.Sign() != 0 {
+					t.Fatalf("%d leaves: non-empty prefix for leaf 0", count)
+				}
+				continue
+			}
+			if leaf.PrefixRoot != prefix.GetHash() || leaf.PrefixDifficulty.Cmp(prefix.GetDifficulty()) != 0 {
+				t.Fatalf("%d leaves: wrong prefix root for leaf %d", count, leaf.Number)
+			}
+		}
+	}
+}
+
+func TestProofLeavesTampered(t *testing.T) {
+	m := NewMMR()
+	for i := 0; i < 300; i++ {
+		m.Push(testLeaf(i))
+	}
+	proof, _ := m.CreateNewProof(testParams())
+	proof.Elems[0].Res.h[0]++
+	if _, err := proof.Leaves(); err != ErrProofRootDiffer {
+		t.Fatalf("tampered proof: have %v, want %v", err, ErrProofRootDiffer)
+	}
+}
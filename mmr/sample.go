@@ -0,0 +1,100 @@
+package mmr
+
+import (
+	"math/big"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+)
+
+// fixedBits is the number of fractional bits of the fixed-point numbers used
+// for sampling.
+const fixedBits = 64
+
+var (
+	fixedOne = new(big.Int).Lsh(big.NewInt(1), fixedBits)
+	fixedTwo = new(big.Int).Lsh(big.NewInt(2), fixedBits)
+
+	// expTable[i] is 2^(-2^-(i+1)) in fixed point, derived by repeated
+	// integer square roots of 1/2.
+	expTable = func() []*big.Int {
+		table := make([]*big.Int, fixedBits)
+		v := new(big.Int).Rsh(fixedOne, 1)
+		for i := range table {
+			v = new(big.Int).Sqrt(new(big.Int).Lsh(v, fixedBits))
+			table[i] = v
+		}
+		return table
+	}()
+)
+
+// sampler maps transcript output to aggregated difficulties in [0, total),
+// following the same distribution as cdf: the share of difficulty after a
+// sample is (right/total)^y for y uniform in [0, 1), so recent blocks are
+// sampled more often. Only integer arithmetic is used, prover and verifier
+// agree bit for bit on every platform.
+type sampler struct {
+	total *big.Int
+	log   *big.Int // log2(total/right) in fixed point, 0 if right >= total
+}
+
+func newSampler(total, right *big.Int) *sampler {
+	return &sampler{total: total, log: fixedLog2(total, right)}
+}
+
+// sample returns the aggregated difficulty selected by h.
+func (s *sampler) sample(h common.Hash) *big.Int {
+	if s.total.Sign() <= 0 {
+		return new(big.Int)
+	}
+	// y is uniform in [0, 1), the tail left after the sample is
+	// total * 2^-(y * log).
+	y := new(big.Int).SetBytes(h[:fixedBits/8])
+	e := y.Mul(y, s.log)
+	e.Rsh(e, fixedBits)
+	tail := new(big.Int).Mul(s.total, fixedExp2Neg(e))
+	tail.Rsh(tail, fixedBits)
+
+	pos := new(big.Int).Sub(s.total, tail)
+	if pos.Cmp(s.total) >= 0 {
+		pos.Sub(s.total, big.NewInt(1))
+	}
+	return pos
+}
+
+// fixedLog2 returns log2(num/den) in fixed point for num > den > 0, and 0
+// otherwise.
+func fixedLog2(num, den *big.Int) *big.Int {
+	if den.Sign() <= 0 || num.Cmp(den) <= 0 {
+		return new(big.Int)
+	}
+	// Normalise num/den to z in [1, 2), the shift is the integer part.
+	k := num.BitLen() - den.BitLen()
+	if num.Cmp(new(big.Int).Lsh(den, uint(k))) < 0 {
+		k--
+	}
+	z := new(big.Int).Lsh(num, fixedBits)
+	z.Quo(z, new(big.Int).Lsh(den, uint(k)))
+
+	res := new(big.Int).Lsh(big.NewInt(int64(k)), fixedBits)
+	for i := fixedBits - 1; i >= 0; i-- {
+		z.Mul(z, z)
+		z.Rsh(z, fixedBits)
+		if z.Cmp(fixedTwo) >= 0 {
+			z.Rsh(z, 1)
+			res.SetBit(res, i, 1)
+		}
+	}
+	return res
+}
+
+// fixedExp2Neg returns 2^-e in fixed point, for e in fixed point.
+func fixedExp2Neg(e *big.Int) *big.Int {
+	res := new(big.Int).Set(fixedOne)
+	for i := 0; i < fixedBits; i++ {
+		if e.Bit(fixedBits-1-i) == 1 {
+			res.Mul(res, expTable[i])
+			res.Rsh(res, fixedBits)
+		}
+	}
+	return res.Rsh(res, uint(new(big.Int).Rsh(e, fixedBits).Uint64()))
+}
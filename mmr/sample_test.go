@@ -0,0 +1,81 @@
+package mmr
+
+import (
+	"encoding/binary"
+	"math"
+	"math/big"
+	"testing"
+)
+
+func fixedFloat(v *big.Int) float64 {
+	f, _ := new(big.Float).Quo(new(big.Float).SetInt(v), new(big.Float).SetInt(fixedOne)).Float64()
+	return f
+}
+
+func TestFixedPoint(t *testing.T) {
+	if got := fixedLog2(big.NewInt(8), big.NewInt(1)); got.Cmp(new(big.Int).Lsh(big.NewInt(3), fixedBits)) != 0 {
+		t.Errorf("log2(8) = %v", fixedFloat(got))
+	}
+	if got := fixedFloat(fixedLog2(big.NewInt(1000000), big.NewInt(7))); math.Abs(got-math.Log2(1000000.0/7)) > 1e-12 {
+		t.Errorf("log2(1000000/7) = %v, want %v", got, math.Log2(1000000.0/7))
+	}
+	if got := fixedLog2(big.NewInt(7), big.NewInt(7)); got.Sign() != 0 {
+		t.Errorf("log2(1) = %v", fixedFloat(got))
+	}
+	if got := fixedFloat(fixedExp2Neg(fixedOne)); got != 0.5 {
+		t.Errorf("2^-1 = %v", got)
+	}
+	e := new(big.Int).Add(new(big.Int).Lsh(big.NewInt(3), fixedBits), new(big.Int).Rsh(fixedOne, 2))
+	if got := fixedFloat(fixedExp2Neg(e)); math.Abs(got-math.Pow(2, -3.25)) > 1e-15 {
+		t.Errorf("2^-3.25 = %v, want %v", got, math.Pow(2, -3.25))
+	}
+}
+
+func TestSampler(t *testing.T) {
+	// The integer sampler follows the float distribution it replaces.
+	total, right := big.NewInt(1500000), big.NewInt(1000)
+	s, tr := newSampler(total, right), NewTranscript("test")
+	for i := uint64(0); i < 1000; i++ {
+		h := tr.Squeeze(i)
+		got, _ := new(big.Float).SetInt(s.sample(h)).Float64()
+		y := float64(binary.BigEndian.Uint64(h[:8])) / math.Pow(2, 64)
+		want := 1500000 * cdf(y, vd_calculate_delta(1000, 1500000))
+		if math.Abs(got-want) > 1 {
+			t.Fatalf("sample %d: have %v, want about %v", i, got, want)
+		}
+	}
+
+	// Difficulties far beyond int64 stay in range.
+	total = new(big.Int).Lsh(big.NewInt(1), 200)
+	s = newSampler(total, big.NewInt(1000))
+	for i := uint64(0); i < 1000; i++ {
+		if w := s.sample(tr.Squeeze(i)); w.Sign() < 0 || w.Cmp(total) >= 0 {
+			t.Fatalf("sample %d: %v out of range", i, w)
+		}
+	}
+	// Without difficulty to sample, the first leaf is taken.
+	if w := newSampler(big.NewInt(10), big.NewInt(1000)).sample(tr.Squeeze(0)); w.Sign() != 0 {
+		t.Fatalf("have %v, want 0", w)
+	}
+}
+
+func TestProofHugeDifficulty(t *testing.T) {
+	diff := new(big.Int).Lsh(big.NewInt(1), 80)
+	m := NewMMR()
+	for i := 0; i < 1000; i++ {
+		m.Push(NewNode(BytesToHash(IntToBytes(i)), diff))
+	}
+	params := DefaultProofParams()
+	params.RightDifficulty = diff
+	proof, _ := m.CreateNewProof(params)
+	pBlocks, err := VerifyRequiredBlocks(proof, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proof.VerifyProof(pBlocks, nil) {
+		t.Fatal("valid proof rejected")
+	}
+	if proof.Checked[len(proof.Checked)-1] < 900 {
+		t.Fatalf("recent blocks not sampled: %v", proof.Checked)
+	}
+}
@@ -0,0 +1,378 @@
+package mmr
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+	"github.com/marcopoloprotocol/flyclientDemo/diskdb"
+	"github.com/marcopoloprotocol/flyclientDemo/rlp"
+)
+
+// defaultCacheSize is the number of recently used nodes a disk backed MMR
+// keeps in memory. Peaks and the freshly rehashed right edge of the tree are
+// the hot nodes, so a small cache is enough.
+const defaultCacheSize = 1024
+
+var (
+	nodeKeyPrefix = []byte("n") // nodeKeyPrefix + pos (uint64 big endian) -> node
+	metaKey       = []byte("meta")
+
+	ErrMissingNode = errors.New("mmr node missing from database")
+)
+
+// nodeStore is the backend holding the nodes of an Mmr by position. Nodes are
+// only ever appended at the end or truncated from the end. Stores shared by
+// snapshots are read while their Mmr is written, so get must be safe to call
+// concurrently with the other methods.
+type nodeStore interface {
+	get(pos uint64) *Node
+	append(n *Node)
+	truncate(size uint64)
+	size() uint64
+	flush() error
+}
+
+// memStore keeps all nodes in a slice, it is the default backend.
+type memStore struct {
+	lock   sync.RWMutex
+	values []*Node
+}
+
+func (s *memStore) get(pos uint64) *Node {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if pos >= uint64(len(s.values)) {
+		return nil
+	}
+	return s.values[pos]
+}
+func (s *memStore) append(n *Node) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.values = append(s.values, n)
+}
+func (s *memStore) truncate(size uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if size < uint64(len(s.values)) {
+		s.values = s.values[:size]
+	}
+}
+func (s *memStore) size() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return uint64(len(s.values))
+}
+func (s *memStore) flush() error {
+	return nil
+}
+
+// storedNode is the database representation of a Node, its position is
+// implied by the key. Payload holds the payload if the node has one.
+type storedNode struct {
+	Hash       common.Hash
+	Difficulty *big.Int
+	Payload    [][]byte `rlp:"tail"`
+}
+
+func newStoredNode(n *Node) *storedNode {
+	sn := &storedNode{Hash: n.value, Difficulty: n.difficulty}
+	if n.payload != nil {
+		sn.Payload = [][]byte{n.payload}
+	}
+	return sn
+}
+
+func (sn *storedNode) node(pos uint64) *Node {
+	n := &Node{value: sn.Hash, difficulty: sn.Difficulty, index: pos}
+	if len(sn.Payload) > 0 {
+		n.payload = sn.Payload[0]
+	}
+	return n
+}
+
+// storedMeta is written next to the nodes so the MMR can be reopened.
+type storedMeta struct {
+	Size    uint64
+	LeafNum uint64
+	Hasher  HasherID
+	Merger  MergerID
+}
+
+// nodeCache is a tiny LRU cache of decoded nodes.
+type nodeCache struct {
+	limit int
+	ll    *list.List
+	items map[uint64]*list.Element
+}
+
+func newNodeCache(limit int) *nodeCache {
+	return &nodeCache{
+		limit: limit,
+		ll:    list.New(),
+		items: make(map[uint64]*list.Element),
+	}
+}
+func (c *nodeCache) get(pos uint64) *Node {
+	if e, ok := c.items[pos]; ok {
+		c.ll.MoveToFront(e)
+		return e.Value.(*Node)
+	}
+	return nil
+}
+func (c *nodeCache) add(n *Node) {
+	if e, ok := c.items[n.index]; ok {
+		e.Value = n
+		c.ll.MoveToFront(e)
+		return
+	}
+	c.items[n.index] = c.ll.PushFront(n)
+	if c.ll.Len() > c.limit {
+		last := c.ll.Back()
+		c.ll.Remove(last)
+		delete(c.items, last.Value.(*Node).index)
+	}
+}
+func (c *nodeCache) remove(pos uint64) {
+	if e, ok := c.items[pos]; ok {
+		c.ll.Remove(e)
+		delete(c.items, pos)
+	}
+}
+
+// dbStore keeps the nodes in a key-value database under a key prefix. Writes
+// are gathered in a batch which is flushed whenever it grows beyond
+// diskdb.IdealBatchSize, or explicitly through Mmr.Flush. Even reads update
+// the cache, so all methods take the lock.
+type dbStore struct {
+	lock   sync.Mutex
+	db     diskdb.Database
+	prefix []byte
+	batch  diskdb.Batch
+	dirty  map[uint64]*Node // nodes written to the batch but not yet to db
+	cache  *nodeCache
+	count  uint64
+	err    error // first write error, reported by flush
+}
+
+func newDBStore(db diskdb.Database, prefix []byte) *dbStore {
+	return &dbStore{
+		db:     db,
+		prefix: common.CopyBytes(prefix),
+		batch:  db.NewBatch(),
+		dirty:  make(map[uint64]*Node),
+		cache:  newNodeCache(defaultCacheSize),
+	}
+}
+
+func (s *dbStore) nodeKey(pos uint64) []byte {
+	key := make([]byte, len(s.prefix)+len(nodeKeyPrefix)+8)
+	n := copy(key, s.prefix)
+	n += copy(key[n:], nodeKeyPrefix)
+	binary.BigEndian.PutUint64(key[n:], pos)
+	return key
+}
+func (s *dbStore) metaKey() []byte {
+	return append(common.CopyBytes(s.prefix), metaKey...)
+}
+
+func (s *dbStore) get(pos uint64) *Node {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if pos >= s.count {
+		return nil
+	}
+	if n, ok := s.dirty[pos]; ok {
+		return n
+	}
+	if n := s.cache.get(pos); n != nil {
+		return n
+	}
+	enc, err := s.db.Get(s.nodeKey(pos))
+	if err != nil {
+		panic(fmt.Sprintf("%v: pos %d: %v", ErrMissingNode, pos, err))
+	}
+	var sn storedNode
+	if err := rlp.DecodeBytes(enc, &sn); err != nil {
+		panic(fmt.Sprintf("corrupted mmr node at pos %d: %v", pos, err))
+	}
+	n := sn.node(pos)
+	s.cache.add(n)
+	return n
+}
+
+func (s *dbStore) append(n *Node) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pos := s.count
+	enc, err := rlp.EncodeToBytes(newStoredNode(n))
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+	s.batch.Put(s.nodeKey(pos), enc)
+	s.dirty[pos] = n
+	s.count++
+	if s.batch.ValueSize() >= diskdb.IdealBatchSize {
+		s.write()
+	}
+}
+
+// truncate drops the nodes from size on. They are left in the database, past
+// the size stored in the meta they are never read and appends overwrite them,
+// while a crash before the meta is written again must still find every node
+// of the size it has.
+func (s *dbStore) truncate(size uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for pos := size; pos < s.count; pos++ {
+		delete(s.dirty, pos)
+		s.cache.remove(pos)
+	}
+	if size < s.count {
+		s.count = size
+	}
+}
+
+func (s *dbStore) size() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.count
+}
+
+// write pushes the pending batch into the database, keeping the written nodes
+// hot in the cache. A batch failing to write is kept with its nodes, so they
+// can still be read, and popped after the error is seen. The lock must be
+// held.
+func (s *dbStore) write() {
+	if err := s.batch.Write(); err != nil {
+		if s.err == nil {
+			s.err = err
+		}
+		return
+	}
+	s.batch.Reset()
+	for _, n := range s.dirty {
+		s.cache.add(n)
+	}
+	s.dirty = make(map[uint64]*Node)
+}
+
+func (s *dbStore) flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.write()
+	return s.err
+}
+
+func (s *dbStore) writeMeta(leafNum uint64, hasher HasherID, merger MergerID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	enc, err := rlp.EncodeToBytes(&storedMeta{Size: s.count, LeafNum: leafNum, Hasher: hasher, Merger: merger})
+	if err != nil {
+		return err
+	}
+	s.batch.Put(s.metaKey(), enc)
+	s.write()
+	return s.err
+}
+
+func (s *dbStore) readMeta() (*storedMeta, error) {
+	ok, err := s.db.Has(s.metaKey())
+	if err != nil || !ok {
+		return nil, err
+	}
+	enc, err := s.db.Get(s.metaKey())
+	if err != nil {
+		return nil, err
+	}
+	meta := new(storedMeta)
+	if err := rlp.DecodeBytes(enc, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// OpenMMR opens the MMR stored in db under the given key prefix with the hash
+// function and merger it was created with, creating an empty one hashing with
+// SHA3 and without payloads if nothing has been stored yet. Changes are
+// written through diskdb batches; call Flush to make them durable.
+func OpenMMR(db diskdb.Database, prefix []byte) (*Mmr, error) {
+	return openMMR(db, prefix, nil, nil, false)
+}
+
+// OpenMMRWithHasher is like OpenMMR, but creates the MMR with the hasher h. A
+// stored MMR must have been created with it too.
+func OpenMMRWithHasher(db diskdb.Database, prefix []byte, h Hasher) (*Mmr, error) {
+	return openMMR(db, prefix, h, nil, true)
+}
+
+// OpenMMRWithMerger is like OpenMMRWithHasher, but the nodes carry payloads
+// aggregated by g.
+func OpenMMRWithMerger(db diskdb.Database, prefix []byte, h Hasher, g Merger) (*Mmr, error) {
+	return openMMR(db, prefix, h, g, true)
+}
+
+// openMMR opens the MMR, with the given hasher and merger if check is set.
+func openMMR(db diskdb.Database, prefix []byte, h Hasher, g Merger, check bool) (*Mmr, error) {
+	s := newDBStore(db, prefix)
+	meta, err := s.readMeta()
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil {
+		if h == nil {
+			h = SHA3
+		}
+		return &Mmr{values: s, hasher: h, merger: g}, nil
+	}
+	stored, err := HasherByID(meta.Hasher)
+	if err != nil {
+		return nil, err
+	}
+	merger, err := MergerByID(meta.Merger)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case check && h.ID() != stored.ID():
+		return nil, fmt.Errorf("%w: mmr stored with hasher %d, want %d", ErrHasherMismatch, stored.ID(), h.ID())
+	case check && mergerID(g) != meta.Merger:
+		return nil, fmt.Errorf("%w: mmr stored with merger %d, want %d", ErrMergerMismatch, meta.Merger, mergerID(g))
+	}
+	m := &Mmr{values: s, hasher: stored, merger: merger}
+	if meta.Size != leaf_to_mmr_size(meta.LeafNum) {
+		return nil, fmt.Errorf("corrupted mmr meta: size %d for %d leaves", meta.Size, meta.LeafNum)
+	}
+	s.count, m.leafNum, m.curSize = meta.Size, meta.LeafNum, meta.Size
+	// Load the peaks and the root into the cache, making sure they are there.
+	positions := append(peak_positions(m.leafNum), meta.Size-1)
+	for _, pos := range positions {
+		enc, err := db.Get(s.nodeKey(pos))
+		if err != nil {
+			return nil, fmt.Errorf("%w: peak %d: %v", ErrMissingNode, pos, err)
+		}
+		var sn storedNode
+		if err := rlp.DecodeBytes(enc, &sn); err != nil {
+			return nil, err
+		}
+		s.cache.add(sn.node(pos))
+	}
+	return m, nil
+}
+
+// Flush writes all pending changes of a disk backed MMR to its database,
+// together with the metadata needed to reopen it. It is a no-op for in-memory
+// MMRs.
+func (m *Mmr) Flush() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if s, ok := m.values.(*dbStore); ok {
+		return s.writeMeta(m.leafNum, m.hasher.ID(), mergerID(m.merger))
+	}
+	return m.values.flush()
+}
@@ -0,0 +1,123 @@
+package mmr
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/marcopoloprotocol/flyclientDemo/diskdb"
+	"github.com/marcopoloprotocol/flyclientDemo/diskdb/lvldb"
+	"github.com/marcopoloprotocol/flyclientDemo/diskdb/memorydb"
+)
+
+func testLeaf(i int) *Node {
+	return NewNode(BytesToHash(IntToBytes(i)), big.NewInt(int64(1000+i)))
+}
+
+func checkSameMmr(t *testing.T, want, got *Mmr) {
+	t.Helper()
+	if want.GetSize() != got.GetSize() || want.getLeafNumber() != got.getLeafNumber() {
+		t.Fatalf("size mismatch: want %d/%d, got %d/%d", want.GetSize(), want.getLeafNumber(),
+			got.GetSize(), got.getLeafNumber())
+	}
+	if want.GetRoot() != got.GetRoot() || want.GetRootDifficulty().Cmp(got.GetRootDifficulty()) != 0 {
+		t.Fatalf("root mismatch at %d leaves: want %v, got %v", want.getLeafNumber(),
+			want.GetRootNode(), got.GetRootNode())
+	}
+}
+
+func testDiskMmr(t *testing.T, db diskdb.Database) {
+	mem := NewMMR()
+	disk, err := OpenMMR(db, []byte("m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3000; i++ {
+		mem.Push(testLeaf(i))
+		disk.Push(testLeaf(i))
+		checkSameMmr(t, mem, disk)
+		if i%7 == 0 {
+			mem.Pop()
+			disk.Pop()
+			checkSameMmr(t, mem, disk)
+		}
+	}
+	if err := disk.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenMMR(db, []byte("m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameMmr(t, mem, reopened)
+	for i := 3000; i < 3100; i++ {
+		mem.Push(testLeaf(i))
+		reopened.Push(testLeaf(i))
+	}
+	checkSameMmr(t, mem, reopened)
+
+	proof, _ := reopened.CreateNewProof(testParams())
+	pBlocks, err := VerifyRequiredBlocks(proof, testParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proof.VerifyProof(pBlocks, nil) {
+		t.Fatal("proof from reopened mmr does not verify")
+	}
+}
+
+func TestDiskMmrMemoryDB(t *testing.T) {
+	testDiskMmr(t, memorydb.New())
+}
+
+func TestDiskMmrLevelDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mmr-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := lvldb.New(dir, 16, 16, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	testDiskMmr(t, db)
+}
+
+func TestDiskMmrUnflushed(t *testing.T) {
+	db := memorydb.New()
+	m, _ := OpenMMR(db, nil)
+	for i := 0; i < 10; i++ {
+		m.Push(testLeaf(i))
+	}
+	// Nothing was flushed, so reopening yields an empty MMR.
+	reopened, err := OpenMMR(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.getLeafNumber() != 0 {
+		t.Fatalf("unflushed mmr reopened with %d leaves", reopened.getLeafNumber())
+	}
+}
+
+func TestPeaks(t *testing.T) {
+	m := NewMMR()
+	var peaks []*Node
+	for i := 0; i < 600; i++ {
+		peaks = m.AppendToPeaks(peaks, uint64(i), testLeaf(i))
+		m.Push(testLeaf(i))
+		if root := m.BagPeaks(peaks); root.GetHash() != m.GetRoot() || root.GetDifficulty().Cmp(m.GetRootDifficulty()) != 0 {
+			t.Fatalf("bagged peaks differ from root at %d leaves", i+1)
+		}
+	}
+	for k := uint64(1); k <= m.GetLeafNumber(); k++ {
+		want := NewMMR()
+		for i := 0; i < int(k); i++ {
+			want.Push(testLeaf(i))
+		}
+		if m.BagPeaks(m.PeaksAt(k)).GetHash() != want.GetRoot() {
+			t.Fatalf("prefix root mismatch at %d leaves", k)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package mmr
+
+import (
+	"math/big"
+	"sort"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+)
+
+// Domain tags separating the transcripts of the different kinds of proofs.
+const (
+	proofDomain       = "flyclient/proof"
+	incrementalDomain = "flyclient/incremental"
+	compareDomain     = "flyclient/compare"
+)
+
+// Transcript derives the randomness of a non-interactive proof from all the
+// proof commits to (Fiat-Shamir). Prover and verifier absorb the same values
+// in the same order, then squeeze one random value per query. Changing any
+// absorbed value changes all of them.
+type Transcript struct {
+	state common.Hash
+}
+
+// NewTranscript starts a transcript for the given domain.
+func NewTranscript(domain string) *Transcript {
+	return &Transcript{state: RlpHash([]interface{}{"transcript", domain})}
+}
+
+// Absorb mixes a labelled, rlp encodable value into the transcript.
+func (t *Transcript) Absorb(label string, v interface{}) {
+	t.state = RlpHash([]interface{}{t.state, label, v})
+}
+
+// AbsorbRoot mixes the root hash, total difficulty and leaf count of an MMR
+// into the transcript.
+func (t *Transcript) AbsorbRoot(label string, r *Root) {
+	t.Absorb(label, []interface{}{r.Hash, r.LeafNumber, nonNil(r.Difficulty)})
+}
+
+// AbsorbParams mixes the proof parameters, the chain ID among them, into the
+// transcript.
+func (t *Transcript) AbsorbParams(p *ProofParams) {
+	t.Absorb("params", p.toRLP())
+}
+
+// Squeeze returns the random value of query i. It does not change the
+// transcript, so queries can be drawn in any order.
+func (t *Transcript) Squeeze(i uint64) common.Hash {
+	return RlpHash([]interface{}{t.state, "squeeze", i})
+}
+
+func nonNil(v *big.Int) *big.Int {
+	if v == nil {
+		return new(big.Int)
+	}
+	return v
+}
+
+// proofTranscript returns the transcript of a FlyClient proof of root.
+func proofTranscript(root *Root, params *ProofParams) *Transcript {
+	t := NewTranscript(proofDomain)
+	t.AbsorbRoot("root", root)
+	t.AbsorbParams(params)
+	return t
+}
+
+// proofWeights returns the aggregated difficulties a FlyClient proof of root
+// samples, in ascending order.
+func proofWeights(root *Root, params *ProofParams) []*big.Int {
+	t := proofTranscript(root, params)
+	s := newSampler(root.Difficulty, params.RightDifficulty)
+	required_queries := params.requiredQueries(root.Difficulty, root.LeafNumber)
+
+	weights := make([]*big.Int, 0, required_queries)
+	for i := uint64(0); i < required_queries; i++ {
+		weights = append(weights, s.sample(t.Squeeze(i)))
+	}
+	sort.Slice(weights, func(i, j int) bool { return weights[i].Cmp(weights[j]) < 0 })
+	return weights
+}
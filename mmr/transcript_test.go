@@ -0,0 +1,61 @@
+package mmr
+
+import (
+	"errors"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+)
+
+func TestTranscript(t *testing.T) {
+	root := &Root{Hash: common.Hash{1}, Difficulty: big.NewInt(1500000), LeafNumber: 1500}
+	want := proofWeights(root, testParams())
+	if !reflect.DeepEqual(want, proofWeights(root, testParams())) {
+		t.Fatal("sampling is not deterministic")
+	}
+
+	// Every absorbed value changes the sampled set.
+	tests := []func(r *Root, p *ProofParams){
+		func(r *Root, p *ProofParams) { r.Hash[0]++ },
+		func(r *Root, p *ProofParams) { r.LeafNumber++ },
+		func(r *Root, p *ProofParams) { r.Difficulty = big.NewInt(1500001) },
+		func(r *Root, p *ProofParams) { p.ChainID++ },
+		func(r *Root, p *ProofParams) { p.Lambda++ },
+		func(r *Root, p *ProofParams) { p.C = 0.6 },
+		func(r *Root, p *ProofParams) { p.RightDifficulty = big.NewInt(1001) },
+		func(r *Root, p *ProofParams) { p.CheckpointInterval++ },
+		func(r *Root, p *ProofParams) { p.MaxCheckpoints++ },
+	}
+	for i, change := range tests {
+		r, p := *root, testParams()
+		change(&r, p)
+		got := proofWeights(&r, p)
+		if reflect.DeepEqual(want, got) {
+			t.Errorf("test %d: sampled set unchanged", i)
+		}
+	}
+
+	// So does the domain.
+	a, b := proofTranscript(root, testParams()), NewTranscript(incrementalDomain)
+	b.AbsorbRoot("root", root)
+	b.AbsorbParams(testParams())
+	if a.Squeeze(0) == b.Squeeze(0) {
+		t.Error("domains are not separated")
+	}
+}
+
+func TestTranscriptChainID(t *testing.T) {
+	proof := newTestProof(1500)
+	required := testParams()
+	required.ChainID++
+	if _, err := VerifyRequiredBlocks(proof, required); !errors.Is(err, ErrChainID) {
+		t.Fatalf("have %v, want %v", err, ErrChainID)
+	}
+	// Relabelling the proof for another chain invalidates its samples.
+	proof.Params.ChainID++
+	if pBlocks, err := VerifyRequiredBlocks(proof, required); err == nil && proof.VerifyProof(pBlocks, nil) {
+		t.Fatal("relabelled proof accepted")
+	}
+}
@@ -0,0 +1,206 @@
+package mmr
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+)
+
+// forkMin is the number of checked leaves from which the two halves of a
+// proof tree are processed in separate goroutines. Smaller subtrees are not
+// worth the scheduling.
+const forkMin = 64
+
+// fork runs f and g, concurrently if they cover at least forkMin checked
+// leaves together.
+func fork(checked int, f, g func()) {
+	if checked < forkMin {
+		f()
+		g()
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		f()
+	}()
+	g()
+	wg.Wait()
+}
+
+// ProofTree is the part of an MMR revealed by a proof, shaped like the MMR
+// itself. Inner nodes have both children. The others are either checked
+// leaves or the roots of subtrees holding no checked leaf, which the proof
+// gives as is. The flat ProofInfo.Elems list is the depth first encoding of
+// the tree, see ProofInfo.Tree.
+type ProofTree struct {
+	Hash       common.Hash
+	Difficulty *big.Int
+	Payload    []byte // aggregate of the proof's Merger, nil without one
+	Number     uint64 // first leaf of the subtree
+	Leaves     uint64 // number of leaves of the subtree
+	Checked    bool   // the subtree is a checked leaf
+	Left       *ProofTree
+	Right      *ProofTree
+
+	count int // number of checked leaves in the subtree
+}
+
+// proofTree returns the proof tree of the subtree with n leaves starting at
+// leaf lo, whose nodes start at position off, for the given sorted checked
+// leaves. The nodes are read from m, the halves of large subtrees
+// concurrently.
+func (m *Mmr) proofTree(off, n, lo uint64, blocks []uint64) *ProofTree {
+	root := m.getNode(off + leaf_to_node_number(n) - 1)
+	t := &ProofTree{
+		Hash:       root.getHash(),
+		Difficulty: root.getDifficulty(),
+		Payload:    root.getPayload(),
+		Number:     lo,
+		Leaves:     n,
+		Checked:    n == 1 && len(blocks) == 1,
+		count:      len(blocks),
+	}
+	if n == 1 || len(blocks) == 0 {
+		return t
+	}
+	left_leaf_number := get_left_leaf_number(n)
+	split := sort.Search(len(blocks), func(i int) bool { return blocks[i] >= lo+left_leaf_number })
+	fork(len(blocks), func() {
+		t.Left = m.proofTree(off, left_leaf_number, lo, blocks[:split])
+	}, func() {
+		t.Right = m.proofTree(off+leaf_to_node_number(left_leaf_number), n-left_leaf_number,
+			lo+left_leaf_number, blocks[split:])
+	})
+	return t
+}
+
+// elems appends the elements encoding t, a right child if right, to elems.
+func (t *ProofTree) elems(elems []*ProofElem, right bool) []*ProofElem {
+	switch {
+	case t.Checked:
+		return append(elems, &ProofElem{Cat: 2, Res: t.res()})
+	case t.Left == nil:
+		return append(elems, &ProofElem{Cat: 1, Right: right, Res: t.res()})
+	}
+	return t.Right.elems(t.Left.elems(elems, false), true)
+}
+
+func (t *ProofTree) res() *proofRes {
+	return &proofRes{h: t.Hash, td: t.Difficulty, payload: t.Payload}
+}
+
+// treeReader decodes a proof tree from the elements of a proof, which are
+// written depth first.
+type treeReader struct {
+	elems []*ProofElem
+	pos   int
+}
+
+func (r *treeReader) next() (*ProofElem, error) {
+	if r.pos >= len(r.elems) {
+		return nil, fmt.Errorf("%w: proof too short", ErrProofShape)
+	}
+	e := r.elems[r.pos]
+	r.pos++
+	return e, nil
+}
+
+// read decodes the subtree with n leaves starting at leaf lo, which contains
+// the given checked leaves. Inner nodes are left to be hashed by rehash.
+func (r *treeReader) read(n, lo uint64, blocks []uint64, right bool) (*ProofTree, error) {
+	t := &ProofTree{Number: lo, Leaves: n, count: len(blocks)}
+	if n == 1 || len(blocks) == 0 {
+		e, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case len(blocks) == 0 && (e.Cat != 1 || e.Right != right):
+			return nil, fmt.Errorf("%w: expected node at elem %d", ErrProofShape, r.pos-1)
+		case len(blocks) != 0 && (e.Cat != 2 || len(blocks) != 1 || blocks[0] != lo):
+			return nil, fmt.Errorf("%w: expected leaf %d at elem %d", ErrProofShape, lo, r.pos-1)
+		}
+		t.Hash, t.Difficulty, t.Payload, t.Checked = e.Res.h, e.Res.td, e.Res.payload, e.Cat == 2
+		return t, nil
+	}
+	left_leaf_number := get_left_leaf_number(n)
+	split := sort.Search(len(blocks), func(i int) bool { return blocks[i] >= lo+left_leaf_number })
+	var err error
+	if t.Left, err = r.read(left_leaf_number, lo, blocks[:split], false); err != nil {
+		return nil, err
+	}
+	if t.Right, err = r.read(n-left_leaf_number, lo+left_leaf_number, blocks[split:], true); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// rehash computes the inner nodes of t from the leaves and siblings up,
+// hashing with h and merging payloads with g.
+func (t *ProofTree) rehash(h Hasher, g Merger) {
+	if t.Left == nil {
+		return
+	}
+	fork(t.count, func() { t.Left.rehash(h, g) }, func() { t.Right.rehash(h, g) })
+	t.Hash = mergeHash(h, t.Left.Hash, t.Right.Hash, t.Left.Difficulty, t.Right.Difficulty, t.Left.Payload, t.Right.Payload)
+	t.Difficulty = new(big.Int).Add(t.Left.Difficulty, t.Right.Difficulty)
+	t.Payload = mergePayload(g, t.Left.Payload, t.Right.Payload)
+}
+
+// eachChecked calls visit for every checked leaf of t with its index among
+// them, counting from first, and the subtrees left of it from the largest to
+// the smallest, i.e. the peaks of the MMR before the leaf. Calls for
+// different leaves may be concurrent.
+func (t *ProofTree) eachChecked(first int, peaks []*ProofTree, visit func(i int, leaf *ProofTree, peaks []*ProofTree)) {
+	switch {
+	case t.Checked:
+		visit(first, t, peaks)
+	case t.Left != nil:
+		fork(t.count, func() {
+			t.Left.eachChecked(first, peaks, visit)
+		}, func() {
+			t.Right.eachChecked(first+t.Left.count, append(peaks[:len(peaks):len(peaks)], t.Left), visit)
+		})
+	}
+}
+
+// Tree decodes the proof into a tree and rehashes it with the hash function
+// and merger recorded in the proof, concurrently for large proofs. It fails
+// unless the tree recomputes to RootHash, RootDifficulty and RootPayload.
+func (p *ProofInfo) Tree() (*ProofTree, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	h, err := HasherByID(p.Hasher)
+	if err != nil {
+		return nil, err
+	}
+	g, err := MergerByID(p.Merger)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range p.Elems {
+		if err := checkPayload(g, e.Res.payload); err != nil {
+			return nil, fmt.Errorf("elem %d: %w", i, err)
+		}
+	}
+	r := &treeReader{elems: p.Elems[:len(p.Elems)-1]}
+	t, err := r.read(p.LeafNumber, 0, SortAndRemoveRepeatForBlocks(append([]uint64{}, p.Checked...)), false)
+	if err != nil {
+		return nil, err
+	}
+	if r.pos != len(r.elems) {
+		return nil, fmt.Errorf("%w: %d trailing elements", ErrProofShape, len(r.elems)-r.pos)
+	}
+	t.rehash(h, g)
+	if !equal_hash(t.Hash, p.RootHash) || t.Difficulty.Cmp(p.RootDifficulty) != 0 || !bytes.Equal(t.Payload, p.RootPayload) {
+		return nil, ErrProofRootDiffer
+	}
+	return t, nil
+}
@@ -0,0 +1,176 @@
+package mmr
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime/debug"
+	"testing"
+)
+
+func TestProofTree(t *testing.T) {
+	for _, count := range []int{1, 2, 3, 100, 1025, 20000} {
+		m := NewMMR()
+		for i := 0; i < count; i++ {
+			m.Push(testLeaf(i))
+		}
+		proof, _ := m.CreateNewProof(testParams())
+		tree, err := proof.Tree()
+		if err != nil {
+			t.Fatalf("%d leaves: %v", count, err)
+		}
+		if tree.Leaves != uint64(count) || tree.Hash != m.GetRoot() {
+			t.Fatalf("%d leaves: wrong tree root", count)
+		}
+		// The tree encodes back to the elements it was read from.
+		elems := tree.elems(nil, false)
+		if len(elems) != len(proof.Elems)-1 {
+			t.Fatalf("%d leaves: %d elems, want %d", count, len(elems), len(proof.Elems)-1)
+		}
+		for i, e := range elems {
+			if e.String() != proof.Elems[i].String() {
+				t.Fatalf("%d leaves: elem %d is %v, want %v", count, i, e, proof.Elems[i])
+			}
+		}
+		checked := SortAndRemoveRepeatForBlocks(append([]uint64{}, proof.Checked...))
+		if tree.count != len(checked) {
+			t.Fatalf("%d leaves: %d checked leaves, want %d", count, tree.count, len(checked))
+		}
+		visited := make([]uint64, len(checked))
+		tree.eachChecked(0, nil, func(i int, leaf *ProofTree, peaks []*ProofTree) {
+			visited[i] = leaf.Number
+		})
+		for i := range checked {
+			if visited[i] != checked[i] {
+				t.Fatalf("%d leaves: checked leaf %d is %d, want %d", count, i, visited[i], checked[i])
+			}
+		}
+	}
+}
+
+func TestVerifyProofTampered(t *testing.T) {
+	m := NewMMR()
+	for i := 0; i < 5000; i++ {
+		m.Push(testLeaf(i))
+	}
+	params := testParams()
+	fresh := func() (*ProofInfo, []*ProofBlock) {
+		proof, _ := m.CreateNewProof(params)
+		pBlocks, err := VerifyRequiredBlocks(proof, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proof, pBlocks
+	}
+	if proof, pBlocks := fresh(); !proof.VerifyProof(pBlocks, nil) {
+		t.Fatal("valid proof rejected")
+	}
+	tests := []func(p *ProofInfo, blocks []*ProofBlock) []*ProofBlock{
+		// a sampled weight outside of its block
+		func(p *ProofInfo, blocks []*ProofBlock) []*ProofBlock {
+			last := blocks[len(blocks)-1]
+			last.AggrWeight = new(big.Int).Add(p.RootDifficulty, big.NewInt(1))
+			return blocks
+		},
+		// a sampled block missing
+		func(p *ProofInfo, blocks []*ProofBlock) []*ProofBlock {
+			return blocks[1:]
+		},
+		// a sibling swapped for another
+		func(p *ProofInfo, blocks []*ProofBlock) []*ProofBlock {
+			for _, e := range p.Elems {
+				if e.Cat == 1 {
+					e.Res = &proofRes{h: e.Res.h, td: new(big.Int).Add(e.Res.td, big.NewInt(1))}
+					break
+				}
+			}
+			return blocks
+		},
+		// the elements out of order
+		func(p *ProofInfo, blocks []*ProofBlock) []*ProofBlock {
+			p.Elems[0], p.Elems[1] = p.Elems[1], p.Elems[0]
+			return blocks
+		},
+	}
+	for i, tamper := range tests {
+		proof, pBlocks := fresh()
+		if proof.VerifyProof(tamper(proof, pBlocks), nil) {
+			t.Errorf("test %d: tampered proof accepted", i)
+		}
+	}
+	// Difficulty moved onto a sibling changes the root hash, even if the root
+	// difficulty is raised to match.
+	proof, _ := fresh()
+	extra := big.NewInt(10000000)
+	for _, e := range proof.Elems {
+		if e.Cat == 1 {
+			e.Res = &proofRes{h: e.Res.h, td: new(big.Int).Add(e.Res.td, extra)}
+			break
+		}
+	}
+	proof.RootDifficulty = new(big.Int).Add(proof.RootDifficulty, extra)
+	if _, err := proof.Tree(); !errors.Is(err, ErrProofRootDiffer) {
+		t.Fatalf("sibling difficulty raised: have %v, want %v", err, ErrProofRootDiffer)
+	}
+
+	proof, _ = fresh()
+	proof.Elems = proof.Elems[1:]
+	if _, err := proof.Tree(); err == nil || errors.Is(err, ErrProofRootDiffer) {
+		t.Fatalf("truncated proof: have %v, want a shape error", err)
+	}
+}
+
+var treeBenchMmrs = make(map[int]*Mmr)
+
+// treeBenchMMR returns an MMR with the given number of leaves, built once.
+func treeBenchMMR(leaves int) *Mmr {
+	if m, ok := treeBenchMmrs[leaves]; ok {
+		return m
+	}
+	// Ten million leaves take a few GB, collect garbage eagerly meanwhile.
+	defer debug.SetGCPercent(debug.SetGCPercent(20))
+	nodes := make([]*Node, leaves)
+	d := big.NewInt(1000)
+	for i := range nodes {
+		nodes[i] = NewNode(BytesToHash(IntToBytes(i)), d)
+	}
+	m := NewMMR()
+	m.PushBatch(nodes)
+	treeBenchMmrs[leaves] = m
+	return m
+}
+
+func benchmarkProofSizes(b *testing.B, run func(b *testing.B, m *Mmr)) {
+	for _, leaves := range []int{1000000, 10000000} {
+		b.Run(fmt.Sprintf("%dM", leaves/1000000), func(b *testing.B) {
+			run(b, treeBenchMMR(leaves))
+		})
+	}
+}
+
+func BenchmarkGenProof(b *testing.B) {
+	benchmarkProofSizes(b, func(b *testing.B, m *Mmr) {
+		params := DefaultProofParams()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			m.CreateNewProof(params)
+		}
+	})
+}
+
+func BenchmarkVerifyProof(b *testing.B) {
+	benchmarkProofSizes(b, func(b *testing.B, m *Mmr) {
+		params := DefaultProofParams()
+		proof, _ := m.CreateNewProof(params)
+		pBlocks, err := VerifyRequiredBlocks(proof, params)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if !proof.VerifyProof(pBlocks, nil) {
+				b.Fatal("proof rejected")
+			}
+		}
+	})
+}
@@ -41,19 +41,16 @@ func parent_offset(height int) uint64 {
 func sibling_offset(height int) uint64 {
 	return (uint64(2) << uint64(height)) - 1
 }
-func merge(left, right *Node) *Node {
-	parent := &Node{}
-	hashes := make([]common.Hash, 0, 0)
-	hashes = append(append(hashes, left.getHash()), right.getHash())
-	parent.setHash(RlpHash(hashes))
-	parent.setDifficulty(new(big.Int).Add(left.getDifficulty(), right.getDifficulty()))
-	parent.setIndex(right.getIndex() + 1)
-	return parent
-}
-func merge2(left, right common.Hash) common.Hash {
-	hashes := make([]common.Hash, 0, 0)
-	hashes = append(append(hashes, left), right)
-	return RlpHash(hashes)
+
+// merge returns the parent of two nodes, hashed with h and with the payload
+// merged by g, which may be nil.
+func merge(h Hasher, g Merger, left, right *Node) *Node {
+	return &Node{
+		value:      mergeHash(h, left.value, right.value, left.difficulty, right.difficulty, left.payload, right.payload),
+		difficulty: new(big.Int).Add(left.difficulty, right.difficulty),
+		payload:    mergePayload(g, left.payload, right.payload),
+		index:      right.index + 1,
+	}
 }
 func left_peak_pos_by_height(height int) uint64 {
 	return (uint64(1) << uint64(height+1)) - 2
@@ -132,20 +129,12 @@ func NextPowerOfTwo(n uint64) uint64 {
 	n++
 	return n
 }
+
+// GetNodeFromLeaf returns the number of nodes of the complete subtrees of an
+// MMR with ln leaves, which is also the position of leaf ln: every set bit b
+// of ln stands for a complete subtree of 2^(b+1)-1 nodes.
 func GetNodeFromLeaf(ln uint64) uint64 {
-	position, remaining := uint64(0), ln
-	for {
-		if remaining == 0 {
-			break
-		}
-		leftTreeLeafNumber := remaining
-		if !IsPowerOfTwo(remaining) {
-			leftTreeLeafNumber = NextPowerOfTwo(remaining) / 2
-		}
-		position += leftTreeLeafNumber + leftTreeLeafNumber - 1
-		remaining = remaining - leftTreeLeafNumber
-	}
-	return position
+	return 2*ln - uint64(bits.OnesCount64(ln))
 }
 
 // calculate logarithm of x for base b:
@@ -246,37 +235,7 @@ func SortAndRemoveRepeatForProofBlocks(slc []*ProofBlock) []*ProofBlock {
 	}
 	return result
 }
-func reverseForProofBlocks(s []*ProofBlock) []*ProofBlock {
-	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
-		s[i], s[j] = s[j], s[i]
-	}
-	return s
-}
-func binary_search(arr []uint64, key uint64) int {
-	low, height := 0, len(arr)-1
-	mid := 0
-	for low <= height {
-		mid = (height + low) / 2
-		if key == arr[mid] {
-			return mid
-		} else if key > arr[mid] {
-			low = mid + 1
-			if low > height {
-				return low
-			}
-		} else {
-			height = mid - 1
-		}
-	}
-	return mid
-}
 
-func splitAt(sli []uint64, pos int) ([]uint64, []uint64) {
-	if pos > len(sli) {
-		panic("out of slice")
-	}
-	return sli[:pos], sli[pos:]
-}
 
 // Get depth of the Mmr with a specified leaf_number
 func get_depth(leaf_number uint64) int {
@@ -303,3 +262,27 @@ func get_left_leaf_number(leaf_number uint64) uint64 {
 		return NextPowerOfTwo(leaf_number) / 2
 	}
 }
+
+// number of nodes stored for an MMR with leaf_number leaves, including the
+// nodes bagging the peaks into a single root
+func leaf_to_mmr_size(leaf_number uint64) uint64 {
+	if leaf_number == 0 {
+		return 0
+	}
+	return leaf_to_node_number(leaf_number)
+}
+
+// positions of the peaks of an MMR with leaf_number leaves, from left to right
+func peak_positions(leaf_number uint64) []uint64 {
+	res, aggr_leaf_number, remaining := []uint64{}, uint64(0), leaf_number
+	for remaining > 0 {
+		left_tree_leaf_number := remaining
+		if !IsPowerOfTwo(remaining) {
+			left_tree_leaf_number = NextPowerOfTwo(remaining) / 2
+		}
+		aggr_leaf_number += left_tree_leaf_number
+		res = append(res, GetNodeFromLeaf(aggr_leaf_number)-1)
+		remaining -= left_tree_leaf_number
+	}
+	return res
+}
@@ -74,3 +74,13 @@ func Test04(t *testing.T) {
 	fmt.Println(res)
 	fmt.Println("finish")
 }
+
+func TestGetNodeFromLeaf(t *testing.T) {
+	// The complete subtrees of n leaves are the peaks of the standard MMR.
+	for n := uint64(1); n < 5000; n++ {
+		peaks := peak_positions(n)
+		if have, want := GetNodeFromLeaf(n), peaks[len(peaks)-1]+1; have != want {
+			t.Fatalf("%d leaves: have %d, want %d", n, have, want)
+		}
+	}
+}
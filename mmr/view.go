@@ -0,0 +1,79 @@
+package mmr
+
+import "fmt"
+
+// prefixStore is a copy-on-write view of the MMR made of the first leaves of
+// another one. The nodes of its complete subtrees sit at the same positions
+// in both and are read from the base store, the few nodes past them, such as
+// the ones bagging the peaks, are owned by the view. Writes only ever touch
+// the view's own nodes, the base is never modified.
+type prefixStore struct {
+	base nodeStore
+	std  uint64  // number of nodes shared with base
+	own  []*Node // nodes past the shared ones, in position order
+}
+
+func (s *prefixStore) get(pos uint64) *Node {
+	if pos < s.std {
+		return s.base.get(pos)
+	}
+	if pos-s.std < uint64(len(s.own)) {
+		return s.own[pos-s.std]
+	}
+	return nil
+}
+func (s *prefixStore) append(n *Node) {
+	s.own = append(s.own, n)
+}
+func (s *prefixStore) truncate(size uint64) {
+	if size < s.std {
+		s.std, s.own = size, nil
+	} else if size-s.std < uint64(len(s.own)) {
+		s.own = s.own[:size-s.std]
+	}
+}
+func (s *prefixStore) size() uint64 {
+	return s.std + uint64(len(s.own))
+}
+func (s *prefixStore) flush() error {
+	return nil
+}
+
+// PrefixAt returns a view of the MMR made of the first leafNum leaves of m,
+// e.g. the one committed to by an older block. It shares the nodes of m and
+// only computes the O(log n) nodes bagging its peaks, so it is cheap to
+// create. The view can be modified like any MMR without affecting m, it stays
+// valid as long as m is not popped below leafNum leaves.
+func (m *Mmr) PrefixAt(leafNum uint64) (*Mmr, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.prefixAt(leafNum)
+}
+func (m *Mmr) prefixAt(leafNum uint64) (*Mmr, error) {
+	if leafNum == 0 || leafNum > m.leafNum {
+		return nil, fmt.Errorf("%w: %d of %d", ErrLeafRange, leafNum, m.leafNum)
+	}
+	positions := peak_positions(leafNum)
+	s := &prefixStore{base: m.values, std: positions[len(positions)-1] + 1}
+	peaks := m.peaksAt(leafNum)
+	root := peaks[len(peaks)-1]
+	for i := len(peaks) - 2; i >= 0; i-- {
+		root = merge(m.hasher, m.merger, peaks[i], root)
+		s.own = append(s.own, root)
+	}
+	return &Mmr{values: s, hasher: m.hasher, merger: m.merger, curSize: s.size(), leafNum: leafNum}, nil
+}
+
+// Snapshot returns a copy-on-write view of all of m, see PrefixAt. Unlike
+// Copy it takes O(log n) time. The nodes bagging the peaks are recomputed
+// rather than shared, as m replaces them on every Push. Snapshots may be
+// taken and used while another goroutine pushes to m.
+func (m *Mmr) Snapshot() *Mmr {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.leafNum == 0 {
+		return &Mmr{values: &prefixStore{base: m.values}, hasher: m.hasher, merger: m.merger}
+	}
+	view, _ := m.prefixAt(m.leafNum)
+	return view
+}
@@ -0,0 +1,181 @@
+package mmr
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+	"github.com/marcopoloprotocol/flyclientDemo/diskdb/memorydb"
+)
+
+func TestPrefixAt(t *testing.T) {
+	full, built := NewMMR(), []*Mmr{nil}
+	for i := 0; i < 300; i++ {
+		full.Push(NewNode(BytesToHash(IntToBytes(i)), big.NewInt(int64(1000+i))))
+		m := NewMMR()
+		for j := 0; j <= i; j++ {
+			m.Push(NewNode(BytesToHash(IntToBytes(j)), big.NewInt(int64(1000+j))))
+		}
+		built = append(built, m)
+	}
+	for leafNum := uint64(1); leafNum <= full.GetLeafNumber(); leafNum++ {
+		view, err := full.PrefixAt(leafNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := built[leafNum]
+		if view.GetSize() != want.GetSize() || view.GetLeafNumber() != leafNum {
+			t.Fatalf("%d leaves: size %d, want %d", leafNum, view.GetSize(), want.GetSize())
+		}
+		for pos := uint64(0); pos < want.GetSize(); pos++ {
+			have, exp := view.getNode(pos), want.getNode(pos)
+			if have.getHash() != exp.getHash() || have.getDifficulty().Cmp(exp.getDifficulty()) != 0 || have.getIndex() != pos {
+				t.Fatalf("%d leaves: node %d is %v, want %v", leafNum, pos, have, exp)
+			}
+		}
+		if leafNum > 100 {
+			if have, exp := proofOf(t, view), proofOf(t, want); have.String() != exp.String() {
+				t.Fatalf("%d leaves: proofs differ", leafNum)
+			}
+		}
+	}
+	// Views of views see the same nodes.
+	view, _ := full.PrefixAt(250)
+	inner, err := view.PrefixAt(130)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inner.GetRoot() != built[130].GetRoot() {
+		t.Fatal("nested view has the wrong root")
+	}
+	if _, err := full.PrefixAt(301); !errors.Is(err, ErrLeafRange) {
+		t.Fatalf("have %v, want %v", err, ErrLeafRange)
+	}
+}
+
+func proofOf(t *testing.T, m *Mmr) *ProofInfo {
+	params := testParams()
+	params.RightDifficulty = big.NewInt(10000)
+	proof, _ := m.CreateNewProof(params)
+	pBlocks, err := VerifyRequiredBlocks(proof, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proof.VerifyProof(pBlocks, nil) {
+		t.Fatal("proof of view rejected")
+	}
+	return proof
+}
+
+func TestSnapshot(t *testing.T) {
+	push := func(m *Mmr, from, to int) {
+		for i := from; i < to; i++ {
+			m.Push(NewNode(BytesToHash(IntToBytes(i)), big.NewInt(1000)))
+		}
+	}
+	m := NewMMR()
+	push(m, 0, 1000)
+	snap, cpy := m.Snapshot(), m.Copy()
+
+	// Both sides change independently, the snapshot behaves like a copy.
+	push(m, 1000, 1100)
+	for i := 0; i < 300; i++ {
+		snap.Pop()
+		cpy.Pop()
+	}
+	push(snap, 5000, 5500)
+	push(cpy, 5000, 5500)
+	if snap.GetRoot() != cpy.GetRoot() || snap.GetSize() != cpy.GetSize() {
+		t.Fatal("snapshot diverged from copy")
+	}
+	want := NewMMR()
+	push(want, 0, 1100)
+	if m.GetRoot() != want.GetRoot() {
+		t.Fatal("snapshot changed the base mmr")
+	}
+	if empty := NewMMR().Snapshot(); empty.GetLeafNumber() != 0 || empty.GetRootNode() != nil {
+		t.Fatal("snapshot of empty mmr is not empty")
+	}
+}
+
+// Run with -race: proofs made while leaves are pushed must be consistent with
+// the MMR at some point in time.
+func TestConcurrentProofs(t *testing.T) {
+	const leaves = 2000
+	roots := make([]common.Hash, leaves+1)
+	ref := NewMMR()
+	for i := 0; i < leaves; i++ {
+		ref.Push(testLeaf(i))
+		roots[i+1] = ref.GetRoot()
+	}
+	disk, _ := OpenMMR(memorydb.New(), nil)
+	for name, m := range map[string]*Mmr{"mem": NewMMR(), "disk": disk} {
+		for i := 0; i < 100; i++ {
+			m.Push(testLeaf(i))
+		}
+		var (
+			wg   sync.WaitGroup
+			done = make(chan struct{})
+		)
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					proof, _ := m.CreateNewProof(testParams())
+					if proof.RootHash != roots[proof.LeafNumber] {
+						t.Errorf("%s: proof of %d leaves has the wrong root", name, proof.LeafNumber)
+						return
+					}
+					pBlocks, err := VerifyRequiredBlocks(proof, testParams())
+					if err != nil || !proof.VerifyProof(pBlocks, nil) {
+						t.Errorf("%s: proof of %d leaves rejected: %v", name, proof.LeafNumber, err)
+						return
+					}
+					if _, err := m.ProveLeaves([]uint64{0, 50}); err != nil {
+						t.Errorf("%s: %v", name, err)
+						return
+					}
+					if m.GetSize() == 0 || m.GetRootNode() == nil {
+						t.Errorf("%s: empty mmr", name)
+						return
+					}
+				}
+			}()
+		}
+		for i := 100; i < leaves; i++ {
+			m.Push(testLeaf(i))
+			if i%100 == 0 {
+				if err := m.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		close(done)
+		wg.Wait()
+		if m.GetRoot() != roots[leaves] {
+			t.Fatalf("%s: wrong root after concurrent proofs", name)
+		}
+	}
+}
+
+func benchmarkTail(b *testing.B, tail func(m *Mmr) *Mmr) {
+	m := NewMMR()
+	for i := 0; i < 500000; i++ {
+		m.Push(NewNode(BytesToHash(IntToBytes(i)), big.NewInt(1000)))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tail(m).Pop()
+	}
+}
+
+func BenchmarkTailCopy(b *testing.B)     { benchmarkTail(b, (*Mmr).Copy) }
+func BenchmarkTailSnapshot(b *testing.B) { benchmarkTail(b, (*Mmr).Snapshot) }
@@ -0,0 +1,136 @@
+package flyclientdemo
+
+import "fmt"
+
+// ReorgEvent is sent to subscribers whenever the canonical chain switches to
+// a heavier branch. Dropped and Added are in ascending block order; Ancestor
+// is the last block both branches have in common.
+type ReorgEvent struct {
+	OldHead  *Block
+	NewHead  *Block
+	Ancestor *Block
+	Dropped  []*Block
+	Added    []*Block
+}
+
+// SubscribeReorgEvent registers ch to receive reorg events. Events are sent
+// without blocking the chain, so ch should be buffered: events which do not
+// fit are dropped.
+func (bc *BlockChain) SubscribeReorgEvent(ch chan<- ReorgEvent) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.reorgSubs = append(bc.reorgSubs, ch)
+}
+
+func (bc *BlockChain) sendReorgEvent(ev ReorgEvent) {
+	for _, ch := range bc.reorgSubs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// reorg makes newHead, a stored side chain block, the head of the chain. The
+// MMR is unwound with Pop down to the common ancestor and re-extended with the
+// blocks of the new branch. The dropped blocks keep their peaks in the
+// database, so the old branch can still be extended and win back later.
+// Every block is loaded before the MMR is touched, and the MMR is restored to
+// the old head if writing the new one fails.
+// Proofs in progress are waited for, as they read the nodes being popped.
+func (bc *BlockChain) reorg(newHead *Block) error {
+	var (
+		oldHead = bc.header
+		added   []*Block
+		dropped []*Block
+	)
+	ancestor := newHead
+	for {
+		if hash, err := readCanonicalHash(bc.db, ancestor.Number); err == nil && hash == bc.hash(ancestor) {
+			break
+		}
+		added = append(added, ancestor)
+		parent, err := readBlock(bc.db, ancestor.PreHash)
+		if err != nil {
+			return err
+		}
+		ancestor = parent
+	}
+	for i, j := 0, len(added)-1; i < j; i, j = i+1, j-1 {
+		added[i], added[j] = added[j], added[i]
+	}
+	for n := oldHead.Number; n > ancestor.Number; n-- {
+		b, err := bc.GetBlockByNumber(n)
+		if err != nil {
+			return err
+		}
+		if b.Number != n {
+			return fmt.Errorf("canonical block #%d is numbered %d", n, b.Number)
+		}
+		dropped = append([]*Block{b}, dropped...)
+	}
+
+	bc.proving.Lock()
+	defer bc.proving.Unlock()
+
+	if err := bc.switchBranch(dropped, added); err != nil {
+		for bc.Mmr.GetLeafNumber() > ancestor.Number+1 {
+			bc.Mmr.Pop()
+		}
+		for _, b := range dropped {
+			bc.Mmr.Push(b.leaf(bc.Mmr.Hasher()))
+		}
+		if ferr := bc.Mmr.Flush(); ferr != nil {
+			return fmt.Errorf("%w, restoring the mmr: %v", err, ferr)
+		}
+		return err
+	}
+	bc.header = newHead
+	bc.sendReorgEvent(ReorgEvent{
+		OldHead:  oldHead,
+		NewHead:  newHead,
+		Ancestor: ancestor,
+		Dropped:  dropped,
+		Added:    added,
+	})
+	return nil
+}
+
+// switchBranch replaces the dropped blocks, the canonical ones after the
+// common ancestor, with the added ones in the MMR and the database, making the
+// last added block the head. As when extending the head, the MMR is flushed
+// first, and recoverMmr takes it back to the old branch on open if the new
+// head is not written.
+func (bc *BlockChain) switchBranch(dropped, added []*Block) error {
+	batch := bc.db.NewBatch()
+	for i := len(dropped) - 1; i >= 0; i-- {
+		b := dropped[i]
+		if err := writePeaks(batch, bc.hash(b), bc.Mmr.PeaksAt(b.Number+1)); err != nil {
+			return err
+		}
+		bc.Mmr.Pop()
+	}
+	for _, b := range added {
+		hash := bc.hash(b)
+		bc.Mmr.Push(b.leaf(bc.Mmr.Hasher()))
+		if err := writeCanonicalHash(batch, b.Number, hash); err != nil {
+			return err
+		}
+	}
+	newHead := added[len(added)-1]
+	for _, b := range dropped {
+		if b.Number <= newHead.Number {
+			continue
+		}
+		if err := deleteCanonicalHash(batch, b.Number); err != nil {
+			return err
+		}
+	}
+	if err := writeHeadHash(batch, bc.hash(newHead)); err != nil {
+		return err
+	}
+	if err := bc.Mmr.Flush(); err != nil {
+		return err
+	}
+	return batch.Write()
+}
@@ -0,0 +1,157 @@
+package flyclientdemo
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/big"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+	"github.com/marcopoloprotocol/flyclientDemo/diskdb"
+	"github.com/marcopoloprotocol/flyclientDemo/mmr"
+	"github.com/marcopoloprotocol/flyclientDemo/rlp"
+)
+
+// The database layout of a BlockChain. Blocks are stored by hash, the
+// canonical chain is indexed by number and the MMR lives under its own
+// prefix in the same database.
+var (
+	headBlockKey = []byte("LastBlock") // headBlockKey -> hash of the current head
+
+	blockPrefix     = []byte("b") // blockPrefix + hash -> rlp(block)
+	canonicalPrefix = []byte("h") // canonicalPrefix + num (uint64 big endian) -> hash
+	tdPrefix        = []byte("t") // tdPrefix + hash -> total difficulty
+	peaksPrefix     = []byte("p") // peaksPrefix + hash -> mmr peaks of a side chain block
+	mmrPrefix       = []byte("m") // mmrPrefix + mmr key -> mmr node or meta
+
+	ErrBlockNotFound = errors.New("block not found")
+)
+
+func encodeBlockNumber(number uint64) []byte {
+	enc := make([]byte, 8)
+	binary.BigEndian.PutUint64(enc, number)
+	return enc
+}
+
+func blockKey(hash common.Hash) []byte {
+	return append(append([]byte{}, blockPrefix...), hash.Bytes()...)
+}
+
+func canonicalKey(number uint64) []byte {
+	return append(append([]byte{}, canonicalPrefix...), encodeBlockNumber(number)...)
+}
+
+func readBlock(db diskdb.Reader, hash common.Hash) (*Block, error) {
+	enc, err := db.Get(blockKey(hash))
+	if err != nil || len(enc) == 0 {
+		return nil, ErrBlockNotFound
+	}
+	b := new(Block)
+	if err := rlp.DecodeBytes(enc, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func writeBlock(db diskdb.KeyValueWriter, hash common.Hash, b *Block) error {
+	enc, err := rlp.EncodeToBytes(b)
+	if err != nil {
+		return err
+	}
+	return db.Put(blockKey(hash), enc)
+}
+
+func readCanonicalHash(db diskdb.Reader, number uint64) (common.Hash, error) {
+	enc, err := db.Get(canonicalKey(number))
+	if err != nil || len(enc) == 0 {
+		return common.Hash{}, ErrBlockNotFound
+	}
+	return common.BytesToHash(enc), nil
+}
+
+func writeCanonicalHash(db diskdb.KeyValueWriter, number uint64, hash common.Hash) error {
+	return db.Put(canonicalKey(number), hash.Bytes())
+}
+
+func readHeadHash(db diskdb.Reader) (common.Hash, bool) {
+	if ok, _ := db.Has(headBlockKey); !ok {
+		return common.Hash{}, false
+	}
+	enc, err := db.Get(headBlockKey)
+	if err != nil || len(enc) == 0 {
+		return common.Hash{}, false
+	}
+	return common.BytesToHash(enc), true
+}
+
+func writeHeadHash(db diskdb.KeyValueWriter, hash common.Hash) error {
+	return db.Put(headBlockKey, hash.Bytes())
+}
+
+func deleteCanonicalHash(db diskdb.KeyValueWriter, number uint64) error {
+	return db.Delete(canonicalKey(number))
+}
+
+func tdKey(hash common.Hash) []byte {
+	return append(append([]byte{}, tdPrefix...), hash.Bytes()...)
+}
+
+func readTd(db diskdb.Reader, hash common.Hash) (*big.Int, error) {
+	enc, err := db.Get(tdKey(hash))
+	if err != nil || len(enc) == 0 {
+		return nil, ErrBlockNotFound
+	}
+	td := new(big.Int)
+	if err := rlp.DecodeBytes(enc, td); err != nil {
+		return nil, err
+	}
+	return td, nil
+}
+
+func writeTd(db diskdb.KeyValueWriter, hash common.Hash, td *big.Int) error {
+	enc, err := rlp.EncodeToBytes(td)
+	if err != nil {
+		return err
+	}
+	return db.Put(tdKey(hash), enc)
+}
+
+// storedPeak is the database form of an mmr peak.
+type storedPeak struct {
+	Hash       common.Hash
+	Difficulty *big.Int
+	Payload    []byte
+}
+
+func peaksKey(hash common.Hash) []byte {
+	return append(append([]byte{}, peaksPrefix...), hash.Bytes()...)
+}
+
+// readPeaks returns the peaks of the MMR over all blocks up to and including
+// the side chain block with the given hash.
+func readPeaks(db diskdb.Reader, hash common.Hash) ([]*mmr.Node, error) {
+	enc, err := db.Get(peaksKey(hash))
+	if err != nil || len(enc) == 0 {
+		return nil, ErrBlockNotFound
+	}
+	var stored []storedPeak
+	if err := rlp.DecodeBytes(enc, &stored); err != nil {
+		return nil, err
+	}
+	peaks := make([]*mmr.Node, len(stored))
+	for i, p := range stored {
+		peaks[i] = mmr.NewNodeWithPayload(p.Hash, p.Difficulty, p.Payload)
+	}
+	return peaks, nil
+}
+
+func writePeaks(db diskdb.KeyValueWriter, hash common.Hash, peaks []*mmr.Node) error {
+	stored := make([]storedPeak, len(peaks))
+	for i, p := range peaks {
+		stored[i] = storedPeak{Hash: p.GetHash(), Difficulty: p.GetDifficulty(), Payload: p.GetPayload()}
+	}
+	enc, err := rlp.EncodeToBytes(stored)
+	if err != nil {
+		return err
+	}
+	return db.Put(peaksKey(hash), enc)
+}
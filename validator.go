@@ -0,0 +1,81 @@
+package flyclientdemo
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/marcopoloprotocol/flyclientDemo/common"
+	"github.com/marcopoloprotocol/flyclientDemo/mmr"
+)
+
+var (
+	ErrGenesisBlock      = errors.New("can not add genesis block")
+	ErrKnownBlock        = errors.New("block already known")
+	ErrUnknownParent     = errors.New("unknown parent")
+	ErrInvalidNumber     = errors.New("block number does not follow its parent")
+	ErrInvalidMRoot      = errors.New("mmr root does not match the chain")
+	ErrInvalidDifficulty = errors.New("invalid difficulty")
+	ErrInvalidTime       = errors.New("invalid block time")
+	ErrInvalidPoW        = errors.New("invalid proof-of-work")
+)
+
+// ValidationError is returned for blocks rejected by the BlockChain. Err is
+// one of the Err* values above, so callers can test it with errors.Is.
+type ValidationError struct {
+	Number uint64
+	Hash   common.Hash
+	Err    error
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("block #%d [%x]: %v", e.Number, e.Hash[:4], e.Err)
+	}
+	return fmt.Sprintf("block #%d [%x]: %v: %s", e.Number, e.Hash[:4], e.Err, e.Reason)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func invalidBlock(b *Block, err error, format string, args ...interface{}) error {
+	return &ValidationError{
+		Number: b.Number,
+		Hash:   b.Hash(),
+		Err:    err,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+// withHash sets the hash of b, the block err is about, on a *ValidationError
+// to its hash under the chain's hasher. The error may come from the engine,
+// which hashes with SHA3.
+func (bc *BlockChain) withHash(b *Block, err error) error {
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		verr.Hash = bc.hash(b)
+	}
+	return err
+}
+
+// validateBlock checks that b can be appended to parent, whose MMR (over all
+// blocks up to and including parent) has root node history: its number
+// continues the chain, its MRoot commits to that MMR, its time and difficulty
+// follow the adjustment rules and its nonce satisfies the proof-of-work
+// target.
+func (bc *BlockChain) validateBlock(parent *Block, history *mmr.Node, b *Block) error {
+	if b.Number != parent.Number+1 {
+		return invalidBlock(b, ErrInvalidNumber, "parent is #%d", parent.Number)
+	}
+	if mroot := history.GetHash(); b.MRoot != mroot {
+		return invalidBlock(b, ErrInvalidMRoot, "have %s, want %s", b.MRoot, mroot)
+	}
+	if err := bc.engine.VerifyDifficulty(parent, b); err != nil {
+		return err
+	}
+	if err := bc.engine.VerifyRetarget(history, b); err != nil {
+		return err
+	}
+	return bc.engine.VerifySeal(b)
+}